@@ -2,7 +2,6 @@ package address
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"strings"
 )
@@ -80,11 +79,7 @@ func CreateAddress(input string) (*Address, error) {
 func LookupMX(address *Address) ([]*net.MX, error) {
 	mxrecords, err := net.LookupMX(address.Domain)
 	if err != nil {
-
 		return nil, err
 	}
-	for _, mx := range mxrecords {
-		fmt.Println(mx.Host, mx.Pref)
-	}
-	return mxrecords, err
+	return mxrecords, nil
 }
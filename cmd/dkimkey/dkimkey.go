@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/gomail/dkim"
+	"github.com/infodancer/gomail/domain"
+)
+
+var Version string
+
+// maxTXTString is the longest string a TXT record can hold; longer records are split
+const maxTXTString = 255
+
+func main() {
+	domainFlag := flag.String("domain", "", "The domain to create a signing key for")
+	selector := flag.String("selector", "default", "The DKIM selector naming the key")
+	keyType := flag.String("type", dkim.KeyTypeRSA, "The key type: rsa or ed25519")
+	bits := flag.Int("bits", 2048, "The size of RSA keys")
+	printFlag := flag.Bool("print", false, "Print the DNS record for the existing key instead of creating one")
+	versionFlag := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if versionFlag != nil && *versionFlag {
+		log.Println("Version: " + Version)
+		os.Exit(0)
+	}
+	if *domainFlag == "" {
+		log.Println("a domain is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	name := strings.ToLower(*domainFlag)
+	dom, err := domain.GetDomain(name)
+	if err != nil {
+		log.Printf("error finding domain: %v", err)
+		os.Exit(1)
+	}
+	path, err := dom.DKIMKeyPath(*selector)
+	if err != nil {
+		log.Printf("error finding key: %v", err)
+		os.Exit(1)
+	}
+
+	var key crypto.Signer
+	if *printFlag {
+		key, err = dkim.LoadPrivateKey(path)
+		if err != nil {
+			log.Printf("error loading key: %v", err)
+			os.Exit(2)
+		}
+	} else {
+		key, err = createKey(path, *keyType, *bits)
+		if err != nil {
+			log.Printf("error creating key: %v", err)
+			os.Exit(2)
+		}
+		log.Printf("Wrote key to %v", path)
+	}
+
+	record, err := dkim.KeyRecord(key)
+	if err != nil {
+		log.Printf("error creating DNS record: %v", err)
+		os.Exit(2)
+	}
+	fmt.Printf("%s._domainkey.%s. IN TXT ( %s )\n", *selector, name, quoteTXT(record))
+	os.Exit(0)
+}
+
+// createKey generates a key and saves it, refusing to replace an existing key
+func createKey(path string, keyType string, bits int) (crypto.Signer, error) {
+	key, err := dkim.GenerateKey(keyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dkim.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if err := os.Remove(path); err != nil {
+			log.Printf("error removing key %v: %v", path, err)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// quoteTXT splits a record into quoted strings short enough for a TXT record
+func quoteTXT(record string) string {
+	var parts []string
+	for len(record) > maxTXTString {
+		parts = append(parts, `"`+record[:maxTXTString]+`"`)
+		record = record[maxTXTString:]
+	}
+	parts = append(parts, `"`+record+`"`)
+	return strings.Join(parts, " ")
+}
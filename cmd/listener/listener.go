@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -10,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +19,9 @@ import (
 
 var Version string
 
+// copyBufferSize is the size of the buffers used to relay data between the connection and the command
+const copyBufferSize = 32 * 1024
+
 // isConnectionClosed checks if an error is due to a closed network connection
 func isConnectionClosed(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
@@ -106,37 +109,12 @@ func startListener(cfgfile string) {
 	var listener net.Listener
 	
 	if serverConfig.TLS.Enabled {
-		// Load TLS certificate and key
-		cert, err := tls.LoadX509KeyPair(serverConfig.TLS.CertFile, serverConfig.TLS.KeyFile)
+		tlsConfig, err := serverConfig.TLS.TLSConfig()
 		if err != nil {
-			log.Printf("error loading TLS certificate for %s: %v", cfgfile, err)
+			log.Printf("error configuring TLS for %s: %v", cfgfile, err)
 			return
 		}
-		
-		// Configure TLS
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-		
-		// Set minimum TLS version if specified
-		switch serverConfig.TLS.MinTLSVersion {
-		case "1.0":
-			tlsConfig.MinVersion = tls.VersionTLS10
-		case "1.1":
-			tlsConfig.MinVersion = tls.VersionTLS11
-		case "1.2":
-			tlsConfig.MinVersion = tls.VersionTLS12
-		case "1.3":
-			tlsConfig.MinVersion = tls.VersionTLS13
-		default:
-			tlsConfig.MinVersion = tls.VersionTLS12 // Default to TLS 1.2
-		}
-		
-		// Set client certificate requirements
-		if serverConfig.TLS.RequireClientCert {
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		}
-		
+
 		listener, err = tls.Listen("tcp", address, tlsConfig)
 		if err != nil {
 			log.Printf("error starting TLS listener on %s for config %s: %v", address, cfgfile, err)
@@ -216,6 +194,27 @@ func startListener(cfgfile string) {
 	}
 }
 
+// connectionEnv describes the connection to the command using the ucspi-tcp environment variables
+// PROTO is set to SSL when the listener has already negotiated TLS with the client
+func connectionEnv(conn net.Conn) []string {
+	proto := "TCP"
+	if _, ok := conn.(*tls.Conn); ok {
+		proto = "SSL"
+	}
+	env := []string{"PROTO=" + proto}
+	if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		env = append(env,
+			"TCPLOCALIP="+localAddr.IP.String(),
+			"TCPLOCALPORT="+strconv.Itoa(localAddr.Port))
+	}
+	if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		env = append(env,
+			"TCPREMOTEIP="+remoteAddr.IP.String(),
+			"TCPREMOTEPORT="+strconv.Itoa(remoteAddr.Port))
+	}
+	return env
+}
+
 func handleConnection(conn net.Conn, command string, args []string, idleTimeoutSeconds int) {
 	log.Printf("handling connection from %s", conn.RemoteAddr())
 
@@ -230,6 +229,7 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 
 	// Start the configured command
 	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), connectionEnv(conn)...)
 
 	// Get pipes for stdin/stdout
 	stdin, err := cmd.StdinPipe()
@@ -295,7 +295,9 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 			}
 		}()
 
-		reader := bufio.NewReader(conn)
+		// Data is copied as raw bytes rather than lines so that the command
+		// can negotiate TLS (STARTTLS) over its standard input and output
+		buf := make([]byte, copyBufferSize)
 		for {
 			select {
 			case <-stopReading:
@@ -308,7 +310,7 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 					}
 				}
 
-				line, err := reader.ReadString('\n')
+				n, err := conn.Read(buf)
 				if err != nil {
 					if err != io.EOF && !isConnectionClosed(err) {
 						// Check if this is a timeout error
@@ -321,7 +323,7 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 					return
 				}
 
-				_, err = stdin.Write([]byte(line))
+				_, err = stdin.Write(buf[:n])
 				if err != nil {
 					if !isConnectionClosed(err) {
 						log.Printf("error writing to command stdin: %v", err)
@@ -336,19 +338,19 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 	go func() {
 		defer wg.Done()
 
-		scanner := bufio.NewScanner(stdout)
+		buf := make([]byte, copyBufferSize)
 		for {
 			select {
 			case <-stopWriting:
 				return
 			default:
-				if !scanner.Scan() {
-					if err := scanner.Err(); err != nil {
+				n, err := stdout.Read(buf)
+				if err != nil {
+					if err != io.EOF {
 						log.Printf("error reading from command stdout: %v", err)
 					}
 					return
 				}
-				line := scanner.Text() + "\n"
 
 				// Update deadline before each write if timeout is configured
 				if idleTimeoutSeconds > 0 {
@@ -357,7 +359,7 @@ func handleConnection(conn net.Conn, command string, args []string, idleTimeoutS
 					}
 				}
 
-				_, err := conn.Write([]byte(line))
+				_, err = conn.Write(buf[:n])
 				if err != nil {
 					if !isConnectionClosed(err) {
 						log.Printf("error writing to connection: %v", err)
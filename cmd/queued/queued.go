@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/infodancer/gomail/delivery"
+	"github.com/infodancer/gomail/queue"
+)
+
+var Version string
+
+func main() {
+	cfgfile := flag.String("cfg", "/opt/infodancer/gomail/etc/queued.toml", "The configuration file")
+	versionFlag := flag.Bool("version", false, "Print the version and exit")
+	onceFlag := flag.Bool("once", false, "Process the queue once and exit")
+	flag.Parse()
+
+	if versionFlag != nil && *versionFlag {
+		log.Println("Version: " + Version)
+		os.Exit(0)
+	}
+
+	var cfg queue.Config
+	err := config.LoadTOMLConfig(*cfgfile, &cfg)
+	if err != nil {
+		log.Printf("error reading configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Use the same queue as smtpd if no directory is configured
+	if cfg.Directory == "" {
+		cfg.Directory = os.Getenv("QUEUE_DIR")
+		if cfg.Directory == "" {
+			cfg.Directory = "/tmp/test-queue"
+		}
+	}
+	q, err := queue.GetQueue(cfg.Directory)
+	if err != nil {
+		log.Printf("error initializing queue: %v", err)
+		os.Exit(1)
+	}
+
+	runner := &queue.Runner{
+		Queue: q,
+		Transport: &delivery.Router{
+			Local:  &delivery.Local{},
+			Remote: &delivery.Remote{Hostname: cfg.Hostname, RequireTLS: cfg.RequireTLS},
+		},
+		Schedule: cfg.Schedule(),
+		Hostname: cfg.Hostname,
+	}
+
+	if onceFlag != nil && *onceFlag {
+		if err := runner.RunOnce(); err != nil {
+			log.Printf("error processing queue: %v", err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	runner.Run(cfg.RunInterval(), stop)
+	os.Exit(0)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/infodancer/gomail/config"
 	"github.com/infodancer/gomail/connect"
+	"github.com/infodancer/gomail/domain"
 	"github.com/infodancer/gomail/queue"
 
 	"github.com/infodancer/gomail/smtpd"
@@ -44,6 +45,12 @@ func main() {
 		}
 	}
 
+	cfg.Auth, err = domain.NewAuthenticator(cfg.Authentication)
+	if err != nil {
+		log.Printf("error configuring authentication: %v", err)
+		os.Exit(1)
+	}
+
 	var c connect.TCPConnection
 	c, err = connect.NewStandardIOConnection()
 	if err != nil {
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"os"
 
@@ -37,6 +38,56 @@ type SecureConnection struct {
 	MinTLSVersion string `toml:"min_tls_version"`
 }
 
+// HasCertificate reports whether a certificate and key have been configured
+func (sc SecureConnection) HasCertificate() bool {
+	return sc.CertFile != "" && sc.KeyFile != ""
+}
+
+// TLSConfig loads the configured certificate and builds a server side tls.Config
+func (sc SecureConnection) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	// Set minimum TLS version if specified
+	switch sc.MinTLSVersion {
+	case "1.0":
+		tlsConfig.MinVersion = tls.VersionTLS10
+	case "1.1":
+		tlsConfig.MinVersion = tls.VersionTLS11
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		tlsConfig.MinVersion = tls.VersionTLS12 // Default to TLS 1.2
+	}
+
+	// Set client certificate requirements
+	if sc.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Authentication selects the backend used to verify user credentials
+type Authentication struct {
+	// Type is the backend to use: "passwd" for per-domain passwd files, "checkpassword"
+	// for an external checkpassword program, or empty to disable authentication
+	Type string `toml:"type"`
+	// Command is the checkpassword program to run
+	Command string `toml:"command"`
+	// Args are the arguments to the checkpassword program, ending with the program it runs on success
+	Args []string `toml:"args"`
+	// PlainSecrets declares that passwd files hold {PLAIN} passwords, which is required
+	// to offer CRAM-MD5 and APOP
+	PlainSecrets bool `toml:"plain_secrets"`
+}
+
 // ServerConfig contains common server configuration
 type ServerConfig struct {
 	// ServerName is the name of the server
@@ -45,6 +96,8 @@ type ServerConfig struct {
 	Listener Listener `toml:"listener"`
 	// TLS contains the TLS configuration
 	TLS SecureConnection `toml:"tls"`
+	// Authentication contains the user authentication configuration
+	Authentication Authentication `toml:"auth"`
 }
 
 // LoadTOMLConfig loads configuration from a TOML file into the provided config struct
@@ -2,14 +2,32 @@ package connect
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 )
 
+// ErrAlreadyEncrypted is returned by StartTLS when the connection is already encrypted
+var ErrAlreadyEncrypted = errors.New("connection is already encrypted")
+
 // TCPConnection holds information about a tcp connection
 type TCPConnection interface {
 	ReadLine() (string, error)
+	// ReadChunk copies exactly n bytes of raw input to w, for commands such as BDAT
+	// that send data of a declared length rather than as lines
+	ReadChunk(w io.Writer, n int64) (int64, error)
 	WriteLine(string) error
+	// Write adds output to the buffer without sending it; it is sent by the next WriteLine or Flush
+	Write(string) error
+	// Flush sends any buffered output
+	Flush() error
+	// InputPending returns true if input has been received that has not yet been read
+	InputPending() bool
 	Close() error
 	GetProto() string
 	GetTCPLocalIP() string
@@ -20,25 +38,37 @@ type TCPConnection interface {
 	GetTCPRemoteHost() string
 	// IsEncrypted returns true if the connection is encrypted
 	IsEncrypted() bool
+	// StartTLS performs a server side TLS handshake on the live connection
+	// Any input buffered before the handshake is discarded
+	StartTLS(cfg *tls.Config) error
 	Logger() *log.Logger
 }
 
 // StandardIOConnection expects stdin, stdout, and TCP info in the environment
 type StandardIOConnection struct {
-	rw     *bufio.ReadWriter
-	logger *log.Logger
+	in        io.Reader
+	out       io.Writer
+	rw        *bufio.ReadWriter
+	logger    *log.Logger
+	encrypted bool
 }
 
 func NewStandardIOConnection() (TCPConnection, error) {
-	r := bufio.NewReader(os.Stdin)
-	w := bufio.NewWriter(os.Stdout)
+	stdcon := newStreamConnection(os.Stdin, os.Stdout)
+	// The listener sets PROTO=SSL when it has already negotiated TLS with the client
+	stdcon.encrypted = strings.EqualFold(os.Getenv("PROTO"), "SSL")
+	return stdcon, nil
+}
 
+// newStreamConnection creates a connection over an arbitrary pair of streams
+func newStreamConnection(in io.Reader, out io.Writer) *StandardIOConnection {
 	logger := log.New(os.Stderr, "", 1|2|6)
-	stdcon := StandardIOConnection{
-		rw:     bufio.NewReadWriter(r, w),
+	return &StandardIOConnection{
+		in:     in,
+		out:    out,
+		rw:     bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(out)),
 		logger: logger,
 	}
-	return &stdcon, nil
 }
 
 // Close currently just flushes the buffers...
@@ -55,10 +85,32 @@ func (c *StandardIOConnection) Logger() *log.Logger {
 	return c.logger
 }
 
-// IsEncrypted indicates whethe the connection is encrypted (but not necessarily authenticated)
-// Stubbed for now
+// IsEncrypted indicates whether the connection is encrypted (but not necessarily authenticated)
+// This is true if the listener negotiated TLS before starting us, or after a successful StartTLS
 func (c *StandardIOConnection) IsEncrypted() bool {
-	return true
+	return c.encrypted
+}
+
+// StartTLS negotiates TLS over stdin and stdout, replacing the plaintext buffers
+func (c *StandardIOConnection) StartTLS(cfg *tls.Config) error {
+	if c.encrypted {
+		return ErrAlreadyEncrypted
+	}
+	if err := c.rw.Flush(); err != nil {
+		return err
+	}
+	// Anything the client sent after the STARTTLS command but before the handshake
+	// must not be treated as part of the encrypted session (RFC 3207 section 4.2)
+	if n := c.rw.Reader.Buffered(); n > 0 {
+		c.logger.Printf("discarding %d bytes of plaintext input received before TLS handshake", n)
+	}
+	tlsConn := tls.Server(&streamConn{Reader: c.in, Writer: c.out}, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.rw = bufio.NewReadWriter(bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn))
+	c.encrypted = true
+	return nil
 }
 
 func (c *StandardIOConnection) ReadLine() (string, error) {
@@ -77,6 +129,15 @@ func (c *StandardIOConnection) ReadLine() (string, error) {
 	return s, nil
 }
 
+// ReadChunk copies exactly n bytes of input to w, returning io.ErrUnexpectedEOF if the input ends first
+func (c *StandardIOConnection) ReadChunk(w io.Writer, n int64) (int64, error) {
+	written, err := io.CopyN(w, c.rw, n)
+	if err == io.EOF {
+		return written, io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
 // WriteLine automatically appends a linefeed character
 func (c *StandardIOConnection) WriteLine(s string) error {
 	_, err := c.rw.WriteString(s)
@@ -87,6 +148,23 @@ func (c *StandardIOConnection) WriteLine(s string) error {
 	return err
 }
 
+// Write buffers the output without flushing it, so several responses can be sent together
+func (c *StandardIOConnection) Write(s string) error {
+	_, err := c.rw.WriteString(s)
+	return err
+}
+
+// Flush sends any buffered output
+func (c *StandardIOConnection) Flush() error {
+	return c.rw.Flush()
+}
+
+// InputPending reports whether input has already arrived and is waiting in the buffer
+// Only data already read from the stream is counted, so this never blocks
+func (c *StandardIOConnection) InputPending() bool {
+	return c.rw.Reader.Buffered() > 0
+}
+
 func (c *StandardIOConnection) GetProto() string {
 	return os.Getenv("PROTO")
 }
@@ -118,3 +196,23 @@ func (c *StandardIOConnection) GetTCPRemoteHost() string {
 func (c *StandardIOConnection) GetTCPRemoteInfo() string {
 	return os.Getenv("TCPREMOTEINFO")
 }
+
+// streamConn adapts a pair of streams to the net.Conn interface required by crypto/tls
+type streamConn struct {
+	io.Reader
+	io.Writer
+}
+
+// streamAddr is the placeholder address reported for stream connections
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stdio" }
+func (streamAddr) String() string  { return "stdio" }
+
+// Close does nothing; the underlying streams belong to the process
+func (c *streamConn) Close() error                       { return nil }
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
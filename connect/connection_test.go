@@ -1,8 +1,19 @@
 package connect
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,11 +27,70 @@ func TestNewStandardIOConnection(t *testing.T) {
 }
 
 func TestStandardIOConnection_IsEncrypted(t *testing.T) {
+	err := os.Unsetenv("PROTO")
+	require.NoError(t, err, "should unset PROTO environment variable")
 	conn, err := NewStandardIOConnection()
 	require.NoError(t, err)
-	
-	// Currently stubbed to return true
-	assert.True(t, conn.IsEncrypted(), "IsEncrypted should return true")
+	assert.False(t, conn.IsEncrypted(), "plain connections should not report encryption")
+
+	err = os.Setenv("PROTO", "SSL")
+	require.NoError(t, err, "should set PROTO environment variable")
+	defer func() {
+		err := os.Unsetenv("PROTO")
+		require.NoError(t, err, "should unset PROTO environment variable")
+	}()
+	conn, err = NewStandardIOConnection()
+	require.NoError(t, err)
+	assert.True(t, conn.IsEncrypted(), "connections from a TLS listener should report encryption")
+}
+
+func TestStandardIOConnection_StartTLS(t *testing.T) {
+	serverCfg := createTestTLSConfig(t)
+
+	// Wire a client and a server together with a pair of pipes
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	conn := newStreamConnection(serverRead, serverWrite)
+	require.False(t, conn.IsEncrypted())
+
+	done := make(chan error, 1)
+	go func() {
+		client := tls.Client(&streamConn{Reader: clientRead, Writer: clientWrite}, &tls.Config{InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		_, err := client.Write([]byte("EHLO client.example.com\r\n"))
+		done <- err
+	}()
+
+	err := conn.StartTLS(serverCfg)
+	require.NoError(t, err, "handshake should succeed")
+	assert.True(t, conn.IsEncrypted(), "connection should report encryption after StartTLS")
+	line, err := conn.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "EHLO client.example.com", line)
+	require.NoError(t, <-done)
+
+	err = conn.StartTLS(serverCfg)
+	assert.ErrorIs(t, err, ErrAlreadyEncrypted)
+}
+
+// createTestTLSConfig generates a self-signed certificate for localhost
+func createTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
 }
 
 func TestStandardIOConnection_GetProto(t *testing.T) {
@@ -158,3 +228,40 @@ func TestStandardIOConnection_EnvironmentVariables_Empty(t *testing.T) {
 	assert.Equal(t, "", conn.GetTCPRemoteIP(), "GetTCPRemoteIP should return empty string when TCPREMOTEIP not set")
 	assert.Equal(t, "", conn.GetTCPRemoteHost(), "GetTCPRemoteHost should return empty string when TCPREMOTEHOST not set")
 }
+
+func TestStandardIOConnection_ReadChunk(t *testing.T) {
+	conn := newStreamConnection(strings.NewReader("BDAT 7 LAST\r\nhi\r\nyouQUIT\r\n"), io.Discard)
+	line, err := conn.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "BDAT 7 LAST", line)
+	var chunk bytes.Buffer
+	n, err := conn.ReadChunk(&chunk, 7)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+	assert.Equal(t, "hi\r\nyou", chunk.String(), "line endings should be left alone")
+	line, err = conn.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "QUIT", line, "reading should continue after the chunk")
+
+	_, err = conn.ReadChunk(&chunk, 1)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStandardIOConnection_Pipelining(t *testing.T) {
+	var out bytes.Buffer
+	conn := newStreamConnection(strings.NewReader("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\n"), &out)
+	assert.False(t, conn.InputPending(), "nothing has been read yet")
+	line, err := conn.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "MAIL FROM:<a@example.com>", line)
+	assert.True(t, conn.InputPending(), "the second command arrived with the first")
+	require.NoError(t, conn.Write("250 OK\r\n"))
+	assert.Empty(t, out.String(), "Write should not flush")
+
+	_, err = conn.ReadLine()
+	require.NoError(t, err)
+	assert.False(t, conn.InputPending())
+	require.NoError(t, conn.Write("250 OK\r\n"))
+	require.NoError(t, conn.Flush())
+	assert.Equal(t, "250 OK\r\n250 OK\r\n", out.String())
+}
@@ -0,0 +1,64 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/infodancer/gomail/address"
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/queue"
+)
+
+var logger *log.Logger
+
+func init() {
+	logger = log.New(os.Stderr, "", 0)
+}
+
+// Local delivers queued messages to the Maildirs of users in domains hosted on this server
+type Local struct{}
+
+// Deliver adds the message to the recipient's Maildir, preceded by Return-Path and Delivered-To headers
+// Unknown domains, unknown users and invalid addresses are permanent failures; anything else is retried
+func (l *Local) Deliver(env *queue.Envelope, recipient string, msg []byte) error {
+	addr, err := address.CreateAddress(recipient)
+	if err != nil {
+		return queue.Permanent(queue.WithStatus("5.1.3", fmt.Errorf("invalid recipient address %s", recipient)))
+	}
+	user, domainName, err := domain.SplitUsername(addr.User + "@" + strings.ToLower(addr.Domain))
+	if err != nil {
+		return queue.Permanent(queue.WithStatus("5.1.3", fmt.Errorf("invalid recipient address %s", recipient)))
+	}
+	// Failure messages are returned to the sender, so the details are only logged
+	dom, err := domain.GetDomain(domainName)
+	if err != nil {
+		if errors.Is(err, domain.ErrNoSuchDomain) {
+			logger.Printf("local delivery to %s failed: %v", recipient, err)
+			return queue.Permanent(queue.WithStatus("5.1.2", fmt.Errorf("domain %s is not hosted here", domainName)))
+		}
+		return err
+	}
+	md, err := dom.GetUserMaildir(user)
+	if err != nil {
+		if errors.Is(err, domain.ErrNoSuchUser) {
+			logger.Printf("local delivery to %s failed: %v", recipient, err)
+			return queue.Permanent(queue.WithStatus("5.1.1", fmt.Errorf("mailbox %s does not exist", recipient)))
+		}
+		return err
+	}
+	// Add writes to tmp and renames into new, so the message appears in the Maildir complete or not at all
+	id, err := md.Add(append([]byte(localHeaders(env.Sender, recipient)), msg...))
+	if err != nil {
+		return fmt.Errorf("could not write to maildir for %s: %w", recipient, err)
+	}
+	logger.Printf("delivered message for %s to maildir as %s", recipient, id)
+	return nil
+}
+
+// localHeaders creates the trace headers added on final delivery (RFC 5321 section 4.4)
+func localHeaders(sender string, recipient string) string {
+	return "Return-Path: <" + sender + ">\n" + "Delivered-To: " + recipient + "\n"
+}
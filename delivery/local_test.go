@@ -0,0 +1,76 @@
+package delivery
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/maildir"
+	"github.com/infodancer/gomail/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestDomain creates a domain root containing example.com with the user test
+func createTestDomain(t *testing.T) *maildir.Maildir {
+	root := t.TempDir()
+	md, err := maildir.Create(filepath.Join(root, "example.com", "users", "test", "Maildir"))
+	require.NoError(t, err)
+	previous := domain.DomainRoot()
+	domain.SetDomainRoot(root)
+	t.Cleanup(func() { domain.SetDomainRoot(previous) })
+	return md
+}
+
+func TestLocalDeliver(t *testing.T) {
+	md := createTestDomain(t)
+	env := &queue.Envelope{Sender: "sender@example.org", Recipients: []string{"test@Example.COM"}}
+	local := &Local{}
+
+	require.NoError(t, local.Deliver(env, "test@Example.COM", []byte("Subject: hello\n\nbody\n")))
+	ids, err := md.List()
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	data, err := md.Read(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, "Return-Path: <sender@example.org>\nDelivered-To: test@Example.COM\nSubject: hello\n\nbody\n", string(data))
+}
+
+func TestLocalDeliverFailures(t *testing.T) {
+	md := createTestDomain(t)
+	env := &queue.Envelope{}
+	local := &Local{}
+
+	// Bounces have an empty return path
+	require.NoError(t, local.Deliver(env, "test@example.com", []byte("bounce\n")))
+	ids, err := md.List()
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	data, err := md.Read(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, "Return-Path: <>\nDelivered-To: test@example.com\nbounce\n", string(data))
+
+	assert.True(t, queue.IsPermanent(local.Deliver(env, "nobody@example.com", nil)), "unknown user should fail permanently")
+	assert.True(t, queue.IsPermanent(local.Deliver(env, "test@example.org", nil)), "unknown domain should fail permanently")
+	assert.True(t, queue.IsPermanent(local.Deliver(env, "test", nil)), "address without domain should fail permanently")
+	assert.True(t, queue.IsPermanent(local.Deliver(env, "../test@example.com", nil)), "unsafe address should fail permanently")
+
+	// A user without a usable Maildir is a local problem that may be fixed
+	require.NoError(t, md.Remove())
+	err = local.Deliver(env, "test@example.com", nil)
+	require.Error(t, err)
+	assert.False(t, queue.IsPermanent(err), "missing maildir should be retried")
+}
+
+func TestLocalDeliverStatus(t *testing.T) {
+	createTestDomain(t)
+	local := &Local{}
+	var statusErr *queue.StatusError
+	err := local.Deliver(&queue.Envelope{}, "nobody@example.com", nil)
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, "5.1.1", statusErr.Status)
+	assert.Equal(t, "mailbox nobody@example.com does not exist", err.Error(), "paths should not be revealed to the sender")
+	err = local.Deliver(&queue.Envelope{}, "test@example.org", nil)
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, "5.1.2", statusErr.Status)
+}
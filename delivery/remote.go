@@ -0,0 +1,331 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/infodancer/gomail/address"
+	"github.com/infodancer/gomail/queue"
+)
+
+// defaultSMTPPort is the port used to deliver to remote mail exchangers
+const defaultSMTPPort = "25"
+
+// defaultRemoteTimeout limits how long a single delivery attempt may take
+const defaultRemoteTimeout = 10 * time.Minute
+
+// errSTARTTLS marks a delivery attempt that failed because TLS couldn't be negotiated
+var errSTARTTLS = errors.New("STARTTLS failed")
+
+// Resolver looks up the DNS records needed to route mail; *net.Resolver implements it
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Remote delivers queued messages to other mail servers over SMTP
+type Remote struct {
+	// Hostname identifies this server in EHLO; defaults to the system hostname
+	Hostname string
+	// Resolver finds the mail exchangers for a domain; defaults to net.DefaultResolver
+	Resolver Resolver
+	// Port is the port to connect to; defaults to 25
+	Port string
+	// TLSConfig is used for STARTTLS; if nil, TLS is used opportunistically without verifying certificates
+	TLSConfig *tls.Config
+	// RequireTLS defers delivery to servers that don't offer STARTTLS or fail the handshake,
+	// instead of falling back to an unencrypted connection
+	RequireTLS bool
+	// Timeout limits each delivery attempt; defaults to 10 minutes
+	Timeout time.Duration
+}
+
+// Deliver sends the message to the mail exchangers for the recipient's domain,
+// trying them in order of preference (RFC 5321 section 5)
+// 5xx replies are permanent failures; connection problems and 4xx replies are retried later
+// A message that is accepted has only been relayed, so it returns queue.ErrRelayedWithDSN if the
+// server took the sender's delivery status notification request, or queue.ErrRelayed if it couldn't
+func (r *Remote) Deliver(env *queue.Envelope, recipient string, msg []byte) error {
+	domainName := address.GetHost(recipient)
+	if domainName == "" {
+		return queue.Permanent(queue.WithStatus("5.1.3", fmt.Errorf("invalid recipient address %s", recipient)))
+	}
+	// Messages are sent with DATA, which can't carry binary content (RFC 3030 section 3)
+	if env.Body == queue.BodyBinaryMIME {
+		return queue.Permanent(queue.WithStatus("5.6.3", errors.New("binary message cannot be relayed without conversion")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	hosts, err := r.lookupMX(ctx, domainName)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	notFound := 0
+	for _, host := range hosts {
+		addrs, err := r.resolver().LookupHost(ctx, host)
+		if err != nil {
+			if isNotFound(err) {
+				notFound++
+			}
+			lastErr = fmt.Errorf("could not resolve mail exchanger %s: %w", host, err)
+			continue
+		}
+		for _, addr := range addrs {
+			err = r.send(ctx, addr, host, env, recipient, msg, true)
+			// Opportunistic TLS falls back to an unencrypted session when the handshake fails (RFC 7435)
+			if errors.Is(err, errSTARTTLS) && !r.RequireTLS {
+				logger.Printf("%v with %s [%s], retrying without TLS", err, host, addr)
+				err = r.send(ctx, addr, host, env, recipient, msg, false)
+			}
+			if errors.Is(err, queue.ErrRelayed) || errors.Is(err, queue.ErrRelayedWithDSN) {
+				logger.Printf("relayed message for %s to %s [%s]", recipient, host, addr)
+				return err
+			}
+			// The server has definitely refused the message
+			if queue.IsPermanent(err) {
+				return err
+			}
+			logger.Printf("delivery for %s to %s [%s] failed: %v", recipient, host, addr, err)
+			lastErr = err
+		}
+	}
+	if notFound == len(hosts) {
+		return queue.Permanent(queue.WithStatus("5.1.2", fmt.Errorf("no mail exchanger for %s could be found", domainName)))
+	}
+	return lastErr
+}
+
+// lookupMX finds the mail exchangers for a domain in order of preference, using the domain
+// itself if it has no MX records (RFC 5321 section 5.1)
+func (r *Remote) lookupMX(ctx context.Context, domainName string) ([]string, error) {
+	records, err := r.resolver().LookupMX(ctx, domainName)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("could not look up MX records for %s: %w", domainName, err)
+	}
+	if len(records) == 0 {
+		return []string{domainName}, nil
+	}
+	// A single MX of "." means the domain doesn't accept mail (RFC 7505)
+	if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+		return nil, queue.Permanent(queue.WithStatus("5.1.10", fmt.Errorf("domain %s does not accept mail", domainName)))
+	}
+	// The resolver isn't required to sort the records, and equal preferences keep their order
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// send runs a single SMTP transaction with a mail exchanger, using STARTTLS if useTLS is set and the server offers it
+func (r *Remote) send(ctx context.Context, addr string, host string, env *queue.Envelope, recipient string, msg []byte, useTLS bool) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, r.port()))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			logger.Printf("error setting connection deadline: %v", err)
+		}
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		if closeErr := conn.Close(); closeErr != nil {
+			logger.Printf("error closing connection: %v", closeErr)
+		}
+		return replyError(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Printf("error closing connection: %v", err)
+		}
+	}()
+
+	if err := c.Hello(r.hostname()); err != nil {
+		return replyError(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && useTLS {
+		if err := c.StartTLS(r.tlsConfig(host)); err != nil {
+			return fmt.Errorf("%w: %v", errSTARTTLS, err)
+		}
+	} else if r.RequireTLS {
+		return fmt.Errorf("%s does not offer STARTTLS", host)
+	}
+	// Delivery status notification requests are passed on if the server supports them (RFC 3461 section 4)
+	dsn, _ := c.Extension("DSN")
+	if dsn {
+		if err := sendDSNEnvelope(c, env, recipient); err != nil {
+			return replyError(err)
+		}
+	} else {
+		if err := c.Mail(env.Sender); err != nil {
+			return replyError(err)
+		}
+		if err := c.Rcpt(recipient); err != nil {
+			return replyError(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return replyError(err)
+	}
+	// The writer converts line endings to CRLF and escapes leading dots
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return replyError(err)
+	}
+	if err := c.Quit(); err != nil {
+		// The message has already been accepted
+		logger.Printf("error ending session with %s: %v", host, err)
+	}
+	if dsn {
+		return queue.ErrRelayedWithDSN
+	}
+	return queue.ErrRelayed
+}
+
+// sendDSNEnvelope sends MAIL and RCPT with the sender's RET, ENVID, NOTIFY and ORCPT parameters,
+// which net/smtp can't add, along with the parameters it would have sent itself
+func sendDSNEnvelope(c *smtp.Client, env *queue.Envelope, recipient string) error {
+	if strings.ContainsAny(env.Sender+recipient, "\r\n") {
+		return queue.Permanent(queue.WithStatus("5.1.7", errors.New("address contains a line break")))
+	}
+	mail := "MAIL FROM:<" + env.Sender + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		mail += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		mail += " SMTPUTF8"
+	}
+	if env.Ret != "" {
+		mail += " RET=" + env.Ret
+	}
+	if env.EnvID != "" {
+		mail += " ENVID=" + encodeXtext(env.EnvID)
+	}
+	if err := command(c, 250, mail); err != nil {
+		return err
+	}
+	rcpt := "RCPT TO:<" + recipient + ">"
+	for _, status := range env.Status {
+		if status.Recipient != recipient {
+			continue
+		}
+		if len(status.Notify) > 0 {
+			rcpt += " NOTIFY=" + strings.Join(status.Notify, ",")
+		}
+		if addrType, addr, found := strings.Cut(status.ORCPT, ";"); found {
+			rcpt += " ORCPT=" + addrType + ";" + encodeXtext(addr)
+		}
+		break
+	}
+	return command(c, 25, rcpt)
+}
+
+// command sends a single command and reads the reply, which must start with the expected code
+func command(c *smtp.Client, expectCode int, line string) error {
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// encodeXtext encodes ENVID and ORCPT values, escaping "+", "=" and anything outside
+// printable ASCII as "+" and two hexadecimal digits (RFC 3461 section 4)
+func encodeXtext(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// replyError marks 5xx replies from the remote server as permanent failures
+func replyError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 && protoErr.Code < 600 {
+		return queue.Permanent(err)
+	}
+	return err
+}
+
+// isNotFound checks whether a DNS lookup failed because the records don't exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func (r *Remote) resolver() Resolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return r.Resolver
+}
+
+func (r *Remote) port() string {
+	if r.Port == "" {
+		return defaultSMTPPort
+	}
+	return r.Port
+}
+
+func (r *Remote) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return defaultRemoteTimeout
+	}
+	return r.Timeout
+}
+
+func (r *Remote) hostname() string {
+	if r.Hostname != "" {
+		return r.Hostname
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// tlsConfig returns the configuration for STARTTLS with a mail exchanger
+func (r *Remote) tlsConfig(host string) *tls.Config {
+	if r.TLSConfig != nil {
+		cfg := r.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		return cfg
+	}
+	// Mail exchangers rarely have certificates matching their MX names, so without
+	// configuration we encrypt without authenticating the server (RFC 7435); if the
+	// handshake fails anyway, Deliver retries without TLS unless RequireTLS is set
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, // #nosec G402
+		MinVersion:         tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,302 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/gomail/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers DNS queries from maps, returning not found for anything else
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := f.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := f.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// fakeSMTPServer accepts messages, replying to RCPT with the code configured for each recipient
+type fakeSMTPServer struct {
+	listener net.Listener
+	replies  map[string]string
+	// extensions are advertised in reply to EHLO
+	extensions []string
+
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+func startFakeSMTPServer(t *testing.T, replies map[string]string) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &fakeSMTPServer{listener: listener, replies: replies}
+	t.Cleanup(func() { assert.NoError(t, listener.Close()) })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handle(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeSMTPServer) port() string {
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return port
+}
+
+func (srv *fakeSMTPServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	send := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	send("220 mx.example.net ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, line)
+		srv.mu.Unlock()
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			send("250-mx.example.net")
+			srv.mu.Lock()
+			for _, ext := range srv.extensions {
+				send("250-" + ext)
+			}
+			srv.mu.Unlock()
+			send("250 8BITMIME")
+		case "STARTTLS":
+			// Agree, then drop the connection so the handshake fails
+			send("220 go ahead")
+			return
+		case "MAIL":
+			send("250 OK")
+		case "RCPT":
+			reply := "250 OK"
+			for rcpt, r := range srv.replies {
+				if strings.Contains(line, "<"+rcpt+">") {
+					reply = r
+				}
+			}
+			send(reply)
+		case "DATA":
+			send("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			srv.mu.Lock()
+			srv.messages = append(srv.messages, data.String())
+			srv.mu.Unlock()
+			send("250 queued")
+		case "QUIT":
+			send("221 bye")
+			return
+		default:
+			send("502 unrecognized command")
+		}
+	}
+}
+
+func createTestRemote(srv *fakeSMTPServer, resolver *fakeResolver) *Remote {
+	return &Remote{
+		Hostname: "mail.example.com",
+		Resolver: resolver,
+		Port:     srv.port(),
+		Timeout:  5 * time.Second,
+	}
+}
+
+func TestRemoteDeliver(t *testing.T) {
+	srv := startFakeSMTPServer(t, map[string]string{
+		"busy@example.net":    "450 mailbox busy",
+		"unknown@example.net": "550 no such user",
+	})
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.net": {{Host: "mx.example.net.", Pref: 20}, {Host: "missing.example.net.", Pref: 10}},
+		},
+		hosts: map[string][]string{"mx.example.net": {"127.0.0.1"}},
+	}
+	remote := createTestRemote(srv, resolver)
+	env := &queue.Envelope{Sender: "sender@example.com"}
+
+	hosts, err := remote.lookupMX(context.Background(), "example.net")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing.example.net", "mx.example.net"}, hosts, "MX records should be sorted by preference")
+
+	// The first MX doesn't resolve, so the second is used
+	require.ErrorIs(t, remote.Deliver(env, "user@example.net", []byte("Subject: test\n\n.dot\nbody\n")), queue.ErrRelayed)
+	srv.mu.Lock()
+	assert.Equal(t, []string{"Subject: test\r\n\r\n..dot\r\nbody\r\n"}, srv.messages)
+	assert.Contains(t, srv.commands, "EHLO mail.example.com")
+	assert.Contains(t, srv.commands, "RCPT TO:<user@example.net>")
+	srv.mu.Unlock()
+
+	err = remote.Deliver(env, "busy@example.net", []byte("test\n"))
+	require.Error(t, err)
+	assert.False(t, queue.IsPermanent(err), "4xx replies should be retried")
+	assert.Contains(t, err.Error(), "mailbox busy")
+
+	err = remote.Deliver(env, "unknown@example.net", []byte("test\n"))
+	require.Error(t, err)
+	assert.True(t, queue.IsPermanent(err), "5xx replies should fail permanently")
+	assert.Contains(t, err.Error(), "no such user")
+}
+
+func TestRemoteDeliverRouting(t *testing.T) {
+	srv := startFakeSMTPServer(t, nil)
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"nullmx.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"nomx.example": {"127.0.0.1"}},
+	}
+	remote := createTestRemote(srv, resolver)
+	env := &queue.Envelope{}
+
+	// Without MX records the domain's own address is used
+	require.ErrorIs(t, remote.Deliver(env, "user@nomx.example", []byte("test\n")), queue.ErrRelayed)
+	srv.mu.Lock()
+	assert.Contains(t, srv.commands, "MAIL FROM:<> BODY=8BITMIME")
+	srv.mu.Unlock()
+
+	err := remote.Deliver(env, "user@nullmx.example", []byte("test\n"))
+	assert.True(t, queue.IsPermanent(err), "null MX should fail permanently")
+	err = remote.Deliver(env, "user@nowhere.example", []byte("test\n"))
+	assert.True(t, queue.IsPermanent(err), "domain without any address should fail permanently")
+	err = remote.Deliver(env, "user", []byte("test\n"))
+	assert.True(t, queue.IsPermanent(err), "address without domain should fail permanently")
+	err = remote.Deliver(&queue.Envelope{Body: queue.BodyBinaryMIME}, "user@nomx.example", []byte("test\r\n"))
+	assert.True(t, queue.IsPermanent(err), "binary messages can't be relayed with DATA")
+}
+
+func TestRemoteDeliverSTARTTLS(t *testing.T) {
+	srv := startFakeSMTPServer(t, nil)
+	srv.extensions = []string{"STARTTLS"}
+	resolver := &fakeResolver{hosts: map[string][]string{"example.net": {"127.0.0.1"}}}
+	remote := createTestRemote(srv, resolver)
+	env := &queue.Envelope{Sender: "sender@example.com"}
+
+	// A failed handshake is retried without TLS
+	require.ErrorIs(t, remote.Deliver(env, "user@example.net", []byte("test\n")), queue.ErrRelayed)
+	srv.mu.Lock()
+	assert.Equal(t, 2, countCommands(srv.commands, "EHLO"))
+	assert.Equal(t, 1, countCommands(srv.commands, "STARTTLS"))
+	assert.Len(t, srv.messages, 1)
+	srv.commands = nil
+	srv.mu.Unlock()
+
+	// Unless TLS is required
+	remote.RequireTLS = true
+	err := remote.Deliver(env, "user@example.net", []byte("test\n"))
+	require.Error(t, err)
+	assert.False(t, queue.IsPermanent(err), "TLS failures should be retried")
+	srv.mu.Lock()
+	assert.Equal(t, 1, countCommands(srv.commands, "EHLO"))
+	assert.Len(t, srv.messages, 1)
+	srv.extensions = nil
+	srv.mu.Unlock()
+
+	err = remote.Deliver(env, "user@example.net", []byte("test\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not offer STARTTLS")
+	srv.mu.Lock()
+	assert.Len(t, srv.messages, 1)
+	srv.mu.Unlock()
+}
+
+func TestRemoteDeliverDSN(t *testing.T) {
+	srv := startFakeSMTPServer(t, nil)
+	resolver := &fakeResolver{hosts: map[string][]string{"example.net": {"127.0.0.1"}}}
+	remote := createTestRemote(srv, resolver)
+	env := &queue.Envelope{
+		Sender: "sender@example.com",
+		Ret:    queue.ReturnHeaders,
+		EnvID:  "id+1=2",
+		Status: []queue.EnvelopeRecipient{
+			{Recipient: "user@example.net", Notify: []string{queue.NotifySuccess, queue.NotifyFailure}, ORCPT: "rfc822;first+last@example.net"},
+		},
+	}
+
+	// Without DSN support, the parameters are dropped and the sender can only be told the message was relayed
+	require.ErrorIs(t, remote.Deliver(env, "user@example.net", []byte("test\n")), queue.ErrRelayed)
+	srv.mu.Lock()
+	assert.Contains(t, srv.commands, "MAIL FROM:<sender@example.com> BODY=8BITMIME")
+	assert.Contains(t, srv.commands, "RCPT TO:<user@example.net>")
+	srv.commands = nil
+	srv.extensions = []string{"DSN"}
+	srv.mu.Unlock()
+
+	require.ErrorIs(t, remote.Deliver(env, "user@example.net", []byte("test\n")), queue.ErrRelayedWithDSN)
+	srv.mu.Lock()
+	assert.Contains(t, srv.commands, "MAIL FROM:<sender@example.com> BODY=8BITMIME RET=HDRS ENVID=id+2B1+3D2")
+	assert.Contains(t, srv.commands, "RCPT TO:<user@example.net> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;first+2Blast@example.net")
+	assert.Len(t, srv.messages, 2)
+	srv.mu.Unlock()
+}
+
+// countCommands counts the commands with the given verb
+func countCommands(commands []string, verb string) int {
+	count := 0
+	for _, command := range commands {
+		if strings.HasPrefix(command, verb) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRouter(t *testing.T) {
+	md := createTestDomain(t)
+	var remoteRecipients []string
+	router := &Router{
+		Local: &Local{},
+		Remote: queue.TransportFunc(func(env *queue.Envelope, recipient string, msg []byte) error {
+			remoteRecipients = append(remoteRecipients, recipient)
+			return nil
+		}),
+	}
+	env := &queue.Envelope{Sender: "sender@example.org"}
+	require.NoError(t, router.Deliver(env, "test@example.com", []byte("test\n")))
+	require.NoError(t, router.Deliver(env, "someone@example.org", []byte("test\n")))
+	assert.Equal(t, []string{"someone@example.org"}, remoteRecipients)
+	ids, err := md.List()
+	require.NoError(t, err)
+	assert.Len(t, ids, 1)
+	assert.True(t, queue.IsPermanent(router.Deliver(env, "test@../example.com", nil)))
+}
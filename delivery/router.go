@@ -0,0 +1,32 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/queue"
+)
+
+// Router sends messages for domains hosted here to local delivery and everything else to remote delivery
+type Router struct {
+	Local  queue.Transport
+	Remote queue.Transport
+}
+
+// Deliver passes the message to the transport responsible for the recipient's domain
+func (r *Router) Deliver(env *queue.Envelope, recipient string, msg []byte) error {
+	_, domainName, err := domain.SplitUsername(recipient)
+	if err != nil {
+		return queue.Permanent(queue.WithStatus("5.1.3", fmt.Errorf("invalid recipient address %s: %w", recipient, err)))
+	}
+	_, err = domain.GetDomain(strings.ToLower(domainName))
+	if err == nil {
+		return r.Local.Deliver(env, recipient, msg)
+	}
+	if errors.Is(err, domain.ErrNoSuchDomain) {
+		return r.Remote.Deliver(env, recipient, msg)
+	}
+	return err
+}
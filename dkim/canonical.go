@@ -0,0 +1,116 @@
+package dkim
+
+import (
+	"hash"
+	"strings"
+)
+
+// Canonicalization is a DKIM canonicalization algorithm (RFC 6376 section 3.4)
+type Canonicalization string
+
+const (
+	// Simple tolerates almost no modification of the message
+	Simple Canonicalization = "simple"
+	// Relaxed tolerates changes to whitespace and header folding
+	Relaxed Canonicalization = "relaxed"
+)
+
+// parseCanonicalization parses the c= tag of a signature: the header and body algorithms,
+// where the body algorithm defaults to simple
+func parseCanonicalization(tag string) (Canonicalization, Canonicalization, bool) {
+	if tag == "" {
+		return Simple, Simple, true
+	}
+	header, body, found := strings.Cut(tag, "/")
+	if !found {
+		body = string(Simple)
+	}
+	h, b := Canonicalization(strings.ToLower(header)), Canonicalization(strings.ToLower(body))
+	return h, b, validCanonicalization(h) && validCanonicalization(b)
+}
+
+func validCanonicalization(c Canonicalization) bool {
+	return c == Simple || c == Relaxed
+}
+
+// canonicalHeader canonicalizes a header field, given with any folding and its CRLF line ending
+func canonicalHeader(c Canonicalization, field string) string {
+	if c == Simple {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return name + ":" + strings.TrimSpace(compressWSP(value)) + "\r\n"
+}
+
+// compressWSP reduces each run of spaces and tabs to a single space
+func compressWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// bodyHasher canonicalizes a message body line by line, hashing the result
+type bodyHasher struct {
+	c Canonicalization
+	h hash.Hash
+	// limit is the number of canonical bytes to hash, from the l= tag, or -1 for all of them
+	limit   int64
+	written int64
+	// blank counts empty lines that are only hashed if more content follows them
+	blank   int
+	content bool
+}
+
+func newBodyHasher(c Canonicalization, h hash.Hash, limit int64) *bodyHasher {
+	return &bodyHasher{c: c, h: h, limit: limit}
+}
+
+// line adds a line of the body, without its line ending
+func (b *bodyHasher) line(l string) {
+	if b.c == Relaxed {
+		l = strings.TrimRight(compressWSP(l), " ")
+	}
+	// Empty lines at the end of the body are ignored (RFC 6376 sections 3.4.3 and 3.4.4)
+	if l == "" {
+		b.blank++
+		return
+	}
+	for ; b.blank > 0; b.blank-- {
+		b.write("\r\n")
+	}
+	b.write(l + "\r\n")
+	b.content = true
+}
+
+func (b *bodyHasher) write(s string) {
+	if b.limit >= 0 && b.written+int64(len(s)) > b.limit {
+		s = s[:b.limit-b.written]
+	}
+	b.written += int64(len(s))
+	b.h.Write([]byte(s))
+}
+
+// sum finishes the body and returns its hash
+func (b *bodyHasher) sum() []byte {
+	// An empty body is a single CRLF in simple canonicalization
+	if !b.content && b.c == Simple {
+		b.write("\r\n")
+	}
+	return b.h.Sum(nil)
+}
@@ -0,0 +1,178 @@
+// Package dkim verifies and creates DomainKeys Identified Mail signatures (RFC 6376)
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Algorithms for signing and verifying
+const (
+	// RSASHA256 is the RSA algorithm of RFC 6376
+	RSASHA256 = "rsa-sha256"
+	// Ed25519SHA256 is the Ed25519 algorithm of RFC 8463
+	Ed25519SHA256 = "ed25519-sha256"
+)
+
+// minRSABits is the smallest RSA key accepted (RFC 8301 section 3.2)
+const minRSABits = 1024
+
+// Resolver looks up the DNS records holding public keys; *net.Resolver implements it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// permError is a problem with a signature or key that can't be resolved by trying again
+type permError struct {
+	msg string
+}
+
+func (e *permError) Error() string {
+	return e.msg
+}
+
+func permErrorf(format string, v ...any) error {
+	return &permError{fmt.Sprintf(format, v...)}
+}
+
+// parseTags parses a tag list, such as a signature or key record (RFC 6376 section 3.2)
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, found := strings.Cut(spec, "=")
+		if !found {
+			return nil, permErrorf("invalid tag %q", spec)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := tags[name]; ok {
+			return nil, permErrorf("duplicate tag %s", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// removeWSP removes all whitespace, for base64 values that may be folded
+func removeWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// publicKey is a key from a DKIM key record (RFC 6376 section 3.6.1)
+type publicKey struct {
+	algorithm string
+	key       crypto.PublicKey
+}
+
+// validDomainName checks that a d= or s= value is a sequence of DNS labels, since both are used
+// to build the key's DNS name and are reported in Authentication-Results
+// Underscores are allowed, as selectors often use them
+func validDomainName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lookupKey fetches the public key for a selector and domain
+func lookupKey(ctx context.Context, resolver Resolver, selector string, domain string) (*publicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, permErrorf("no key for signature at %s", name)
+		}
+		return nil, fmt.Errorf("could not look up key %s: %w", name, err)
+	}
+	if len(txts) == 0 {
+		return nil, permErrorf("no key for signature at %s", name)
+	}
+	return parseKeyRecord(txts[0])
+}
+
+// parseKeyRecord parses a key record published in DNS
+func parseKeyRecord(txt string) (*publicKey, error) {
+	tags, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permErrorf("unsupported key version %s", v)
+	}
+	if h, ok := tags["h"]; ok && !containsFold(strings.Split(h, ":"), "sha256") {
+		return nil, permErrorf("key does not allow sha256")
+	}
+	if s, ok := tags["s"]; ok && !containsFold(strings.Split(s, ":"), "*") && !containsFold(strings.Split(s, ":"), "email") {
+		return nil, permErrorf("key is not for email")
+	}
+	p := removeWSP(tags["p"])
+	if p == "" {
+		return nil, permErrorf("key has been revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permErrorf("invalid key data: %s", err)
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some keys are published as a bare PKCS #1 key rather than SubjectPublicKeyInfo
+			if key, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, permErrorf("invalid RSA key: %s", err)
+			}
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, permErrorf("key is not an RSA key")
+		}
+		if rsaKey.N.BitLen() < minRSABits {
+			return nil, permErrorf("RSA key is too short")
+		}
+		return &publicKey{algorithm: RSASHA256, key: rsaKey}, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, permErrorf("invalid Ed25519 key")
+		}
+		return &publicKey{algorithm: Ed25519SHA256, key: ed25519.PublicKey(data)}, nil
+	default:
+		return nil, permErrorf("unsupported key type %s", k)
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Key types for GenerateKey
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// GenerateKey creates a new signing key; bits is only used for RSA keys
+func GenerateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if bits < minRSABits {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits", minRSABits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %s", keyType)
+}
+
+// MarshalPrivateKey encodes a private key as a PKCS #8 PEM block
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// LoadPrivateKey reads a PEM encoded private key, in PKCS #8 or PKCS #1 form
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+	if _, err := keyAlgorithm(signer); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// KeyRecord returns the DNS TXT record publishing the public half of a key (RFC 6376 section 3.6.1)
+func KeyRecord(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
@@ -0,0 +1,67 @@
+package dkim
+
+import (
+	"bytes"
+)
+
+// messageHandler receives a message from a parser
+type messageHandler interface {
+	// startBody is called once all the header fields have been read
+	startBody(headers []string)
+	// bodyLine is called with each line of the body, without its line ending
+	bodyLine(line string)
+}
+
+// parser splits a message into header fields and body lines as it is written
+// The message may use CRLF or LF line endings
+type parser struct {
+	// partial holds the start of a line that hasn't been finished
+	partial []byte
+	// headers holds the header fields, with folding and CRLF line endings
+	headers []string
+	inBody  bool
+}
+
+// write adds message data
+func (p *parser) write(data []byte, h messageHandler) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			p.partial = append(p.partial, data...)
+			return
+		}
+		p.partial = append(p.partial, data[:i]...)
+		data = data[i+1:]
+		p.line(string(bytes.TrimSuffix(p.partial, []byte{'\r'})), h)
+		p.partial = p.partial[:0]
+	}
+}
+
+// finish processes any unfinished line at the end of the message
+func (p *parser) finish(h messageHandler) {
+	if len(p.partial) > 0 {
+		p.line(string(p.partial), h)
+		p.partial = nil
+	}
+	if !p.inBody {
+		p.inBody = true
+		h.startBody(p.headers)
+	}
+}
+
+// line processes a complete line
+func (p *parser) line(l string, h messageHandler) {
+	if p.inBody {
+		h.bodyLine(l)
+		return
+	}
+	switch {
+	case l == "":
+		p.inBody = true
+		h.startBody(p.headers)
+	case (l[0] == ' ' || l[0] == '\t') && len(p.headers) > 0:
+		p.headers[len(p.headers)-1] += l + "\r\n"
+	default:
+		p.headers = append(p.headers, l+"\r\n")
+	}
+}
@@ -0,0 +1,149 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders are the header fields signed when none are configured
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// Signer creates a DKIM signature for a message as it is written
+// The message may use CRLF or LF line endings
+type Signer struct {
+	// Domain is the signing domain, and Selector locates the public key within it
+	Domain   string
+	Selector string
+	// Key is an *rsa.PrivateKey or ed25519.PrivateKey
+	Key crypto.Signer
+	// Headers lists the header fields to sign where they are present; defaults to DefaultHeaders
+	// From is always signed
+	Headers []string
+	// HeaderCanonicalization and BodyCanonicalization default to relaxed
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	parser parser
+	body   *bodyHasher
+}
+
+// ParseCanonicalization parses a canonicalization setting in the form of the c= tag,
+// such as "relaxed/simple"
+func ParseCanonicalization(s string) (Canonicalization, Canonicalization, error) {
+	header, body, ok := parseCanonicalization(s)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported canonicalization %s", s)
+	}
+	return header, body, nil
+}
+
+// Write adds message data
+func (s *Signer) Write(p []byte) (int, error) {
+	s.parser.write(p, s)
+	return len(p), nil
+}
+
+func (s *Signer) startBody(headers []string) {}
+
+func (s *Signer) bodyLine(line string) {
+	s.bodyHasher().line(line)
+}
+
+func (s *Signer) bodyHasher() *bodyHasher {
+	if s.body == nil {
+		s.body = newBodyHasher(canonicalizationOrDefault(s.BodyCanonicalization), sha256.New(), -1)
+	}
+	return s.body
+}
+
+func canonicalizationOrDefault(c Canonicalization) Canonicalization {
+	if c == "" {
+		return Relaxed
+	}
+	return c
+}
+
+// Sign finishes reading the message and returns its DKIM-Signature header, folded with "\n\t"
+// and without a line ending
+func (s *Signer) Sign() (string, error) {
+	s.parser.finish(s)
+	algorithm, err := keyAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	headerC := canonicalizationOrDefault(s.HeaderCanonicalization)
+	bodyC := canonicalizationOrDefault(s.BodyCanonicalization)
+	if !validCanonicalization(headerC) || !validCanonicalization(bodyC) {
+		return "", fmt.Errorf("unsupported canonicalization %s/%s", headerC, bodyC)
+	}
+
+	names := s.signedHeaders()
+	if !containsFold(names, "From") {
+		return "", errors.New("message has no From field to sign")
+	}
+	tags := []string{
+		"v=1; a=" + algorithm + "; c=" + string(headerC) + "/" + string(bodyC) + ";",
+		"d=" + s.Domain + "; s=" + s.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) + ";",
+		"h=" + strings.Join(names, ":") + ";",
+		"bh=" + base64.StdEncoding.EncodeToString(s.bodyHasher().sum()) + ";",
+		"b=",
+	}
+	field := "DKIM-Signature: " + strings.Join(tags, "\r\n\t")
+	digest := headerHash(s.parser.headers, names, headerC, field+"\r\n")
+
+	var sig []byte
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		sig, err = s.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not sign message: %w", err)
+	}
+	field += base64.StdEncoding.EncodeToString(sig)
+	return strings.ReplaceAll(field, "\r\n", "\n"), nil
+}
+
+// signedHeaders lists the configured header fields present in the message, naming fields
+// that appear more than once as often as they appear
+func (s *Signer) signedHeaders() []string {
+	wanted := s.Headers
+	if len(wanted) == 0 {
+		wanted = DefaultHeaders
+	}
+	if !containsFold(wanted, "From") {
+		wanted = append([]string{"From"}, wanted...)
+	}
+	var names []string
+	for _, name := range wanted {
+		for _, field := range s.parser.headers {
+			if strings.EqualFold(headerName(field), name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// keyAlgorithm returns the signing algorithm for a private key
+func keyAlgorithm(key crypto.Signer) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return RSASHA256, nil
+	case ed25519.PrivateKey:
+		return Ed25519SHA256, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
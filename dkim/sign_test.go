@@ -0,0 +1,94 @@
+package dkim
+
+import (
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	msg := "From: Joe <joe@example.com>\nTo: suzie@example.net\nSubject: Is dinner ready?\n" +
+		"Received: from somewhere\n\nHi.\n\nWe lost the game.\n\n\n"
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeEd25519} {
+		key, err := GenerateKey(keyType, 2048)
+		require.NoError(t, err)
+		record, err := KeyRecord(key)
+		require.NoError(t, err)
+		resolver := fakeResolver{"mail._domainkey.example.com": record}
+
+		signer := &Signer{Domain: "example.com", Selector: "mail", Key: key}
+		_, err = signer.Write([]byte(msg))
+		require.NoError(t, err)
+		header, err := signer.Sign()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(header, "DKIM-Signature: v=1; a="+map[string]string{
+			KeyTypeRSA: RSASHA256, KeyTypeEd25519: Ed25519SHA256}[keyType]+"; c=relaxed/relaxed;\n\t"), header)
+		assert.Contains(t, header, "\n\th=From:Subject:To;\n", "only fields that are present should be signed")
+
+		// The signature is checked as the queue stores it, with LF line endings
+		signed := header + "\n" + msg
+		results := verify(resolver, signed)
+		require.Len(t, results, 1)
+		assert.Equal(t, Pass, results[0].Status, "%s: %v", keyType, results[0].Err)
+
+		results = verify(resolver, strings.Replace(signed, "dinner", "lunch", 1))
+		assert.Equal(t, Fail, results[0].Status)
+	}
+
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	require.NoError(t, err)
+	signer := &Signer{Domain: "example.com", Selector: "mail", Key: key, Headers: []string{"Subject"}}
+	_, err = signer.Write([]byte("Subject: no sender\n\nbody\n"))
+	require.NoError(t, err)
+	_, err = signer.Sign()
+	assert.Error(t, err, "From must be signed")
+
+	_, _, err = ParseCanonicalization("relaxed/loose")
+	assert.Error(t, err)
+	header, body, err := ParseCanonicalization("relaxed")
+	require.NoError(t, err)
+	assert.Equal(t, Relaxed, header)
+	assert.Equal(t, Simple, body)
+}
+
+func TestKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(KeyTypeRSA, 512)
+	assert.Error(t, err, "short RSA keys should be refused")
+	_, err = GenerateKey("dsa", 0)
+	assert.Error(t, err)
+
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeEd25519} {
+		key, err := GenerateKey(keyType, 1024)
+		require.NoError(t, err)
+		data, err := MarshalPrivateKey(key)
+		require.NoError(t, err)
+		path := filepath.Join(dir, keyType+".key")
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		loaded, err := LoadPrivateKey(path)
+		require.NoError(t, err)
+		assert.Equal(t, key.Public(), loaded.Public())
+
+		record, err := KeyRecord(loaded)
+		require.NoError(t, err)
+		pub, err := parseKeyRecord(record)
+		require.NoError(t, err)
+		assert.Equal(t, key.Public(), pub.key)
+	}
+
+	rsaKey, err := GenerateKey(KeyTypeRSA, 1024)
+	require.NoError(t, err)
+	record, err := KeyRecord(rsaKey)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(record, "v=DKIM1; k=rsa; p="))
+	_, ok := rsaKey.(*rsa.PrivateKey)
+	assert.True(t, ok)
+
+	_, err = LoadPrivateKey(filepath.Join(dir, "missing.key"))
+	assert.Error(t, err)
+}
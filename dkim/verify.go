@@ -0,0 +1,362 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of verifying a signature (RFC 8601 section 2.7.1)
+type Status string
+
+const (
+	// None means the message was not signed
+	None Status = "none"
+	// Pass means the signature verified
+	Pass Status = "pass"
+	// Fail means the signature did not verify, usually because the message was changed
+	Fail Status = "fail"
+	// TempError means the key could not be fetched, and a later attempt may succeed
+	TempError Status = "temperror"
+	// PermError means the signature or key could not be used
+	PermError Status = "permerror"
+)
+
+// maxSignatures limits how many signatures are checked, since each needs a DNS lookup
+const maxSignatures = 5
+
+// defaultTimeout limits the key lookups for a message
+const defaultTimeout = 20 * time.Second
+
+// Result is the outcome of verifying one signature
+type Result struct {
+	Status Status
+	// Domain and Selector locate the signing key
+	Domain   string
+	Selector string
+	// Identifier is the i= tag, the identity of the signer
+	Identifier string
+	// Signature is the b= value, used to tell signatures apart in the results
+	Signature string
+	// Err describes why the signature did not pass
+	Err error
+}
+
+// signature is a parsed DKIM-Signature header field (RFC 6376 section 3.5)
+type signature struct {
+	field      string
+	algorithm  string
+	domain     string
+	selector   string
+	identifier string
+	headers    []string
+	headerC    Canonicalization
+	bodyC      Canonicalization
+	bodyHash   []byte
+	sig        string
+	expires    time.Time
+	body       *bodyHasher
+}
+
+// Verifier checks the DKIM signatures of a message as it is written
+// The message may use CRLF or LF line endings
+type Verifier struct {
+	// Resolver looks up public keys; defaults to net.DefaultResolver
+	Resolver Resolver
+	// Timeout limits the key lookups; defaults to 20 seconds
+	Timeout time.Duration
+
+	parser     parser
+	signatures []*signature
+	// results holds the results for signatures that could not be parsed
+	results []Result
+}
+
+// Write adds message data
+func (v *Verifier) Write(p []byte) (int, error) {
+	v.parser.write(p, v)
+	return len(p), nil
+}
+
+// startBody parses the signatures once all the header fields have been read
+func (v *Verifier) startBody(headers []string) {
+	for _, field := range headers {
+		if !strings.EqualFold(headerName(field), "DKIM-Signature") {
+			continue
+		}
+		if len(v.signatures)+len(v.results) >= maxSignatures {
+			break
+		}
+		sig, err := parseSignature(field)
+		if err != nil {
+			result := Result{Status: PermError, Err: err}
+			if sig != nil {
+				result.Domain, result.Selector, result.Signature = sig.domain, sig.selector, sig.sig
+			}
+			v.results = append(v.results, result)
+			continue
+		}
+		v.signatures = append(v.signatures, sig)
+	}
+}
+
+func (v *Verifier) bodyLine(line string) {
+	for _, sig := range v.signatures {
+		sig.body.line(line)
+	}
+}
+
+// Verify finishes reading the message and checks each signature
+// It returns a single result with status None if the message has no signatures
+func (v *Verifier) Verify() []Result {
+	v.parser.finish(v)
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := append([]Result{}, v.results...)
+	for _, sig := range v.signatures {
+		result := Result{
+			Status:     Pass,
+			Domain:     sig.domain,
+			Selector:   sig.selector,
+			Identifier: sig.identifier,
+			Signature:  sig.sig,
+		}
+		if err := v.verify(ctx, sig); err != nil {
+			result.Err = err
+			var perm *permError
+			switch {
+			case errors.As(err, &perm):
+				result.Status = PermError
+			case errors.Is(err, errVerifyFailed):
+				result.Status = Fail
+			default:
+				result.Status = TempError
+			}
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return []Result{{Status: None}}
+	}
+	return results
+}
+
+// errVerifyFailed is wrapped by errors for signatures that don't match the message
+var errVerifyFailed = errors.New("signature did not verify")
+
+// verify checks a signature against the message
+func (v *Verifier) verify(ctx context.Context, sig *signature) error {
+	if !sig.expires.IsZero() && time.Now().After(sig.expires) {
+		return permErrorf("signature has expired")
+	}
+	if !bytes.Equal(sig.body.sum(), sig.bodyHash) {
+		return fmt.Errorf("body hash did not verify: %w", errVerifyFailed)
+	}
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	key, err := lookupKey(ctx, resolver, sig.selector, sig.domain)
+	if err != nil {
+		return err
+	}
+	if key.algorithm != sig.algorithm {
+		return permErrorf("key type does not match the signature algorithm %s", sig.algorithm)
+	}
+	signed, err := base64.StdEncoding.DecodeString(sig.sig)
+	if err != nil {
+		return permErrorf("invalid signature data: %s", err)
+	}
+	digest := headerHash(v.parser.headers, sig.headers, sig.headerC, removeSignature(sig.field))
+	switch k := key.key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signed)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signed) {
+			err = errors.New("invalid Ed25519 signature")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", errVerifyFailed, err)
+	}
+	return nil
+}
+
+// headerHash hashes the signed header fields, followed by the signature field with an empty
+// b= value (RFC 6376 section 3.7)
+// When a name is listed more than once, its instances are used from the bottom up
+func headerHash(fields []string, names []string, c Canonicalization, sigField string) []byte {
+	h := sha256.New()
+	used := make(map[string]int)
+	for _, name := range names {
+		key := strings.ToLower(name)
+		skip := used[key]
+		used[key]++
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !strings.EqualFold(headerName(fields[i]), name) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			h.Write([]byte(canonicalHeader(c, fields[i])))
+			break
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(c, sigField), "\r\n")))
+	return h.Sum(nil)
+}
+
+// headerName returns the name of a header field
+func headerName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+// removeSignature empties the b= tag of a signature field, leaving the rest unchanged
+func removeSignature(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, found := strings.Cut(spec, "=")
+		if found && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:len(tag)+1]
+			if strings.HasSuffix(spec, "\r\n") && i == len(specs)-1 {
+				specs[i] += "\r\n"
+			}
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// parseSignature parses a DKIM-Signature field
+// The signature is returned with any error, so the result can identify it where possible
+func parseSignature(field string) (*signature, error) {
+	_, value, _ := strings.Cut(field, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, err
+	}
+	sig := &signature{
+		field:      field,
+		algorithm:  strings.ToLower(tags["a"]),
+		domain:     strings.ToLower(tags["d"]),
+		selector:   tags["s"],
+		identifier: tags["i"],
+		sig:        removeWSP(tags["b"]),
+	}
+	// The domain and selector are checked first, so that an invalid value is never reported
+	if tags["d"] != "" && !validDomainName(sig.domain) {
+		return nil, permErrorf("invalid signing domain")
+	}
+	if tags["s"] != "" && !validDomainName(sig.selector) {
+		return nil, permErrorf("invalid selector")
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return sig, permErrorf("signature is missing the %s= tag", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, permErrorf("unsupported signature version %s", tags["v"])
+	}
+	if sig.algorithm != RSASHA256 && sig.algorithm != Ed25519SHA256 {
+		return sig, permErrorf("unsupported algorithm %s", sig.algorithm)
+	}
+	var ok bool
+	if sig.headerC, sig.bodyC, ok = parseCanonicalization(tags["c"]); !ok {
+		return sig, permErrorf("unsupported canonicalization %s", tags["c"])
+	}
+	if q, found := tags["q"]; found && !containsFold(strings.Split(q, ":"), "dns/txt") {
+		return sig, permErrorf("unsupported query method %s", q)
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.TrimSpace(name))
+	}
+	if !containsFold(sig.headers, "From") {
+		return sig, permErrorf("From field is not signed")
+	}
+	// The identity must be in the signing domain (RFC 6376 section 3.5)
+	if sig.identifier != "" {
+		_, host, found := strings.Cut(sig.identifier, "@")
+		host = strings.ToLower(host)
+		if !found || (host != sig.domain && !strings.HasSuffix(host, "."+sig.domain)) {
+			return sig, permErrorf("identity %s is not in domain %s", sig.identifier, sig.domain)
+		}
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(removeWSP(tags["bh"])); err != nil {
+		return sig, permErrorf("invalid body hash: %s", err)
+	}
+	limit := int64(-1)
+	if l, found := tags["l"]; found {
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			return sig, permErrorf("invalid body length %s", l)
+		}
+	}
+	if x, found := tags["x"]; found {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return sig, permErrorf("invalid expiration time %s", x)
+		}
+		sig.expires = time.Unix(expires, 0)
+	}
+	sig.body = newBodyHasher(sig.bodyC, sha256.New(), limit)
+	return sig, nil
+}
+
+// AuthenticationResults formats the results as an Authentication-Results header, without
+// a line ending (RFC 8601)
+func AuthenticationResults(authServID string, results []Result) string {
+	entries := make([]string, 0, len(results))
+	for _, r := range results {
+		entry := "dkim=" + string(r.Status)
+		if r.Err != nil && r.Status != Pass {
+			entry += " reason=" + quote(r.Err.Error())
+		}
+		if r.Domain != "" {
+			entry += " header.d=" + quote(r.Domain)
+		}
+		if r.Identifier != "" {
+			entry += " header.i=" + quote(r.Identifier)
+		}
+		if r.Selector != "" {
+			entry += " header.s=" + quote(r.Selector)
+		}
+		// The start of the signature tells several signatures from the same domain apart (RFC 6008)
+		if len(r.Signature) >= 8 {
+			entry += " header.b=" + quote(r.Signature[:8])
+		}
+		entries = append(entries, entry)
+	}
+	return "Authentication-Results: " + authServID + ";\n\t" + strings.Join(entries, ";\n\t")
+}
+
+// quote returns a value as a token, or as a quoted string if it needs one
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"\\()<>,;:@[]=/?") {
+		return s
+	}
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,224 @@
+package dkim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver serves key records from a map, returning not found for anything else
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// rfc8463Message is the signed example message from RFC 8463 appendix A
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var rfc8463Keys = fakeResolver{
+	"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+}
+
+// verify passes a message to a verifier in small pieces, as it would arrive
+func verify(resolver Resolver, msg string) []Result {
+	v := &Verifier{Resolver: resolver}
+	for len(msg) > 0 {
+		n := 7
+		if n > len(msg) {
+			n = len(msg)
+		}
+		_, _ = v.Write([]byte(msg[:n]))
+		msg = msg[n:]
+	}
+	return v.Verify()
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	results := verify(rfc8463Keys, rfc8463Message)
+	require.Len(t, results, 1)
+	assert.Equal(t, Pass, results[0].Status, "%v", results[0].Err)
+	assert.Equal(t, "football.example.com", results[0].Domain)
+	assert.Equal(t, "brisbane", results[0].Selector)
+
+	// The queue stores messages with LF line endings
+	results = verify(rfc8463Keys, strings.ReplaceAll(rfc8463Message, "\r\n", "\n"))
+	assert.Equal(t, Pass, results[0].Status, "%v", results[0].Err)
+
+	// Relaxed canonicalization tolerates changes to whitespace
+	changed := strings.Replace(rfc8463Message, "Subject: Is dinner ready?", "SUBJECT:   Is dinner\r\n  ready?  ", 1)
+	changed = strings.Replace(changed, "the game.  Are", "the game. \tAre", 1)
+	results = verify(rfc8463Keys, changed+"\r\n\r\n")
+	assert.Equal(t, Pass, results[0].Status, "%v", results[0].Err)
+
+	results = verify(rfc8463Keys, strings.Replace(rfc8463Message, "We lost", "We won", 1))
+	assert.Equal(t, Fail, results[0].Status)
+	assert.ErrorContains(t, results[0].Err, "body hash")
+
+	results = verify(rfc8463Keys, strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1))
+	assert.Equal(t, Fail, results[0].Status)
+
+	results = verify(fakeResolver{}, rfc8463Message)
+	assert.Equal(t, PermError, results[0].Status)
+
+	revoked := fakeResolver{"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p="}
+	results = verify(revoked, rfc8463Message)
+	assert.Equal(t, PermError, results[0].Status)
+	assert.ErrorContains(t, results[0].Err, "revoked")
+}
+
+// sign adds a signature to a message for the verification tests
+func sign(t *testing.T, msg string, signer *Signer) string {
+	_, err := signer.Write([]byte(msg))
+	require.NoError(t, err)
+	header, err := signer.Sign()
+	require.NoError(t, err)
+	return strings.ReplaceAll(header, "\n", "\r\n") + "\r\n" + msg
+}
+
+func TestVerifyRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	resolver := fakeResolver{"sel._domainkey.example.com": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}
+	msg := "From: user@example.com\r\nSubject: test\r\n\r\nbody\r\n\r\n"
+
+	for _, c := range []Canonicalization{Simple, Relaxed} {
+		signer := &Signer{Domain: "example.com", Selector: "sel", Key: key, HeaderCanonicalization: c, BodyCanonicalization: c}
+		results := verify(resolver, sign(t, msg, signer))
+		require.Len(t, results, 1)
+		assert.Equal(t, Pass, results[0].Status, "%s: %v", c, results[0].Err)
+	}
+
+	// Simple canonicalization doesn't allow whitespace changes
+	signed := sign(t, msg, &Signer{Domain: "example.com", Selector: "sel", Key: key, HeaderCanonicalization: Simple})
+	results := verify(resolver, strings.Replace(signed, "Subject: test", "Subject:  test", 1))
+	assert.Equal(t, Fail, results[0].Status)
+
+	// The key must match the algorithm
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signed = sign(t, msg, &Signer{Domain: "example.com", Selector: "sel", Key: edKey})
+	results = verify(resolver, signed)
+	assert.Equal(t, PermError, results[0].Status)
+}
+
+func TestVerifySignatureErrors(t *testing.T) {
+	tests := map[string]string{
+		"v=1; a=rsa-sha1; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA":                       "unsupported algorithm",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=Subject; bh=AAAA; b=AAAA":                  "From field is not signed",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA":                             "missing the b= tag",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA; i=u@example.org":    "not in domain",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA; c=loose":            "canonicalization",
+		"v=1; v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA":                "duplicate tag",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA; x=1":                "expired",
+		"v=2; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA":                     "version",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA; l=-5":               "body length",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=From; bh=AAAA; b=AAAA; q=dns/txt:http/wk":  "",
+		"v=1; a=rsa-sha256; d=x dkim=pass header.d=paypal.com; s=sel; h=From; bh=AAAA; b=AAAA": "invalid signing domain",
+		"v=1; a=rsa-sha256; d=example.com; s=a/b; h=From; bh=AAAA; b=AAAA":                     "invalid selector",
+	}
+	for tags, reason := range tests {
+		results := verify(fakeResolver{}, "DKIM-Signature: "+tags+"\r\nFrom: a@example.com\r\n\r\nbody\r\n")
+		require.Len(t, results, 1)
+		if reason == "" {
+			assert.NotEqual(t, PermError, results[0].Status, tags)
+			continue
+		}
+		if assert.Error(t, results[0].Err, tags) {
+			assert.Contains(t, results[0].Err.Error(), reason, tags)
+		}
+		assert.NotEqual(t, Pass, results[0].Status, tags)
+	}
+
+	results := verify(fakeResolver{}, "From: a@example.com\r\n\r\nbody\r\n")
+	assert.Equal(t, []Result{{Status: None}}, results)
+
+	// Values that could forge a result are never reported
+	results = verify(fakeResolver{}, "DKIM-Signature: v=1; d=x dkim=pass header.d=paypal.com; s=sel\r\nFrom: a@example.com\r\n\r\nbody\r\n")
+	require.Len(t, results, 1)
+	assert.Empty(t, results[0].Domain)
+	assert.NotContains(t, AuthenticationResults("mail.example.net", results), "dkim=pass")
+}
+
+func TestBodyHash(t *testing.T) {
+	// Examples from RFC 6376 section 3.4.5
+	body := []string{" C ", "D \t E", "", ""}
+	hashBody := func(c Canonicalization, lines []string) string {
+		var out strings.Builder
+		b := newBodyHasher(c, &hashRecorder{&out}, -1)
+		for _, line := range lines {
+			b.line(line)
+		}
+		b.sum()
+		return out.String()
+	}
+	assert.Equal(t, " C \r\nD \t E\r\n", hashBody(Simple, body))
+	assert.Equal(t, " C\r\nD E\r\n", hashBody(Relaxed, body))
+	assert.Equal(t, "\r\n", hashBody(Simple, nil))
+	assert.Equal(t, "", hashBody(Relaxed, []string{"", " "}))
+
+	var out strings.Builder
+	b := newBodyHasher(Simple, &hashRecorder{&out}, 5)
+	b.line("hello world")
+	b.sum()
+	assert.Equal(t, "hello", out.String(), "l= limits the hashed body")
+
+	assert.Equal(t, "a:B C\r\n", canonicalHeader(Relaxed, "A : B\r\n\t C \r\n"))
+	assert.Equal(t, "A : B\r\n\t C \r\n", canonicalHeader(Simple, "A : B\r\n\t C \r\n"))
+}
+
+// hashRecorder is a hash.Hash that records what is written to it
+type hashRecorder struct {
+	out *strings.Builder
+}
+
+func (h *hashRecorder) Write(p []byte) (int, error) { return h.out.Write(p) }
+func (h *hashRecorder) Sum(b []byte) []byte         { return b }
+func (h *hashRecorder) Reset()                      { h.out.Reset() }
+func (h *hashRecorder) Size() int                   { return 0 }
+func (h *hashRecorder) BlockSize() int              { return 1 }
+
+func TestAuthenticationResults(t *testing.T) {
+	header := AuthenticationResults("mail.example.net", []Result{
+		{Status: Pass, Domain: "example.com", Selector: "sel", Signature: "abcdefghijkl"},
+		{Status: Fail, Domain: "example.org", Selector: "s2", Identifier: "@example.org", Err: errVerifyFailed},
+	})
+	assert.Equal(t, "Authentication-Results: mail.example.net;\n"+
+		"\tdkim=pass header.d=example.com header.s=sel header.b=abcdefgh;\n"+
+		"\tdkim=fail reason=\"signature did not verify\" header.d=example.org header.i=\"@example.org\" header.s=s2",
+		header)
+	assert.Equal(t, "Authentication-Results: mail.example.net;\n\tdkim=none", AuthenticationResults("mail.example.net", []Result{{Status: None}}))
+	assert.Equal(t, "Authentication-Results: mail.example.net;\n\tdkim=permerror header.d=\"x dkim=pass\" header.s=\"a;b\"",
+		AuthenticationResults("mail.example.net", []Result{{Status: PermError, Domain: "x dkim=pass", Selector: "a;b"}}))
+}
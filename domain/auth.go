@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/gomail/config"
+)
+
+// Authentication backends selectable in the configuration
+const (
+	AuthTypeNone          = ""
+	AuthTypePasswd        = "passwd"
+	AuthTypeCheckpassword = "checkpassword"
+)
+
+// passwdFile is the name of the per-domain password file
+const passwdFile = "passwd"
+
+// ErrAuthFailed indicates the credentials were wrong or the user does not exist
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrSecretUnavailable indicates the backend cannot supply a plaintext secret for the user
+var ErrSecretUnavailable = errors.New("plaintext secret not available")
+
+// Authenticator verifies the credentials of domain users
+// Usernames are full addresses in the form user@domain
+type Authenticator interface {
+	// Authenticate checks a plaintext password, returning ErrAuthFailed if it doesn't match
+	// Any other error should be treated as a temporary failure
+	Authenticate(username string, password string) error
+}
+
+// SecretProvider is implemented by authenticators that can supply a plaintext shared secret,
+// which challenge-response mechanisms such as CRAM-MD5 require
+type SecretProvider interface {
+	// Secret returns the shared secret, ErrAuthFailed if the user does not exist,
+	// or ErrSecretUnavailable if the password is only stored as a hash
+	Secret(username string) (string, error)
+}
+
+// APOPVerifier is implemented by authenticators that can check an APOP digest themselves,
+// such as checkpassword programs that understand the timestamp field
+type APOPVerifier interface {
+	// VerifyAPOP checks that digest is the MD5 of timestamp followed by the user's secret
+	VerifyAPOP(username string, timestamp string, digest string) error
+}
+
+// NewAuthenticator creates the authentication backend selected in the configuration
+// A nil Authenticator is returned if authentication is not configured
+func NewAuthenticator(cfg config.Authentication) (Authenticator, error) {
+	switch cfg.Type {
+	case AuthTypeNone:
+		return nil, nil
+	case AuthTypePasswd:
+		if cfg.PlainSecrets {
+			return &PlainPasswdAuthenticator{}, nil
+		}
+		return &PasswdAuthenticator{}, nil
+	case AuthTypeCheckpassword:
+		return NewCheckpasswordAuthenticator(cfg.Command, cfg.Args)
+	}
+	return nil, fmt.Errorf("unknown authentication type: %s", cfg.Type)
+}
+
+// PasswdAuthenticator checks passwords against a passwd file in each domain directory
+// Each line holds a user name and password hash separated by a colon, as in
+//
+//	user:$2b$10$...
+//
+// Blank lines and lines beginning with # are ignored
+type PasswdAuthenticator struct{}
+
+// Authenticate checks the password for user@domain against the domain's passwd file
+func (a *PasswdAuthenticator) Authenticate(username string, password string) error {
+	hash, err := a.lookup(username)
+	if err != nil {
+		return err
+	}
+	ok, err := CheckPassword(hash, password)
+	if err != nil {
+		return fmt.Errorf("could not check password for %s: %w", username, err)
+	}
+	if !ok {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// PlainPasswdAuthenticator is a PasswdAuthenticator whose passwd files hold {PLAIN} passwords,
+// so it can supply the secrets needed by CRAM-MD5 and APOP
+// It is only used when configured, since hashed passwords can never provide a secret
+type PlainPasswdAuthenticator struct {
+	PasswdAuthenticator
+}
+
+// Secret returns the password for user@domain if it is stored in plaintext
+func (a *PlainPasswdAuthenticator) Secret(username string) (string, error) {
+	hash, err := a.lookup(username)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(hash, plainPrefix) {
+		return "", ErrSecretUnavailable
+	}
+	return hash[len(plainPrefix):], nil
+}
+
+// lookup finds the stored hash for user@domain
+func (a *PasswdAuthenticator) lookup(username string) (string, error) {
+	user, domainName, err := SplitUsername(username)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	dom, err := GetDomain(domainName)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	f, err := os.Open(filepath.Join(dom.Path, passwdFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrAuthFailed
+		}
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logger.Printf("error closing passwd file: %v", err)
+		}
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		if name == user {
+			return hash, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrAuthFailed
+}
+
+// SplitUsername separates a login name in the form user@domain, rejecting names
+// that are unsafe to use as filesystem paths
+func SplitUsername(username string) (string, string, error) {
+	user, domainName, found := strings.Cut(username, "@")
+	if !found || len(user) == 0 || len(domainName) == 0 {
+		return "", "", errors.New("username must be in the form user@domain")
+	}
+	if strings.ContainsAny(username, "/\\:") || strings.Contains(username, "..") || strings.HasPrefix(domainName, ".") {
+		return "", "", errors.New("username contains illegal characters")
+	}
+	return user, domainName, nil
+}
@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestDomain creates a domain root containing example.com with the given passwd file
+func createTestDomain(t *testing.T, passwd string) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "example.com", "users", "test"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "example.com", passwdFile), []byte(passwd), 0600))
+	previous := domainRoot
+	SetDomainRoot(root)
+	t.Cleanup(func() { SetDomainRoot(previous) })
+}
+
+func TestPasswdAuthenticator(t *testing.T) {
+	sha512Hash, err := sha512Crypt("secret", "$6$saltstring")
+	require.NoError(t, err)
+	createTestDomain(t, "# test users\n\ntest:"+sha512Hash+"\nplain:{PLAIN}plainsecret\n")
+
+	auth, err := NewAuthenticator(config.Authentication{Type: AuthTypePasswd})
+	require.NoError(t, err)
+
+	assert.NoError(t, auth.Authenticate("test@example.com", "secret"))
+	assert.ErrorIs(t, auth.Authenticate("test@example.com", "wrong"), ErrAuthFailed)
+	assert.ErrorIs(t, auth.Authenticate("nobody@example.com", "secret"), ErrAuthFailed)
+	assert.ErrorIs(t, auth.Authenticate("test@example.org", "secret"), ErrAuthFailed)
+	assert.ErrorIs(t, auth.Authenticate("test", "secret"), ErrAuthFailed)
+	assert.ErrorIs(t, auth.Authenticate("test@../example.com", "secret"), ErrAuthFailed)
+
+	_, ok := auth.(SecretProvider)
+	assert.False(t, ok, "hashed passwords can't provide secrets")
+
+	auth, err = NewAuthenticator(config.Authentication{Type: AuthTypePasswd, PlainSecrets: true})
+	require.NoError(t, err)
+	assert.NoError(t, auth.Authenticate("plain@example.com", "plainsecret"))
+	secrets, ok := auth.(SecretProvider)
+	require.True(t, ok, "passwd backend should provide secrets when configured")
+	secret, err := secrets.Secret("plain@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "plainsecret", secret)
+	_, err = secrets.Secret("test@example.com")
+	assert.ErrorIs(t, err, ErrSecretUnavailable)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(config.Authentication{})
+	assert.NoError(t, err)
+	assert.Nil(t, auth, "authentication should be disabled by default")
+	_, err = NewAuthenticator(config.Authentication{Type: "ldap"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Exit codes defined by the checkpassword interface (https://cr.yp.to/checkpwd/interface.html)
+const (
+	checkpasswordSuccess  = 0
+	checkpasswordFailure  = 1
+	checkpasswordMisuse   = 2
+	checkpasswordTempFail = 111
+)
+
+// checkpasswordMaxInput is the largest input checkpassword programs are required to accept
+const checkpasswordMaxInput = 512
+
+// defaultCheckpasswordTimeout limits how long we wait for the checkpassword program
+const defaultCheckpasswordTimeout = 30 * time.Second
+
+// CheckpasswordAuthenticator verifies passwords by running an external checkpassword
+// program, passing the username, password and a timestamp on file descriptor 3
+type CheckpasswordAuthenticator struct {
+	// Command is the checkpassword program to run
+	Command string
+	// Args are passed to the program; by convention the last is the program it runs on success
+	Args []string
+	// Timeout limits how long the program may run
+	Timeout time.Duration
+}
+
+// NewCheckpasswordAuthenticator creates a checkpassword backend for the given program
+// If no arguments are given, "true" is used as the program to run on success
+func NewCheckpasswordAuthenticator(command string, args []string) (*CheckpasswordAuthenticator, error) {
+	if command == "" {
+		return nil, errors.New("no checkpassword program configured")
+	}
+	if len(args) == 0 {
+		args = []string{"true"}
+	}
+	return &CheckpasswordAuthenticator{
+		Command: command,
+		Args:    args,
+		Timeout: defaultCheckpasswordTimeout,
+	}, nil
+}
+
+// Authenticate runs the checkpassword program for user@domain
+func (a *CheckpasswordAuthenticator) Authenticate(username string, password string) error {
+	timestamp := fmt.Sprintf("<%d.%d@gomail>", os.Getpid(), time.Now().UnixNano())
+	return a.check(username, password, timestamp)
+}
+
+// VerifyAPOP passes an APOP digest and the greeting timestamp to the checkpassword program
+// Only programs that support APOP, such as vchkpw, will accept this
+func (a *CheckpasswordAuthenticator) VerifyAPOP(username string, timestamp string, digest string) error {
+	return a.check(username, digest, timestamp)
+}
+
+// check feeds the credentials to the checkpassword program and interprets its exit code
+func (a *CheckpasswordAuthenticator) check(username string, password string, timestamp string) error {
+	if strings.ContainsRune(username, 0) || strings.ContainsRune(password, 0) {
+		return ErrAuthFailed
+	}
+	input := username + "\x00" + password + "\x00" + timestamp + "\x00"
+	if len(input) > checkpasswordMaxInput {
+		return ErrAuthFailed
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = defaultCheckpasswordTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.Command, a.Args...)
+	// ExtraFiles start at file descriptor 3
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	// The child has its own copy of the read end now
+	if closeErr := r.Close(); closeErr != nil {
+		logger.Printf("error closing checkpassword pipe: %v", closeErr)
+	}
+	if err != nil {
+		if closeErr := w.Close(); closeErr != nil {
+			logger.Printf("error closing checkpassword pipe: %v", closeErr)
+		}
+		return fmt.Errorf("could not start checkpassword program: %w", err)
+	}
+	if _, err := w.Write([]byte(input)); err != nil {
+		logger.Printf("error writing to checkpassword program: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		logger.Printf("error closing checkpassword pipe: %v", err)
+	}
+
+	err = cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("checkpassword program failed: %w", err)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("checkpassword program timed out after %v", timeout)
+	}
+	switch exitErr.ExitCode() {
+	case checkpasswordSuccess:
+		return nil
+	case checkpasswordFailure:
+		return ErrAuthFailed
+	case checkpasswordMisuse:
+		return errors.New("checkpassword program reported misuse")
+	case checkpasswordTempFail:
+		return errors.New("checkpassword program reported a temporary failure")
+	}
+	return fmt.Errorf("checkpassword program exited with status %d", exitErr.ExitCode())
+}
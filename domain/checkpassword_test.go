@@ -0,0 +1,70 @@
+package domain
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCheckpassword reads the credentials from file descriptor 3 like a real checkpassword program
+const mockCheckpassword = `#!/bin/sh
+data=$(tr '\0' '\n' <&3)
+user=$(echo "$data" | sed -n 1p)
+pass=$(echo "$data" | sed -n 2p)
+timestamp=$(echo "$data" | sed -n 3p)
+if [ "$user" = "apop@example.com" ] && [ "$timestamp" = "<1.2@example.com>" ] && [ "$pass" = "digest" ]; then
+	exec "$@"
+fi
+if [ "$user" = "tempfail@example.com" ]; then
+	exit 111
+fi
+if [ "$user" = "test@example.com" ] && [ "$pass" = "secret" ]; then
+	exec "$@"
+fi
+exit 1
+`
+
+func TestCheckpasswordAuthenticator(t *testing.T) {
+	for _, cmd := range []string{"sh", "tr", "sed", "true"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s command not available for testing", cmd)
+		}
+	}
+	script := filepath.Join(t.TempDir(), "checkpassword")
+	require.NoError(t, os.WriteFile(script, []byte(mockCheckpassword), 0755))
+
+	auth, err := NewAuthenticator(config.Authentication{Type: AuthTypeCheckpassword, Command: script})
+	require.NoError(t, err)
+
+	assert.NoError(t, auth.Authenticate("test@example.com", "secret"))
+	assert.ErrorIs(t, auth.Authenticate("test@example.com", "wrong"), ErrAuthFailed)
+	assert.ErrorIs(t, auth.Authenticate("nobody@example.com", "secret"), ErrAuthFailed)
+
+	err = auth.Authenticate("tempfail@example.com", "secret")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrAuthFailed, "exit code 111 should be a temporary failure")
+
+	// The program run on success decides the final result
+	failing, err := NewCheckpasswordAuthenticator(script, []string{"false"})
+	require.NoError(t, err)
+	assert.Error(t, failing.Authenticate("test@example.com", "secret"))
+
+	apop, ok := auth.(APOPVerifier)
+	require.True(t, ok, "checkpassword should pass APOP digests to the program")
+	assert.NoError(t, apop.VerifyAPOP("apop@example.com", "<1.2@example.com>", "digest"))
+	assert.ErrorIs(t, apop.VerifyAPOP("apop@example.com", "<3.4@example.com>", "digest"), ErrAuthFailed)
+
+	missing, err := NewCheckpasswordAuthenticator("/nonexistent/checkpassword", nil)
+	require.NoError(t, err)
+	err = missing.Authenticate("test@example.com", "secret")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrAuthFailed)
+
+	_, err = NewAuthenticator(config.Authentication{Type: AuthTypeCheckpassword})
+	assert.Error(t, err, "a program must be configured")
+}
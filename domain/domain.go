@@ -28,6 +28,12 @@ type User struct {
 	MaildirPath string
 }
 
+// ErrNoSuchDomain indicates the domain is not hosted here
+var ErrNoSuchDomain = errors.New("no such domain")
+
+// ErrNoSuchUser indicates the user does not exist in the domain
+var ErrNoSuchUser = errors.New("no such user")
+
 var logger *log.Logger
 var domainRoot string
 var domainPattern *regexp.Regexp
@@ -51,6 +57,11 @@ func SetDomainRoot(path string) {
 	domainRoot = path
 }
 
+// DomainRoot returns the root directory for the domain heirarchy
+func DomainRoot() string {
+	return domainRoot
+}
+
 // GetDomain provides a domain object based on the domain root and the provided name
 func GetDomain(name string) (*Domain, error) {
 	var result Domain
@@ -58,7 +69,7 @@ func GetDomain(name string) (*Domain, error) {
 	result.Path = filepath.Join(domainRoot, name)
 	logger.Println("Checking domain path " + result.Path)
 	if _, err := os.Stat(result.Path); os.IsNotExist(err) {
-		err := fmt.Errorf("requested domain %v does not exist or cannot be accessed: %v", result.Path, err)
+		err := fmt.Errorf("requested domain %v does not exist or cannot be accessed: %w", result.Path, ErrNoSuchDomain)
 		return nil, err
 	}
 	return &result, nil
@@ -69,7 +80,7 @@ func (domain *Domain) GetUser(name string) (*User, error) {
 	userpath := filepath.Join(domain.Path, "users", name)
 	logger.Println("Checking user path " + userpath)
 	if _, err := os.Stat(userpath); os.IsNotExist(err) {
-		err := fmt.Errorf("user does not exist: %v", err)
+		err := fmt.Errorf("user %v does not exist: %w", userpath, ErrNoSuchUser)
 		return nil, err
 	}
 	user := User{}
@@ -83,7 +94,7 @@ func (domain *Domain) GetUser(name string) (*User, error) {
 func (domain *Domain) GetUserMaildir(name string) (*maildir.Maildir, error) {
 	user, err := domain.GetUser(name)
 	if err != nil {
-		err := fmt.Errorf("user does not exist: %v", err)
+		err := fmt.Errorf("user does not exist: %w", err)
 		return nil, err
 	}
 	logger.Println("Checking for maildir at " + user.MaildirPath)
@@ -99,6 +110,17 @@ func (domain *Domain) GetUserMaildir(name string) (*maildir.Maildir, error) {
 	return result, nil
 }
 
+// DKIMKeyPath returns the path of the private key the domain signs mail with for a DKIM selector
+func (domain *Domain) DKIMKeyPath(selector string) (string, error) {
+	if selector == "" {
+		return "", errors.New("no DKIM selector given")
+	}
+	if err := ValidateDomainName(selector); err != nil {
+		return "", fmt.Errorf("invalid DKIM selector %v: %w", selector, err)
+	}
+	return filepath.Join(domain.Path, "dkim", selector+".key"), nil
+}
+
 // validateDomainName ensures a domain name is safe to use for a filename
 func ValidateDomainName(name string) error {
 	result := domainPattern.ReplaceAllString(name, "")
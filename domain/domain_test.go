@@ -17,3 +17,16 @@ func TestExtractDomainPath(t *testing.T) {
 		}
 	}
 }
+
+func TestDKIMKeyPath(t *testing.T) {
+	d := &Domain{Name: "example.com", Path: "/srv/domains/example.com"}
+	path, err := d.DKIMKeyPath("mail2024")
+	if err != nil || path != "/srv/domains/example.com/dkim/mail2024.key" {
+		t.Error("DKIM key path failed: ", path, err)
+	}
+	for _, selector := range []string{"", "../users", "a.b"} {
+		if _, err := d.DKIMKeyPath(selector); err == nil {
+			t.Error("DKIM selector should have been refused: ", selector)
+		}
+	}
+}
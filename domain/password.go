@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// plainPrefix marks a password stored in plaintext, which is required for CRAM-MD5 and APOP
+const plainPrefix = "{PLAIN}"
+
+// ErrUnknownHash is returned when a stored password uses an unsupported scheme
+var ErrUnknownHash = errors.New("unsupported password hash scheme")
+
+// CheckPassword compares a plaintext password against a stored hash
+// Supported schemes are bcrypt ($2a$, $2b$, $2y$), argon2 ($argon2id$, $argon2i$),
+// SHA-512-crypt ($6$) and plaintext ({PLAIN})
+func CheckPassword(hash string, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		return checkArgon2(hash, password)
+	case strings.HasPrefix(hash, sha512CryptPrefix):
+		computed, err := sha512Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, plainPrefix):
+		return subtle.ConstantTimeCompare([]byte(hash[len(plainPrefix):]), []byte(password)) == 1, nil
+	}
+	return false, ErrUnknownHash
+}
+
+// checkArgon2 verifies a password against a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func checkArgon2(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("malformed argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("malformed argon2 version: %w", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 salt: %w", err)
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 hash: %w", err)
+	}
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	default:
+		return false, ErrUnknownHash
+	}
+	return subtle.ConstantTimeCompare(computed, expected) == 1, nil
+}
@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestSHA512Crypt uses the test vectors from the SHA-crypt specification
+func TestSHA512Crypt(t *testing.T) {
+	vectors := []struct {
+		settings string
+		password string
+		expected string
+	}{
+		{"$6$saltstring", "Hello world!",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!",
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=5000$toolongsaltstring", "This is just a test",
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed",
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, v := range vectors {
+		result, err := sha512Crypt(v.password, v.settings)
+		assert.NoError(t, err)
+		assert.Equal(t, v.expected, result, "hash mismatch for settings %s", v.settings)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("secret"), salt, 1, 64*1024, 1, 32)
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=65536,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	sha512Hash, err := sha512Crypt("secret", "$6$saltstring")
+	assert.NoError(t, err)
+
+	for _, hash := range []string{string(bcryptHash), argon2Hash, sha512Hash, "{PLAIN}secret"} {
+		ok, err := CheckPassword(hash, "secret")
+		assert.NoError(t, err)
+		assert.True(t, ok, "password should match %s", hash)
+		ok, err = CheckPassword(hash, "wrong")
+		assert.NoError(t, err)
+		assert.False(t, ok, "wrong password should not match %s", hash)
+	}
+
+	_, err = CheckPassword("$1$md5crypt$isnotsupported", "secret")
+	assert.ErrorIs(t, err, ErrUnknownHash)
+}
@@ -0,0 +1,157 @@
+package domain
+
+import (
+	"crypto/sha512"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SHA-512-crypt as specified at https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+	cryptAlphabet            = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// sha512CryptOrder is the order in which digest bytes are encoded, three at a time
+var sha512CryptOrder = [21][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// sha512Crypt hashes a password using the settings (prefix, rounds and salt) from an existing hash
+func sha512Crypt(password string, settings string) (string, error) {
+	if !strings.HasPrefix(settings, sha512CryptPrefix) {
+		return "", errors.New("not a SHA-512-crypt hash")
+	}
+	rest := settings[len(sha512CryptPrefix):]
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, sha512CryptRoundsPrefix) {
+		end := strings.Index(rest, "$")
+		if end == -1 {
+			return "", errors.New("malformed rounds in SHA-512-crypt hash")
+		}
+		n, err := strconv.Atoi(rest[len(sha512CryptRoundsPrefix):end])
+		if err != nil {
+			return "", errors.New("malformed rounds in SHA-512-crypt hash")
+		}
+		if n < sha512CryptMinRounds {
+			n = sha512CryptMinRounds
+		}
+		if n > sha512CryptMaxRounds {
+			n = sha512CryptMaxRounds
+		}
+		rounds = n
+		customRounds = true
+		rest = rest[end+1:]
+	}
+	salt := rest
+	if i := strings.Index(salt, "$"); i != -1 {
+		salt = salt[:i]
+	}
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	p := []byte(password)
+	s := []byte(salt)
+
+	// Digest B
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	digestB := b.Sum(nil)
+
+	// Digest A
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	a.Write(repeatBytes(digestB, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(p)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	// Sequence P from digest DP
+	dp := sha512.New()
+	for i := 0; i < len(p); i++ {
+		dp.Write(p)
+	}
+	seqP := repeatBytes(dp.Sum(nil), len(p))
+
+	// Sequence S from digest DS
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	seqS := repeatBytes(ds.Sum(nil), len(s))
+
+	digest := digestA
+	for r := 0; r < rounds; r++ {
+		c := sha512.New()
+		if r&1 != 0 {
+			c.Write(seqP)
+		} else {
+			c.Write(digest)
+		}
+		if r%3 != 0 {
+			c.Write(seqS)
+		}
+		if r%7 != 0 {
+			c.Write(seqP)
+		}
+		if r&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(seqP)
+		}
+		digest = c.Sum(nil)
+	}
+
+	var result strings.Builder
+	result.WriteString(sha512CryptPrefix)
+	if customRounds {
+		result.WriteString(sha512CryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	result.WriteString(salt)
+	result.WriteString("$")
+	for _, group := range sha512CryptOrder {
+		writeCrypt64(&result, digest[group[0]], digest[group[1]], digest[group[2]], 4)
+	}
+	writeCrypt64(&result, 0, 0, digest[63], 2)
+	return result.String(), nil
+}
+
+// repeatBytes repeats src until it is exactly n bytes long
+func repeatBytes(src []byte, n int) []byte {
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		remaining := n - len(result)
+		if remaining > len(src) {
+			remaining = len(src)
+		}
+		result = append(result, src[:remaining]...)
+	}
+	return result
+}
+
+// writeCrypt64 encodes 24 bits using the crypt base64 alphabet, least significant bits first
+func writeCrypt64(sb *strings.Builder, b2 byte, b1 byte, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
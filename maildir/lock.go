@@ -0,0 +1,137 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the lock file created inside a locked maildir
+const lockFileName = ".gomail.lock"
+
+// staleLockAge is how old a lock must be before it is considered stale when
+// its owner can't be checked, because it belongs to another host or is unreadable
+const staleLockAge = time.Hour
+
+// ErrLocked indicates another process holds the lock on the maildir
+var ErrLocked = errors.New("maildir is locked by another process")
+
+// Lock is an exclusive lock on a maildir
+type Lock struct {
+	path string
+}
+
+// Lock takes an exclusive lock on the maildir that is respected by other processes
+// The lock file records our process ID and hostname, so that locks left behind
+// by crashed processes can be detected and removed
+func (m *Maildir) Lock() (*Lock, error) {
+	path := filepath.Join(m.directory, lockFileName)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	owner := fmt.Sprintf("%d %s\n", os.Getpid(), hostname)
+	// Try twice: once normally, and again after removing a stale lock
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(owner)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				if removeErr := os.Remove(path); removeErr != nil {
+					log.Printf("error removing incomplete lock %s: %v", path, removeErr)
+				}
+				return nil, err
+			}
+			return &Lock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if !isStaleLock(path, hostname) {
+			return nil, ErrLocked
+		}
+		if err := breakLock(path, hostname); err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrLocked
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	return os.Remove(l.path)
+}
+
+// isStaleLock checks whether the process that created a lock file has gone away
+func isStaleLock(path string, hostname string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		// If it has vanished in the meantime, it's safe to try again
+		return os.IsNotExist(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		// The owner may not have written its details yet
+		return time.Since(fi.ModTime()) > staleLockAge
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || fields[1] != hostname {
+		return time.Since(fi.ModTime()) > staleLockAge
+	}
+	return !isProcessRunning(pid)
+}
+
+// isProcessRunning checks whether a process exists on this host
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	if err == nil || errors.Is(err, syscall.EPERM) {
+		return true
+	}
+	return false
+}
+
+// breakLock removes a stale lock file
+// The lock is first renamed aside, so that if another process replaced the stale lock
+// with a fresh one in the meantime, the fresh lock can be put back instead of deleted
+func breakLock(path string, hostname string) error {
+	aside := fmt.Sprintf("%s.stale.%d", path, os.Getpid())
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if isStaleLock(aside, hostname) {
+		log.Printf("removing stale maildir lock %s", path)
+		return os.Remove(aside)
+	}
+	// The lock we moved is live, so it must be restored; if that fails, possibly because
+	// yet another lock has appeared, it is left aside rather than deleted
+	if err := os.Link(aside, path); err != nil {
+		return fmt.Errorf("%w: could not restore lock moved to %s: %v", ErrLocked, aside, err)
+	}
+	if err := os.Remove(aside); err != nil {
+		log.Printf("error removing %s: %v", aside, err)
+	}
+	return ErrLocked
+}
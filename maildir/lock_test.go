@@ -0,0 +1,103 @@
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createLockTestMaildir(t *testing.T) *Maildir {
+	tmpdir, err := os.MkdirTemp("", "maildir-lock-test-")
+	assert.NoError(t, err, "error creating tmpdir")
+	t.Cleanup(func() { assert.NoError(t, os.RemoveAll(tmpdir)) })
+	md, err := Create(path.Join(tmpdir, "Maildir"))
+	if err != nil {
+		t.Fatalf("error creating maildir: %v", err)
+	}
+	return md
+}
+
+func TestMaildirLock(t *testing.T) {
+	md := createLockTestMaildir(t)
+
+	lock, err := md.Lock()
+	assert.NoError(t, err, "error locking maildir")
+	_, err = md.Lock()
+	assert.ErrorIs(t, err, ErrLocked, "expected second lock to fail")
+
+	assert.NoError(t, lock.Unlock(), "error unlocking maildir")
+	lock, err = md.Lock()
+	assert.NoError(t, err, "expected lock to succeed after unlock")
+	assert.NoError(t, lock.Unlock(), "error unlocking maildir")
+
+	msgs, err := md.List()
+	assert.NoError(t, err, "error listing maildir")
+	assert.Equal(t, 0, len(msgs), "lock file should not appear as a message")
+}
+
+func TestMaildirStaleLock(t *testing.T) {
+	md := createLockTestMaildir(t)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err, "error getting hostname")
+
+	// Use the pid of a process that has already exited
+	cmd := exec.Command("true")
+	assert.NoError(t, cmd.Run(), "error running true")
+	deadPid := cmd.ProcessState.Pid()
+
+	lockPath := path.Join(md.directory, lockFileName)
+	err = os.WriteFile(lockPath, []byte(fmt.Sprintf("%d %s\n", deadPid, hostname)), 0600)
+	assert.NoError(t, err, "error writing stale lock")
+	lock, err := md.Lock()
+	assert.NoError(t, err, "expected stale lock from dead process to be broken")
+	assert.NoError(t, lock.Unlock(), "error unlocking maildir")
+
+	// A live process on another host can't be checked until the lock is old
+	err = os.WriteFile(lockPath, []byte(fmt.Sprintf("%d other.example.com\n", os.Getpid())), 0600)
+	assert.NoError(t, err, "error writing foreign lock")
+	_, err = md.Lock()
+	assert.ErrorIs(t, err, ErrLocked, "expected recent foreign lock to be respected")
+
+	old := time.Now().Add(-2 * staleLockAge)
+	assert.NoError(t, os.Chtimes(lockPath, old, old), "error aging lock")
+	lock, err = md.Lock()
+	assert.NoError(t, err, "expected old foreign lock to be broken")
+	assert.NoError(t, lock.Unlock(), "error unlocking maildir")
+}
+
+func TestMaildirLiveLock(t *testing.T) {
+	md := createLockTestMaildir(t)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err, "error getting hostname")
+
+	lockPath := path.Join(md.directory, lockFileName)
+	err = os.WriteFile(lockPath, []byte(fmt.Sprintf("%d %s\n", os.Getppid(), hostname)), 0600)
+	assert.NoError(t, err, "error writing lock")
+	_, err = md.Lock()
+	assert.ErrorIs(t, err, ErrLocked, "expected lock held by a running process to be respected")
+	_, err = os.Stat(lockPath)
+	assert.NoError(t, err, "lock held by a running process should not be removed")
+}
+
+func TestMaildirBreakLiveLock(t *testing.T) {
+	md := createLockTestMaildir(t)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err, "error getting hostname")
+
+	// A lock that was replaced by a live one after it was found to be stale is put back
+	lockPath := path.Join(md.directory, lockFileName)
+	owner := []byte(fmt.Sprintf("%d %s\n", os.Getppid(), hostname))
+	assert.NoError(t, os.WriteFile(lockPath, owner, 0600), "error writing lock")
+	assert.ErrorIs(t, breakLock(lockPath, hostname), ErrLocked, "expected live lock to be kept")
+	content, err := os.ReadFile(lockPath)
+	assert.NoError(t, err, "live lock should be restored")
+	assert.Equal(t, owner, content)
+	aside := fmt.Sprintf("%s.stale.%d", lockPath, os.Getpid())
+	_, err = os.Stat(aside)
+	assert.True(t, os.IsNotExist(err), "restored lock should not be left aside")
+}
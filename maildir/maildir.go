@@ -189,16 +189,9 @@ func getMsgIDFromFilename(f string) string {
 }
 
 func (m *Maildir) Read(msgid string) ([]byte, error) {
-	msgpath, err := findByMsgID(path.Join(m.directory, "new"), msgid)
+	msgpath, err := m.find(msgid)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			msgpath, err = findByMsgID(path.Join(m.directory, "cur"), msgid)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
 
 	msg, err := os.ReadFile(msgpath)
@@ -208,6 +201,24 @@ func (m *Maildir) Read(msgid string) ([]byte, error) {
 	return msg, nil
 }
 
+// Open opens a message for reading, for callers that don't need the whole message in memory
+func (m *Maildir) Open(msgid string) (*os.File, error) {
+	msgpath, err := m.find(msgid)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(msgpath)
+}
+
+// find returns the path of a message in new or cur
+func (m *Maildir) find(msgid string) (string, error) {
+	msgpath, err := findByMsgID(path.Join(m.directory, "new"), msgid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return findByMsgID(path.Join(m.directory, "cur"), msgid)
+	}
+	return msgpath, err
+}
+
 // List returns an array of valid message identifiers
 func (m *Maildir) List() ([]string, error) {
 	// Check for new messages so we only have to read one dir
@@ -2,12 +2,14 @@ package maildir
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMaildir(t *testing.T) {
@@ -44,6 +46,14 @@ func TestMaildir(t *testing.T) {
 		}
 		strings.Contains(string(msg), body)
 	}
+	f, err := md.Open(msgid)
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, body, string(data))
+	_, err = md.Open("missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
 	err = md.Delete()
 	assert.NoError(t, err)
 }
@@ -0,0 +1,68 @@
+package pop3d
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/infodancer/gomail/domain"
+)
+
+// createTimestamp creates a unique greeting timestamp in the form <process-ID.clock@hostname>
+func createTimestamp(hostname string) string {
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), hostname)
+}
+
+// supportsAPOP checks whether the backend can verify APOP digests, either itself or by supplying secrets
+func supportsAPOP(auth domain.Authenticator) bool {
+	if _, ok := auth.(domain.APOPVerifier); ok {
+		return true
+	}
+	_, ok := auth.(domain.SecretProvider)
+	return ok
+}
+
+// verifyAPOP checks that digest is the MD5 of the timestamp followed by the user's secret
+func verifyAPOP(auth domain.Authenticator, username string, timestamp string, digest string) error {
+	if verifier, ok := auth.(domain.APOPVerifier); ok {
+		return verifier.VerifyAPOP(username, timestamp, digest)
+	}
+	secrets, ok := auth.(domain.SecretProvider)
+	if !ok {
+		return domain.ErrSecretUnavailable
+	}
+	secret, err := secrets.Secret(username)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum([]byte(timestamp + secret))
+	expected := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) != 1 {
+		return domain.ErrAuthFailed
+	}
+	return nil
+}
+
+// processAPOP authenticates using a digest of the greeting timestamp (RFC 1939 section 7)
+func (s *Session) processAPOP(line string) (string, error) {
+	if len(s.timestamp) == 0 {
+		return "-ERR APOP not available", nil
+	}
+	args := strings.Fields(line)
+	if len(args) != 3 {
+		return "-ERR APOP requires a mailbox name and digest", nil
+	}
+	username := args[1]
+	digest := strings.ToLower(args[2])
+	if err := verifyAPOP(s.Config.Auth, username, s.timestamp, digest); err != nil {
+		return s.authFailure(username, err), nil
+	}
+	return s.login(username), nil
+}
@@ -0,0 +1,41 @@
+package pop3d
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/infodancer/gomail/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPOP(t *testing.T) {
+	createTestMaildrop(t)
+	s, conn := createTestSession(t)
+	assert.NotContains(t, conn.writeLines[0], "<", "no timestamp should be sent unless APOP is enabled")
+	assert.Equal(t, "-ERR APOP not available", send(t, s, "APOP test@example.com 0123456789abcdef"))
+
+	s.Config.APOP = true
+	conn.writeLines = nil
+	s, err := s.Config.Start(conn)
+	require.NoError(t, err)
+	greeting := strings.TrimSpace(conn.writeLines[0])
+	timestamp := greeting[strings.Index(greeting, "<"):]
+	assert.True(t, strings.HasSuffix(timestamp, "@pop3.example.com>"), "unexpected timestamp %s", timestamp)
+
+	assert.Equal(t, "-ERR [AUTH] invalid username or password", send(t, s, "APOP test@example.com 0123456789abcdef"))
+	sum := md5.Sum([]byte(timestamp + "secret"))
+	assert.Equal(t, "+OK maildrop has 0 messages", send(t, s, "APOP test@example.com "+hex.EncodeToString(sum[:])))
+	assert.Equal(t, STATE_TRANSACTION, s.State)
+
+	// Hashed passwords can't answer APOP, so it isn't offered unless plaintext secrets are configured
+	auth, err := domain.NewAuthenticator(config.Authentication{Type: domain.AuthTypePasswd})
+	require.NoError(t, err)
+	conn.writeLines = nil
+	_, err = (&Config{Auth: auth, APOP: true}).Start(conn)
+	require.NoError(t, err)
+	assert.NotContains(t, conn.writeLines[0], "<")
+}
@@ -3,6 +3,7 @@ package pop3d
 import (
 	"github.com/infodancer/gomail/config"
 	"github.com/infodancer/gomail/connect"
+	"github.com/infodancer/gomail/domain"
 )
 
 type Config struct {
@@ -10,6 +11,10 @@ type Config struct {
 	config.ServerConfig `toml:"server"`
 	// POP3-specific configuration
 	Banner string `toml:"banner"`
+	// APOP includes a timestamp in the greeting so that clients may use the APOP command
+	APOP bool `toml:"apop"`
+	// Auth verifies user credentials
+	Auth domain.Authenticator `toml:"-"`
 }
 
 // Start sends the banner for new connections
@@ -17,11 +22,16 @@ func (cfg *Config) Start(c connect.TCPConnection) (*Session, error) {
 	s := Session{
 		Config: *cfg,
 		Conn:   c,
+		State:  STATE_AUTHORIZATION,
 	}
 	banner := cfg.Banner
 	if banner == "" {
 		banner = cfg.ServerName + " POP3 server ready"
 	}
+	if cfg.APOP && supportsAPOP(cfg.Auth) {
+		s.timestamp = createTimestamp(cfg.ServerName)
+		banner += " " + s.timestamp
+	}
 	err := s.SendLine("+OK " + banner)
 	if err != nil {
 		return nil, err
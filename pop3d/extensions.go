@@ -0,0 +1,147 @@
+package pop3d
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/gomail/sasl"
+)
+
+// processCAPA lists the capabilities available in the current state (RFC 2449)
+func (s *Session) processCAPA(line string) (string, error) {
+	capabilities := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE"}
+	if s.State == STATE_AUTHORIZATION && s.Config.Auth != nil {
+		capabilities = append(capabilities, "USER")
+		if mechanisms := s.saslServer().Mechanisms(s.Conn.IsEncrypted()); len(mechanisms) > 0 {
+			capabilities = append(capabilities, "SASL "+strings.Join(mechanisms, " "))
+		}
+	}
+	if s.isSTLSAvailable() {
+		capabilities = append(capabilities, "STLS")
+	}
+	capabilities = append(capabilities, "IMPLEMENTATION gomail")
+	return "+OK Capability list follows\r\n" + strings.Join(capabilities, "\r\n") + "\r\n.", nil
+}
+
+// processUIDL reports the unique-id of one message, or of every message not marked for deletion
+func (s *Session) processUIDL(line string) (string, error) {
+	if arg := extractArgument(line); len(arg) > 0 {
+		n, msg, errResponse := s.getMessage(arg)
+		if msg == nil {
+			return errResponse, nil
+		}
+		return fmt.Sprintf("+OK %d %s", n, uniqueID(msg.id)), nil
+	}
+	var sb strings.Builder
+	sb.WriteString("+OK\r\n")
+	for i, msg := range s.messages {
+		if !msg.deleted {
+			fmt.Fprintf(&sb, "%d %s\r\n", i+1, uniqueID(msg.id))
+		}
+	}
+	sb.WriteString(".")
+	return sb.String(), nil
+}
+
+// processTOP sends the headers of a message and the requested number of body lines
+func (s *Session) processTOP(line string) (string, error) {
+	args := strings.Fields(line)
+	if len(args) != 3 {
+		return "-ERR TOP requires a message number and line count", nil
+	}
+	_, msg, errResponse := s.getMessage(args[1])
+	if msg == nil {
+		return errResponse, nil
+	}
+	lines, err := strconv.Atoi(args[2])
+	if err != nil || lines < 0 {
+		return "-ERR invalid line count", nil
+	}
+	data, err := s.maildir.Read(msg.id)
+	if err != nil {
+		s.Conn.Logger().Printf("error reading message %s: %s", msg.id, err)
+		return "-ERR [SYS/TEMP] unable to read message", nil
+	}
+	return "+OK top of message follows\r\n" + dotStuff(data, lines) + ".", nil
+}
+
+// isSTLSAvailable reports whether STLS can be offered on this connection
+func (s *Session) isSTLSAvailable() bool {
+	return s.State == STATE_AUTHORIZATION && s.Config.TLS.HasCertificate() && !s.Conn.IsEncrypted()
+}
+
+// processSTLS upgrades the connection to TLS as described in RFC 2595
+// The +OK response is sent before the handshake, so this returns an empty response
+func (s *Session) processSTLS(line string) (string, bool, error) {
+	if !s.isSTLSAvailable() {
+		return "-ERR STLS not available", false, nil
+	}
+	tlsConfig, err := s.Config.TLS.TLSConfig()
+	if err != nil {
+		s.Conn.Logger().Printf("error loading TLS configuration: %s", err)
+		return "-ERR [SYS/TEMP] TLS not available", false, nil
+	}
+	if err := s.SendLine("+OK Begin TLS negotiation"); err != nil {
+		return "", true, err
+	}
+	if err := s.Conn.StartTLS(tlsConfig); err != nil {
+		// The connection is in an unknown state, so the only safe option is to drop it
+		s.Conn.Logger().Printf("TLS handshake failed: %s", err)
+		return "", true, nil
+	}
+	// Forget anything the client told us in plaintext
+	s.User = ""
+	return "", false, nil
+}
+
+// saslServer creates the SASL server for this session's authenticator
+func (s *Session) saslServer() *sasl.Server {
+	return &sasl.Server{Auth: s.Config.Auth, Hostname: s.Config.ServerName}
+}
+
+// processAUTH authenticates using a SASL mechanism (RFC 5034)
+func (s *Session) processAUTH(line string) (string, error) {
+	if s.Config.Auth == nil {
+		return "-ERR authentication not available", nil
+	}
+	server := s.saslServer()
+	args := strings.Fields(line)
+	if len(args) == 1 {
+		// Older clients (RFC 1734) ask for a list of mechanisms
+		mechanisms := server.Mechanisms(s.Conn.IsEncrypted())
+		return "+OK\r\n" + strings.Join(append(mechanisms, "."), "\r\n"), nil
+	}
+	if len(args) > 3 {
+		return "-ERR syntax error", nil
+	}
+	mechanism := strings.ToUpper(args[1])
+	if !server.IsAvailable(mechanism, s.Conn.IsEncrypted()) {
+		return "-ERR unsupported authentication mechanism", nil
+	}
+	initial := ""
+	if len(args) == 3 {
+		initial = args[2]
+	}
+	username, err := server.Authenticate(mechanism, initial, s.challenge)
+	if err != nil {
+		switch {
+		case errors.Is(err, sasl.ErrCancelled):
+			return "-ERR authentication cancelled", nil
+		case errors.Is(err, sasl.ErrMalformed):
+			return "-ERR cannot decode response", nil
+		default:
+			return s.authFailure(username, err), nil
+		}
+	}
+	return s.login(username), nil
+}
+
+// challenge sends a continuation and reads the client's response
+func (s *Session) challenge(encoded string) (string, error) {
+	if err := s.SendLine("+ " + encoded); err != nil {
+		return "", err
+	}
+	return s.ReadLine()
+}
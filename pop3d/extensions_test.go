@@ -0,0 +1,89 @@
+package pop3d
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/infodancer/gomail/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAPA(t *testing.T) {
+	createTestMaildrop(t)
+	s, _ := createTestSession(t)
+	capa := send(t, s, "CAPA")
+	assert.True(t, strings.HasPrefix(capa, "+OK"))
+	assert.Contains(t, capa, "\r\nUIDL\r\n")
+	assert.Contains(t, capa, "\r\nUSER\r\n")
+	assert.Contains(t, capa, "\r\nSASL CRAM-MD5\r\n", "plaintext mechanisms should require TLS")
+	assert.NotContains(t, capa, "STLS", "STLS requires a certificate")
+	assert.True(t, strings.HasSuffix(capa, "\r\n."))
+
+	s.Config.TLS = config.SecureConnection{CertFile: "server.crt", KeyFile: "server.key"}
+	assert.Contains(t, send(t, s, "CAPA"), "\r\nSTLS\r\n")
+
+	send(t, s, "USER test@example.com")
+	send(t, s, "PASS secret")
+	capa = send(t, s, "CAPA")
+	assert.NotContains(t, capa, "USER", "USER is only valid before authentication")
+	assert.NotContains(t, capa, "STLS", "STLS is only valid before authentication")
+
+	// CRAM-MD5 needs plaintext secrets, which hashed passwords can't provide
+	auth, err := domain.NewAuthenticator(config.Authentication{Type: domain.AuthTypePasswd})
+	require.NoError(t, err)
+	s, err = (&Config{Auth: auth}).Start(&MockConnection{})
+	require.NoError(t, err)
+	assert.NotContains(t, send(t, s, "CAPA"), "CRAM-MD5")
+}
+
+func TestUIDLAndTOP(t *testing.T) {
+	md := createTestMaildrop(t, "Subject: one\nFrom: a@example.com\n\nline 1\n.line 2\nline 3\n")
+	ids, err := md.List()
+	require.NoError(t, err)
+	s, _ := createTestSession(t)
+	send(t, s, "USER test@example.com")
+	send(t, s, "PASS secret")
+
+	assert.Equal(t, "+OK 1 "+ids[0], send(t, s, "UIDL 1"))
+	assert.Equal(t, "+OK\r\n1 "+ids[0]+"\r\n.", send(t, s, "UIDL"))
+	// Flag changes rename the file but must not change the unique-id
+	require.NoError(t, md.SetFlags(ids[0], []rune{'S'}))
+	assert.Equal(t, "+OK 1 "+ids[0], send(t, s, "UIDL 1"))
+
+	assert.Equal(t, "+OK top of message follows\r\nSubject: one\r\nFrom: a@example.com\r\n\r\n.", send(t, s, "TOP 1 0"))
+	assert.Equal(t, "+OK top of message follows\r\nSubject: one\r\nFrom: a@example.com\r\n\r\nline 1\r\n..line 2\r\n.", send(t, s, "TOP 1 2"))
+	assert.Equal(t, "-ERR invalid line count", send(t, s, "TOP 1 x"))
+
+	send(t, s, "DELE 1")
+	assert.Equal(t, "+OK\r\n.", send(t, s, "UIDL"))
+
+	long := strings.Repeat("x", maxUniqueIDLength+1)
+	assert.Len(t, uniqueID(long), 32, "long names should be hashed")
+	assert.Equal(t, uniqueID(long), uniqueID(long))
+}
+
+func TestSASLAuth(t *testing.T) {
+	createTestMaildrop(t)
+	s, conn := createTestSession(t)
+	assert.Equal(t, "-ERR unsupported authentication mechanism", send(t, s, "AUTH PLAIN"))
+
+	conn.encrypted = true
+	conn.readLines = []string{base64.StdEncoding.EncodeToString([]byte("\x00test@example.com\x00wrong"))}
+	assert.Equal(t, "-ERR [AUTH] invalid username or password", send(t, s, "AUTH PLAIN"))
+	assert.Equal(t, "+ \r\n", conn.writeLines[len(conn.writeLines)-1])
+
+	initial := base64.StdEncoding.EncodeToString([]byte("\x00test@example.com\x00secret"))
+	assert.Equal(t, "+OK maildrop has 0 messages", send(t, s, "AUTH PLAIN "+initial))
+	assert.Equal(t, STATE_TRANSACTION, s.State)
+}
+
+func TestSTLS(t *testing.T) {
+	createTestMaildrop(t)
+	s, _ := createTestSession(t)
+	assert.Equal(t, "-ERR STLS not available", send(t, s, "STLS"))
+	s.Config.TLS = config.SecureConnection{CertFile: "/nonexistent/server.crt", KeyFile: "/nonexistent/server.key"}
+	assert.Equal(t, "-ERR [SYS/TEMP] TLS not available", send(t, s, "STLS"))
+}
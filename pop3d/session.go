@@ -1,13 +1,19 @@
 package pop3d
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/infodancer/gomail/connect"
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/maildir"
 )
 
 // Session describes the current session
@@ -18,8 +24,34 @@ type Session struct {
 	Conn connect.TCPConnection
 	// State holds the state of the session
 	State SessionState
+	// User is the name given by the USER command, awaiting PASS
+	User string
+	// Username is the authenticated user; empty until authenticated
+	Username string
+
+	// timestamp is the APOP timestamp sent in the greeting; empty if APOP is not offered
+	timestamp string
+	// maildir is the user's mailbox, opened on entering the TRANSACTION state
+	maildir *maildir.Maildir
+	// lock prevents other sessions opening the maildir while we hold it (RFC 1939 section 8)
+	lock *maildir.Lock
+	// messages lists the messages in the maildrop, numbered from 1 in POP3 commands
+	messages []*message
+}
+
+// message describes a message in the maildrop
+type message struct {
+	// id is the maildir message identifier
+	id string
+	// size is the size of the message in octets, with CRLF line endings; -1 until it is counted
+	size int64
+	// deleted indicates the message has been marked for deletion
+	deleted bool
 }
 
+// maxUniqueIDLength is the longest unique-id permitted by RFC 1939 section 7
+const maxUniqueIDLength = 70
+
 type SessionState int
 
 const (
@@ -28,16 +60,20 @@ const (
 	STATE_UPDATE
 )
 
-func (s Session) HandleConnection() error {
+func (s *Session) HandleConnection() error {
+	// The maildrop must not stay locked if the client goes away without QUIT
+	defer s.unlock()
 	for {
 		line, err := s.ReadLine()
 		if err != nil {
 			if err == io.EOF {
+				// Deletions are only applied after QUIT (RFC 1939 section 6)
 				break
 			}
 			if err := s.Println("io error reading from connection"); err != nil {
 				return err
 			}
+			return err
 		}
 		response, finished, err := s.HandleInputLine(line)
 		if err != nil {
@@ -46,6 +82,13 @@ func (s Session) HandleConnection() error {
 			}
 			return err
 		}
+		// An empty response means the command has already responded
+		if response == "" {
+			if finished {
+				break
+			}
+			continue
+		}
 		err = s.SendLine(response)
 		if err != nil {
 			if err := s.Println("io error sending response"); err != nil {
@@ -60,12 +103,14 @@ func (s Session) HandleConnection() error {
 	return nil
 }
 
-// SendLine accepts a line without linefeeds and sends it with a CRLF and the provided response code
-func (s Session) SendLine(line string) error {
-	if err := s.Println("S:" + line); err != nil {
+// SendLine accepts a response without the final line ending and sends it with a CRLF
+// Multi-line responses are sent in a single write
+func (s *Session) SendLine(line string) error {
+	status, _, _ := strings.Cut(line, "\r\n")
+	if err := s.Println("S:" + status); err != nil {
 		return err
 	}
-	return s.Conn.WriteLine(line)
+	return s.Conn.WriteLine(line + "\r\n")
 }
 
 func (s *Session) Printf(v ...any) error {
@@ -79,93 +124,442 @@ func (s *Session) Println(v ...any) error {
 }
 
 // ReadLine reads a line
-func (s Session) ReadLine() (string, error) {
+func (s *Session) ReadLine() (string, error) {
 	return s.Conn.ReadLine()
 }
 
 // HandleInputLine accepts a line and handles it
-func (s Session) HandleInputLine(line string) (string, bool, error) {
+// Protocol errors are reported to the client as -ERR responses; a returned error means the session cannot continue
+func (s *Session) HandleInputLine(line string) (string, bool, error) {
 	cmd := strings.Split(line, " ")
 	command := strings.ToUpper(strings.TrimSpace(cmd[0]))
 	switch command {
-	// These commands are valid only in the AUTH state
-	case "USER":
-		response, err := s.processUSER(line)
+	// QUIT terminates the session, and is valid in any state
+	case "QUIT":
+		response, err := s.processQUIT(line)
+		return response, true, err
+	// CAPA is valid in any state (RFC 2449)
+	case "CAPA":
+		response, err := s.processCAPA(line)
 		return response, false, err
-	case "PASS":
-		response, err := s.processPASS(line)
+	// NOOP is harmless, but only permitted after authentication
+	case "NOOP":
+		if s.State != STATE_TRANSACTION {
+			return "-ERR command not valid in this state", false, nil
+		}
+		response, err := s.processNOOP(line)
 		return response, false, err
+	}
+
+	switch s.State {
+	// These commands are valid only in the AUTHORIZATION state
+	case STATE_AUTHORIZATION:
+		switch command {
+		case "USER":
+			response, err := s.processUSER(line)
+			return response, false, err
+		case "PASS":
+			response, err := s.processPASS(line)
+			return response, false, err
+		case "AUTH":
+			response, err := s.processAUTH(line)
+			return response, false, err
+		case "APOP":
+			response, err := s.processAPOP(line)
+			return response, false, err
+		case "STLS":
+			return s.processSTLS(line)
+		}
 
 	// These commands are valid only in the TRANSACTION state
-	case "STAT":
-		response, err := s.processSTAT(line)
-		return response, false, err
-	case "LIST":
-		response, err := s.processLIST(line)
-		return response, false, err
-	case "RETR":
-		response, err := s.processRETR(line)
-		return response, false, err
-	case "DELE":
-		response, err := s.processDELE(line)
-		return response, false, err
+	case STATE_TRANSACTION:
+		switch command {
+		case "STAT":
+			response, err := s.processSTAT(line)
+			return response, false, err
+		case "LIST":
+			response, err := s.processLIST(line)
+			return response, false, err
+		case "RETR":
+			response, err := s.processRETR(line)
+			return response, false, err
+		case "DELE":
+			response, err := s.processDELE(line)
+			return response, false, err
+		case "RSET":
+			response, err := s.processRSET(line)
+			return response, false, err
+		case "UIDL":
+			response, err := s.processUIDL(line)
+			return response, false, err
+		case "TOP":
+			response, err := s.processTOP(line)
+			return response, false, err
+		}
+	}
 
-	// These commands are not vital
-	case "NOOP":
-		response, err := s.processNOOP(line)
-		return response, false, err
+	if isKnownCommand(command) {
+		return "-ERR command not valid in this state", false, nil
+	}
+	return "-ERR unrecognized command", false, nil
+}
 
-	// QUIT terminates the session
-	case "QUIT":
-		response, err := s.processQUIT(line)
-		return response, true, err
-	default:
-		return "-ERR", false, errors.New("unrecognized command")
+// isKnownCommand checks whether a command is implemented in some state
+func isKnownCommand(command string) bool {
+	switch command {
+	case "USER", "PASS", "APOP", "AUTH", "STLS", "STAT", "LIST", "RETR", "DELE", "RSET", "UIDL", "TOP":
+		return true
 	}
+	return false
 }
 
-// processUSER does nothing
-func (s Session) processDELE(line string) (string, error) {
+// processUSER records the name of the mailbox to authenticate
+func (s *Session) processUSER(line string) (string, error) {
+	if s.Config.Auth == nil {
+		return "-ERR authentication not available", nil
+	}
+	name := extractArgument(line)
+	if len(name) == 0 {
+		return "-ERR USER requires a mailbox name", nil
+	}
+	s.User = name
+	return "+OK send PASS", nil
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// processPASS authenticates the user named by USER and opens their maildrop
+func (s *Session) processPASS(line string) (string, error) {
+	if len(s.User) == 0 {
+		return "-ERR USER required before PASS", nil
+	}
+	username := s.User
+	s.User = ""
+	// The password may contain spaces, so take everything after the command
+	password := ""
+	if i := strings.Index(line, " "); i != -1 {
+		password = line[i+1:]
+	}
+	if err := s.Config.Auth.Authenticate(username, password); err != nil {
+		return s.authFailure(username, err), nil
+	}
+	return s.login(username), nil
 }
 
-// processRETR does nothing
-func (s Session) processRETR(line string) (string, error) {
+// authFailure logs a failed authentication and creates the response, distinguishing
+// bad credentials from temporary problems with the authentication backend (RFC 3206)
+func (s *Session) authFailure(username string, err error) string {
+	if errors.Is(err, domain.ErrAuthFailed) || errors.Is(err, domain.ErrSecretUnavailable) {
+		if err := s.Println("Authentication failed for: " + username); err != nil {
+			s.Conn.Logger().Print(err)
+		}
+		return "-ERR [AUTH] invalid username or password"
+	}
+	s.Conn.Logger().Printf("error during authentication: %s", err)
+	return "-ERR [SYS/TEMP] authentication temporarily unavailable"
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// login opens the maildrop for an authenticated user and enters the TRANSACTION state
+func (s *Session) login(username string) string {
+	if err := s.openMaildrop(username); err != nil {
+		if errors.Is(err, maildir.ErrLocked) {
+			return "-ERR [IN-USE] maildrop already locked"
+		}
+		s.Conn.Logger().Printf("error opening maildrop for %s: %s", username, err)
+		return "-ERR [SYS/TEMP] unable to open maildrop"
+	}
+	s.Username = username
+	s.State = STATE_TRANSACTION
+	return fmt.Sprintf("+OK maildrop has %d messages", s.count())
 }
 
-// processLIST does nothing
-func (s Session) processLIST(line string) (string, error) {
+// openMaildrop locks the user's maildir and loads the list of messages in it
+func (s *Session) openMaildrop(username string) error {
+	user, domainName, err := domain.SplitUsername(username)
+	if err != nil {
+		return err
+	}
+	dom, err := domain.GetDomain(domainName)
+	if err != nil {
+		return err
+	}
+	md, err := dom.GetUserMaildir(user)
+	if err != nil {
+		return err
+	}
+	lock, err := md.Lock()
+	if err != nil {
+		return err
+	}
+	s.lock = lock
+	ids, err := md.List()
+	if err != nil {
+		s.unlock()
+		return err
+	}
+	// Sizes are counted when first needed, so logging in doesn't read the whole maildrop
+	messages := make([]*message, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, &message{id: id, size: -1})
+	}
+	s.maildir = md
+	s.messages = messages
+	return nil
+}
+
+// count returns the number of messages not marked for deletion
+func (s *Session) count() int {
+	count := 0
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			count++
+		}
+	}
+	return count
+}
+
+// stat counts the messages not marked for deletion and their total size
+func (s *Session) stat() (int, int64, error) {
+	var size int64
+	for _, msg := range s.messages {
+		if msg.deleted {
+			continue
+		}
+		n, err := s.messageSize(msg)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += n
+	}
+	return s.count(), size, nil
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// messageSize returns the size of a message, reading through it the first time it is needed
+func (s *Session) messageSize(msg *message) (int64, error) {
+	if msg.size >= 0 {
+		return msg.size, nil
+	}
+	f, err := s.maildir.Open(msg.id)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			s.Conn.Logger().Printf("error closing message %s: %s", msg.id, err)
+		}
+	}()
+	size, err := countOctets(f)
+	if err != nil {
+		return 0, err
+	}
+	msg.size = size
+	return size, nil
 }
 
-// processSTAT does nothing
-func (s Session) processSTAT(line string) (string, error) {
+// getMessage looks up a message by the number given as a command argument
+func (s *Session) getMessage(arg string) (int, *message, string) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, nil, "-ERR invalid message number"
+	}
+	if n < 1 || n > len(s.messages) {
+		return 0, nil, "-ERR no such message"
+	}
+	msg := s.messages[n-1]
+	if msg.deleted {
+		return 0, nil, fmt.Sprintf("-ERR message %d already deleted", n)
+	}
+	return n, msg, ""
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// processSTAT reports the number and size of messages in the maildrop
+func (s *Session) processSTAT(line string) (string, error) {
+	count, size, err := s.stat()
+	if err != nil {
+		s.Conn.Logger().Printf("error reading maildrop: %s", err)
+		return "-ERR [SYS/TEMP] unable to read maildrop", nil
+	}
+	return fmt.Sprintf("+OK %d %d", count, size), nil
 }
 
-// processUSER does nothing
-func (s Session) processUSER(line string) (string, error) {
+// processLIST reports the size of one message, or of every message not marked for deletion
+func (s *Session) processLIST(line string) (string, error) {
+	if arg := extractArgument(line); len(arg) > 0 {
+		n, msg, errResponse := s.getMessage(arg)
+		if msg == nil {
+			return errResponse, nil
+		}
+		size, err := s.messageSize(msg)
+		if err != nil {
+			s.Conn.Logger().Printf("error reading message %s: %s", msg.id, err)
+			return "-ERR [SYS/TEMP] unable to read message", nil
+		}
+		return fmt.Sprintf("+OK %d %d", n, size), nil
+	}
+	count, size, err := s.stat()
+	if err != nil {
+		s.Conn.Logger().Printf("error reading maildrop: %s", err)
+		return "-ERR [SYS/TEMP] unable to read maildrop", nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "+OK %d messages (%d octets)\r\n", count, size)
+	for i, msg := range s.messages {
+		if !msg.deleted {
+			fmt.Fprintf(&sb, "%d %d\r\n", i+1, msg.size)
+		}
+	}
+	sb.WriteString(".")
+	return sb.String(), nil
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// processRETR sends a complete message as a dot-stuffed multi-line response
+func (s *Session) processRETR(line string) (string, error) {
+	_, msg, errResponse := s.getMessage(extractArgument(line))
+	if msg == nil {
+		return errResponse, nil
+	}
+	data, err := s.maildir.Read(msg.id)
+	if err != nil {
+		s.Conn.Logger().Printf("error reading message %s: %s", msg.id, err)
+		return "-ERR [SYS/TEMP] unable to read message", nil
+	}
+	msg.size = octets(data)
+	return fmt.Sprintf("+OK %d octets\r\n", msg.size) + dotStuff(data, -1) + ".", nil
 }
 
-// processPASS does nothing
-func (s Session) processPASS(line string) (string, error) {
+// processDELE marks a message for deletion when the session ends
+func (s *Session) processDELE(line string) (string, error) {
+	n, msg, errResponse := s.getMessage(extractArgument(line))
+	if msg == nil {
+		return errResponse, nil
+	}
+	msg.deleted = true
+	return fmt.Sprintf("+OK message %d deleted", n), nil
+}
 
-	return "-ERR", errors.New("not yet implemented")
+// processRSET removes all deletion marks
+func (s *Session) processRSET(line string) (string, error) {
+	for _, msg := range s.messages {
+		msg.deleted = false
+	}
+	return fmt.Sprintf("+OK maildrop has %d messages", s.count()), nil
 }
 
 // processNOOP does nothing
-func (s Session) processNOOP(line string) (string, error) {
+func (s *Session) processNOOP(line string) (string, error) {
 	return "+OK", nil
 }
 
-// processQUIT simply terminates the session
-func (s Session) processQUIT(line string) (string, error) {
-	return "+OK goodbye", nil
+// processQUIT terminates the session, removing deleted messages if the user authenticated
+func (s *Session) processQUIT(line string) (string, error) {
+	if s.State != STATE_TRANSACTION {
+		return "+OK goodbye", nil
+	}
+	s.State = STATE_UPDATE
+	defer s.unlock()
+	ids := make([]string, 0)
+	for _, msg := range s.messages {
+		if msg.deleted {
+			ids = append(ids, msg.id)
+		}
+	}
+	if len(ids) > 0 {
+		if err := s.maildir.Delete(ids...); err != nil {
+			s.Conn.Logger().Printf("error deleting messages: %s", err)
+			return "-ERR [SYS/TEMP] some deleted messages not removed", nil
+		}
+	}
+	return fmt.Sprintf("+OK goodbye (%d messages left)", s.count()), nil
+}
+
+// unlock releases the maildrop lock, if held
+func (s *Session) unlock() {
+	if s.lock == nil {
+		return
+	}
+	if err := s.lock.Unlock(); err != nil {
+		s.Conn.Logger().Printf("error unlocking maildrop: %s", err)
+	}
+	s.lock = nil
+}
+
+// extractArgument returns everything after the command, trimmed of whitespace
+func extractArgument(line string) string {
+	i := strings.Index(line, " ")
+	if i == -1 {
+		return ""
+	}
+	return strings.TrimSpace(line[i+1:])
+}
+
+// uniqueID derives the UIDL identifier from the maildir unique name, which does not change
+// when flags are set; names that are too long or contain invalid characters are hashed
+func uniqueID(id string) string {
+	if len(id) <= maxUniqueIDLength && strings.IndexFunc(id, func(r rune) bool { return r < 0x21 || r > 0x7e }) == -1 {
+		return id
+	}
+	sum := md5.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// octets calculates the size of a message as sent by dotStuff, before any periods are escaped
+func octets(data []byte) int64 {
+	size, _ := countOctets(bytes.NewReader(data))
+	return size
+}
+
+// countOctets calculates the size of a message read from r, as octets does
+func countOctets(r io.Reader) (int64, error) {
+	var size int64
+	var last byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' && last != '\r' {
+				size++
+			}
+			last = b
+		}
+		size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	// A final line ending is added if the message lacks one
+	if size > 0 && last != '\n' {
+		size += 2
+	}
+	return size, nil
+}
+
+// dotStuff converts a message to CRLF line endings, escaping lines that begin with a period
+// If bodyLines is not negative, only the headers and that many lines of the body are included
+// The result always ends with CRLF, ready for the terminating "."
+func dotStuff(data []byte, bodyLines int) string {
+	var sb strings.Builder
+	sb.Grow(len(data) + len(data)/40)
+	text := string(data)
+	inBody := false
+	for len(text) > 0 {
+		if inBody && bodyLines >= 0 {
+			if bodyLines == 0 {
+				break
+			}
+			bodyLines--
+		}
+		line, rest, _ := strings.Cut(text, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, ".") {
+			sb.WriteString(".")
+		}
+		sb.WriteString(line)
+		sb.WriteString("\r\n")
+		if len(line) == 0 {
+			inBody = true
+		}
+		text = rest
+	}
+	return sb.String()
 }
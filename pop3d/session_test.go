@@ -0,0 +1,232 @@
+package pop3d
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/infodancer/gomail/config"
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/maildir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// MockConnection implements connect.TCPConnection for testing
+type MockConnection struct {
+	readLines  []string
+	writeLines []string
+	readIndex  int
+	encrypted  bool
+}
+
+func (m *MockConnection) ReadLine() (string, error) {
+	if m.readIndex >= len(m.readLines) {
+		return "", io.EOF
+	}
+	line := m.readLines[m.readIndex]
+	m.readIndex++
+	return line, nil
+}
+
+func (m *MockConnection) ReadChunk(w io.Writer, n int64) (int64, error) {
+	return 0, errors.New("chunks not supported by mock connection")
+}
+
+func (m *MockConnection) WriteLine(s string) error {
+	m.writeLines = append(m.writeLines, s)
+	return nil
+}
+
+func (m *MockConnection) Write(s string) error {
+	m.writeLines = append(m.writeLines, s)
+	return nil
+}
+
+func (m *MockConnection) Flush() error {
+	return nil
+}
+
+func (m *MockConnection) InputPending() bool {
+	return false
+}
+
+func (m *MockConnection) Close() error {
+	return nil
+}
+
+func (m *MockConnection) GetProto() string {
+	return "tcp"
+}
+
+func (m *MockConnection) GetTCPLocalIP() string {
+	return "127.0.0.1"
+}
+
+func (m *MockConnection) GetTCPLocalPort() string {
+	return "110"
+}
+
+func (m *MockConnection) GetTCPLocalHost() string {
+	return "localhost"
+}
+
+func (m *MockConnection) GetTCPRemotePort() string {
+	return "12345"
+}
+
+func (m *MockConnection) GetTCPRemoteIP() string {
+	return "192.168.1.100"
+}
+
+func (m *MockConnection) GetTCPRemoteHost() string {
+	return "client.example.com"
+}
+
+func (m *MockConnection) IsEncrypted() bool {
+	return m.encrypted
+}
+
+func (m *MockConnection) StartTLS(cfg *tls.Config) error {
+	return errors.New("TLS not supported by mock connection")
+}
+
+func (m *MockConnection) Logger() *log.Logger {
+	return log.New(os.Stderr, "mock: ", log.LstdFlags)
+}
+
+// createTestMaildrop creates a domain root with test@example.com, password "secret", holding the given messages
+func createTestMaildrop(t *testing.T, msgs ...string) *maildir.Maildir {
+	root := t.TempDir()
+	domainPath := filepath.Join(root, "example.com")
+	require.NoError(t, os.MkdirAll(filepath.Join(domainPath, "users", "test"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(domainPath, "passwd"), []byte("test:{PLAIN}secret\n"), 0600))
+	md, err := maildir.Create(filepath.Join(domainPath, "users", "test", "Maildir"))
+	require.NoError(t, err)
+	for _, msg := range msgs {
+		_, err := md.Add([]byte(msg))
+		require.NoError(t, err)
+	}
+	previous := domain.DomainRoot()
+	domain.SetDomainRoot(root)
+	t.Cleanup(func() { domain.SetDomainRoot(previous) })
+	return md
+}
+
+func createTestSession(t *testing.T) (*Session, *MockConnection) {
+	auth, err := domain.NewAuthenticator(config.Authentication{Type: domain.AuthTypePasswd, PlainSecrets: true})
+	require.NoError(t, err)
+	conn := &MockConnection{}
+	cfg := Config{Auth: auth}
+	cfg.ServerName = "pop3.example.com"
+	s, err := cfg.Start(conn)
+	require.NoError(t, err)
+	return s, conn
+}
+
+// send runs a command and returns the response
+func send(t *testing.T, s *Session, line string) string {
+	response, _, err := s.HandleInputLine(line)
+	require.NoError(t, err)
+	return response
+}
+
+func TestAuthorization(t *testing.T) {
+	createTestMaildrop(t)
+	s, conn := createTestSession(t)
+	assert.Equal(t, []string{"+OK pop3.example.com POP3 server ready\r\n"}, conn.writeLines)
+
+	assert.Equal(t, "-ERR command not valid in this state", send(t, s, "STAT"))
+	assert.Equal(t, "-ERR USER required before PASS", send(t, s, "PASS secret"))
+	assert.Equal(t, "+OK send PASS", send(t, s, "USER test@example.com"))
+	assert.Equal(t, "-ERR [AUTH] invalid username or password", send(t, s, "PASS wrong"))
+	assert.Equal(t, STATE_AUTHORIZATION, s.State)
+
+	send(t, s, "USER test@example.com")
+	assert.Equal(t, "+OK maildrop has 0 messages", send(t, s, "PASS secret"))
+	assert.Equal(t, STATE_TRANSACTION, s.State)
+	assert.Equal(t, "test@example.com", s.Username)
+	assert.Equal(t, "-ERR command not valid in this state", send(t, s, "USER test@example.com"))
+	assert.Equal(t, "-ERR unrecognized command", send(t, s, "XYZZY"))
+}
+
+func TestTransaction(t *testing.T) {
+	md := createTestMaildrop(t, "Subject: one\n\nFirst message\n", "Subject: two\n\n.hidden\nSecond\n")
+	s, _ := createTestSession(t)
+	send(t, s, "USER test@example.com")
+	assert.Equal(t, "+OK maildrop has 2 messages", send(t, s, "PASS secret"))
+	assert.Equal(t, int64(-1), s.messages[0].size, "sizes should only be counted when needed")
+
+	assert.Equal(t, "+OK 2 64", send(t, s, "STAT"))
+	assert.Equal(t, "+OK 2 messages (64 octets)\r\n1 31\r\n2 33\r\n.", send(t, s, "LIST"))
+	assert.Equal(t, "+OK 2 33", send(t, s, "LIST 2"))
+	assert.Equal(t, "-ERR no such message", send(t, s, "LIST 3"))
+	assert.Equal(t, "+OK 33 octets\r\nSubject: two\r\n\r\n..hidden\r\nSecond\r\n.", send(t, s, "RETR 2"))
+
+	assert.Equal(t, "+OK message 1 deleted", send(t, s, "DELE 1"))
+	assert.Equal(t, "-ERR message 1 already deleted", send(t, s, "RETR 1"))
+	assert.Equal(t, "+OK 1 33", send(t, s, "STAT"))
+	assert.Equal(t, "+OK maildrop has 2 messages", send(t, s, "RSET"))
+	send(t, s, "DELE 1")
+
+	// Nothing is removed until QUIT
+	ids, err := md.List()
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+	response, finished, err := s.HandleInputLine("QUIT")
+	require.NoError(t, err)
+	assert.True(t, finished)
+	assert.Equal(t, "+OK goodbye (1 messages left)", response)
+	assert.Equal(t, STATE_UPDATE, s.State)
+	ids, err = md.List()
+	require.NoError(t, err)
+	assert.Len(t, ids, 1)
+}
+
+func TestDisconnectWithoutQuit(t *testing.T) {
+	md := createTestMaildrop(t, "Subject: one\n\nFirst message\n")
+	s, conn := createTestSession(t)
+	conn.readLines = []string{"USER test@example.com", "PASS secret", "DELE 1"}
+	require.NoError(t, s.HandleConnection())
+	ids, err := md.List()
+	require.NoError(t, err)
+	assert.Len(t, ids, 1, "messages should only be deleted after QUIT")
+}
+
+func TestDotStuff(t *testing.T) {
+	assert.Equal(t, "a\r\n..b\r\nc\r\n", dotStuff([]byte("a\n.b\r\nc"), -1))
+	assert.Equal(t, int64(len("a\r\n.b\r\nc\r\n")), octets([]byte("a\n.b\r\nc")))
+	// Line endings split between reads are still counted once
+	size, err := countOctets(iotest.OneByteReader(strings.NewReader("a\r\nb\n")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("a\r\nb\r\n")), size)
+}
+
+func TestMaildropLocking(t *testing.T) {
+	createTestMaildrop(t, "Subject: one\n\nFirst message\n")
+	first, _ := createTestSession(t)
+	send(t, first, "USER test@example.com")
+	assert.Equal(t, "+OK maildrop has 1 messages", send(t, first, "PASS secret"))
+
+	second, _ := createTestSession(t)
+	send(t, second, "USER test@example.com")
+	assert.Equal(t, "-ERR [IN-USE] maildrop already locked", send(t, second, "PASS secret"))
+	assert.Equal(t, STATE_AUTHORIZATION, second.State)
+
+	send(t, first, "QUIT")
+	send(t, second, "USER test@example.com")
+	assert.Equal(t, "+OK maildrop has 1 messages", send(t, second, "PASS secret"))
+
+	// Dropping the connection without QUIT releases the lock too
+	second.Conn.(*MockConnection).readLines = nil
+	require.NoError(t, second.HandleConnection())
+	third, _ := createTestSession(t)
+	send(t, third, "USER test@example.com")
+	assert.Equal(t, "+OK maildrop has 1 messages", send(t, third, "PASS secret"))
+}
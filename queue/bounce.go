@@ -0,0 +1,319 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Delivery status notification actions (RFC 3464 section 2.3.3)
+const (
+	actionFailed    = "failed"
+	actionDelayed   = "delayed"
+	actionDelivered = "delivered"
+	actionRelayed   = "relayed"
+)
+
+// enhancedStatusPattern matches an RFC 3463 enhanced status code at the start of a reply
+var enhancedStatusPattern = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+
+// deliveryStatus derives the enhanced status code and diagnostic for the result of a delivery attempt
+// Replies from remote servers become the diagnostic, and supply the status code if they include one
+func deliveryStatus(err error) (string, string) {
+	if err == nil || errors.Is(err, ErrRelayed) || errors.Is(err, ErrRelayedWithDSN) {
+		return "2.0.0", ""
+	}
+	status := "4.0.0"
+	if IsPermanent(err) {
+		status = "5.0.0"
+	}
+	diagnostic := ""
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		text := strings.ReplaceAll(reply.Msg, "\n", " ")
+		diagnostic = fmt.Sprintf("smtp; %03d %s", reply.Code, text)
+		if code := enhancedStatusPattern.FindString(text); code != "" {
+			status = code
+		} else if reply.Code >= 400 && reply.Code < 600 {
+			status = fmt.Sprintf("%d.0.0", reply.Code/100)
+		}
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		status = statusErr.Status
+	}
+	return status, diagnostic
+}
+
+// notify sends delivery status notifications to the sender for new permanent failures,
+// a warning once if delivery to the remaining recipients has been delayed too long, and
+// reports of successful delivery or relaying, as the sender asked with NOTIFY (RFC 3461)
+// Bounces have a null sender and are never themselves bounced (RFC 5321 section 4.5.5)
+func (r *Runner) notify(env *Envelope, msg []byte, now time.Time) error {
+	failed := make([]*EnvelopeRecipient, 0)
+	delayed := make([]*EnvelopeRecipient, 0)
+	delivered := make([]*EnvelopeRecipient, 0)
+	relayed := make([]*EnvelopeRecipient, 0)
+	for i := range env.Status {
+		rcpt := &env.Status[i]
+		switch {
+		case rcpt.Failed && !rcpt.Notified:
+			if rcpt.notifyOn(NotifyFailure) || env.IsBounce() {
+				failed = append(failed, rcpt)
+			}
+		case rcpt.Delivered && !rcpt.Notified:
+			if !rcpt.notifyOn(NotifySuccess) {
+				break
+			}
+			if rcpt.last().DeliveryResult == DeliveryResultRelayed {
+				relayed = append(relayed, rcpt)
+			} else {
+				delivered = append(delivered, rcpt)
+			}
+		case !rcpt.Delivered && !rcpt.Failed:
+			if rcpt.notifyOn(NotifyDelay) {
+				delayed = append(delayed, rcpt)
+			}
+		}
+	}
+	if env.IsBounce() {
+		for _, rcpt := range failed {
+			logger.Printf("discarding bounce for %s, which could not be delivered", rcpt.Recipient)
+			rcpt.Notified = true
+		}
+		return nil
+	}
+
+	if len(failed) > 0 {
+		rep := &report{hostname: r.hostname(), env: env, recipients: failed, action: actionFailed}
+		if err := r.Queue.Enqueue("", []string{env.Sender}, rep.create(msg, now)); err != nil {
+			return err
+		}
+		for _, rcpt := range failed {
+			rcpt.Notified = true
+		}
+	}
+	if len(delivered) > 0 {
+		rep := &report{hostname: r.hostname(), env: env, recipients: delivered, action: actionDelivered}
+		if err := r.Queue.Enqueue("", []string{env.Sender}, rep.create(msg, now)); err != nil {
+			return err
+		}
+		for _, rcpt := range delivered {
+			rcpt.Notified = true
+		}
+	}
+	if len(relayed) > 0 {
+		rep := &report{hostname: r.hostname(), env: env, recipients: relayed, action: actionRelayed}
+		if err := r.Queue.Enqueue("", []string{env.Sender}, rep.create(msg, now)); err != nil {
+			return err
+		}
+		for _, rcpt := range relayed {
+			rcpt.Notified = true
+		}
+	}
+	if len(delayed) > 0 && !env.DelayWarned && now.Sub(env.Created) > r.Schedule.warnAfter() {
+		rep := &report{hostname: r.hostname(), env: env, recipients: delayed, action: actionDelayed,
+			retryUntil: env.Created.Add(r.Schedule.maxLifetime())}
+		if err := r.Queue.Enqueue("", []string{env.Sender}, rep.create(msg, now)); err != nil {
+			return err
+		}
+		env.DelayWarned = true
+	}
+	return nil
+}
+
+func (r *Runner) hostname() string {
+	if r.Hostname != "" {
+		return r.Hostname
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// report describes a delivery status notification for some of the recipients of a message
+type report struct {
+	hostname   string
+	env        *Envelope
+	recipients []*EnvelopeRecipient
+	action     string
+	// retryUntil is when delivery will be abandoned, included in delay warnings
+	retryUntil time.Time
+}
+
+// create builds the notification as an RFC 3464 multipart/report message, returning
+// the headers of the original message rather than the whole message
+func (rep *report) create(msg []byte, now time.Time) []byte {
+	boundary := createUniqueName() + "/" + rep.hostname
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\n", rep.hostname)
+	fmt.Fprintf(&b, "To: <%s>\n", rep.env.Sender)
+	switch rep.action {
+	case actionDelayed:
+		b.WriteString("Subject: Delayed Mail (still being retried)\n")
+	case actionDelivered, actionRelayed:
+		b.WriteString("Subject: Successful Mail Delivery Report\n")
+	default:
+		b.WriteString("Subject: Undelivered Mail Returned to Sender\n")
+	}
+	fmt.Fprintf(&b, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\n", createUniqueName(), rep.hostname)
+	b.WriteString("Auto-Submitted: auto-replied\n")
+	b.WriteString("MIME-Version: 1.0\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\n\tboundary=\"%s\"\n", boundary)
+	b.WriteString("\nThis is a MIME-encapsulated message.\n\n")
+
+	// Human readable explanation
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	b.WriteString("Content-Description: Notification\n")
+	b.WriteString("Content-Type: text/plain; charset=us-ascii\n\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\n\n", rep.hostname)
+	switch rep.action {
+	case actionDelayed:
+		b.WriteString("Your message could not be delivered to the following recipients yet.\n")
+		fmt.Fprintf(&b, "Delivery will be retried until %s.\n\n", rep.retryUntil.Format(time.RFC1123Z))
+		for _, rcpt := range rep.recipients {
+			fmt.Fprintf(&b, "<%s>\n", rcpt.Recipient)
+		}
+	case actionDelivered:
+		b.WriteString("Your message was successfully delivered to the following recipients.\n\n")
+		for _, rcpt := range rep.recipients {
+			fmt.Fprintf(&b, "<%s>\n", rcpt.Recipient)
+		}
+	case actionRelayed:
+		b.WriteString("Your message was passed on to mail servers that do not send delivery reports,\n")
+		b.WriteString("so you will not be told when it reaches the following recipients.\n")
+		b.WriteString("You may still be told about delivery errors by other systems.\n\n")
+		for _, rcpt := range rep.recipients {
+			fmt.Fprintf(&b, "<%s>\n", rcpt.Recipient)
+		}
+	default:
+		b.WriteString("Your message could not be delivered to the following recipients.\n\n")
+		for _, rcpt := range rep.recipients {
+			fmt.Fprintf(&b, "<%s>: %s\n", rcpt.Recipient, rcpt.last().explanation())
+		}
+	}
+	b.WriteString("\n")
+
+	// Machine readable status
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	b.WriteString("Content-Description: Delivery report\n")
+	b.WriteString("Content-Type: message/delivery-status\n\n")
+	if rep.env.EnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\n", rep.env.EnvID)
+	}
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\n", rep.hostname)
+	if !rep.env.Created.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\n", rep.env.Created.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range rep.recipients {
+		last := rcpt.last()
+		b.WriteString("\n")
+		if rcpt.ORCPT != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\n", rcpt.ORCPT)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\n", rcpt.Recipient)
+		fmt.Fprintf(&b, "Action: %s\n", rep.action)
+		fmt.Fprintf(&b, "Status: %s\n", statusForAction(last.Status, rep.action))
+		if diagnostic := rcpt.diagnostic(); diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: %s\n", diagnostic)
+		}
+		if !last.Time.IsZero() {
+			fmt.Fprintf(&b, "Last-Attempt-Date: %s\n", last.Time.Format(time.RFC1123Z))
+		}
+		if rep.action == actionDelayed {
+			fmt.Fprintf(&b, "Will-Retry-Until: %s\n", rep.retryUntil.Format(time.RFC1123Z))
+		}
+	}
+	b.WriteString("\n")
+
+	// The original message, or only its headers unless the sender asked for the whole
+	// message to be returned with failures (RFC 3461 section 4.3)
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	if rep.action == actionFailed && rep.env.Ret == ReturnFull {
+		b.WriteString("Content-Description: Undelivered Message\n")
+		b.WriteString("Content-Type: message/rfc822\n\n")
+		b.Write(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")))
+		if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+			b.WriteString("\n")
+		}
+	} else {
+		if rep.action == actionDelivered || rep.action == actionRelayed {
+			b.WriteString("Content-Description: Delivered Message Headers\n")
+		} else {
+			b.WriteString("Content-Description: Undelivered Message Headers\n")
+		}
+		b.WriteString("Content-Type: text/rfc822-headers\n\n")
+		b.Write(messageHeaders(msg))
+	}
+	fmt.Fprintf(&b, "\n--%s--\n", boundary)
+	return b.Bytes()
+}
+
+// last returns the most recent delivery attempt
+func (rcpt *EnvelopeRecipient) last() EnvelopeDelivery {
+	if len(rcpt.Result) == 0 {
+		return EnvelopeDelivery{}
+	}
+	return rcpt.Result[len(rcpt.Result)-1]
+}
+
+// explanation describes the result in a form suitable for the sender, preferring the remote server's reply
+func (result EnvelopeDelivery) explanation() string {
+	if result.Diagnostic != "" {
+		_, reply, _ := strings.Cut(result.Diagnostic, "; ")
+		return reply
+	}
+	return result.Message
+}
+
+// diagnostic returns the most recent reply from a remote server, which may come
+// from an earlier attempt if the message has since expired
+func (rcpt *EnvelopeRecipient) diagnostic() string {
+	for i := len(rcpt.Result) - 1; i >= 0; i-- {
+		if rcpt.Result[i].Diagnostic != "" {
+			return rcpt.Result[i].Diagnostic
+		}
+	}
+	return ""
+}
+
+// statusForAction makes sure the status code class matches the reported action, since a failed
+// action must carry a permanent status and a delayed one a transient status (RFC 3464 section 2.3.4)
+func statusForAction(status string, action string) string {
+	if status == "" {
+		switch action {
+		case actionDelayed:
+			return "4.0.0"
+		case actionDelivered, actionRelayed:
+			return "2.0.0"
+		}
+		return "5.0.0"
+	}
+	if action == actionDelayed && !strings.HasPrefix(status, "4.") {
+		return "4" + status[1:]
+	}
+	if action == actionFailed && !strings.HasPrefix(status, "5.") {
+		return "5" + status[1:]
+	}
+	return status
+}
+
+// messageHeaders returns the header section of a message, ending with a line break
+func messageHeaders(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	if i := bytes.Index(msg, []byte("\n\n")); i >= 0 {
+		return msg[:i+1]
+	}
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		return append(msg, '\n')
+	}
+	return msg
+}
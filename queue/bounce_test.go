@@ -0,0 +1,220 @@
+package queue
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadOthers loads the queued envelopes other than the named one
+func loadOthers(t *testing.T, q *Queue, name string) []*Envelope {
+	names, err := q.List()
+	require.NoError(t, err)
+	result := make([]*Envelope, 0)
+	for _, n := range names {
+		if n == name {
+			continue
+		}
+		env, err := q.Load(n)
+		require.NoError(t, err)
+		result = append(result, env)
+	}
+	return result
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	status, diagnostic := deliveryStatus(nil)
+	assert.Equal(t, "2.0.0", status)
+	assert.Equal(t, "", diagnostic)
+
+	status, diagnostic = deliveryStatus(errors.New("connection refused"))
+	assert.Equal(t, "4.0.0", status)
+	assert.Equal(t, "", diagnostic)
+
+	status, diagnostic = deliveryStatus(Permanent(&textproto.Error{Code: 550, Msg: "5.1.1 no such user\nreally"}))
+	assert.Equal(t, "5.1.1", status)
+	assert.Equal(t, "smtp; 550 5.1.1 no such user really", diagnostic)
+
+	status, _ = deliveryStatus(&textproto.Error{Code: 452, Msg: "mailbox full"})
+	assert.Equal(t, "4.0.0", status)
+
+	status, _ = deliveryStatus(Permanent(WithStatus("5.1.2", errors.New("no such domain"))))
+	assert.Equal(t, "5.1.2", status)
+
+	assert.Equal(t, "5.4.7", statusForAction("4.4.7", actionFailed), "failed actions need a permanent status")
+	assert.Equal(t, "4.4.1", statusForAction("5.4.1", actionDelayed))
+	assert.Equal(t, "5.0.0", statusForAction("", actionFailed))
+}
+
+func TestBounce(t *testing.T) {
+	q := createTestQueue(t)
+	msg := "From: sender@example.com\nSubject: hello\n\nsecret body\n"
+	require.NoError(t, q.Enqueue("sender@example.com", []string{"never@example.net"}, []byte(msg)))
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	transport := &fakeTransport{results: map[string]error{
+		"never@example.net": Permanent(&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}),
+	}}
+	r := &Runner{Queue: q, Transport: transport, Hostname: "mail.example.com"}
+	require.NoError(t, r.RunOnce())
+
+	bounces := loadOthers(t, q, names[0])
+	require.Len(t, bounces, 1)
+	assert.Equal(t, "", bounces[0].Sender, "bounces must have a null sender")
+	assert.Equal(t, []string{"sender@example.com"}, bounces[0].Recipients)
+	data, err := q.ReadMessage(bounces[0])
+	require.NoError(t, err)
+	dsn := string(data)
+	assert.Contains(t, dsn, "From: Mail Delivery System <MAILER-DAEMON@mail.example.com>\n")
+	assert.Contains(t, dsn, "To: <sender@example.com>\n")
+	assert.Contains(t, dsn, "Auto-Submitted: auto-replied\n")
+	assert.Contains(t, dsn, "Content-Type: multipart/report; report-type=delivery-status;")
+	assert.Contains(t, dsn, "<never@example.net>: 550 5.1.1 no such user\n")
+	assert.Contains(t, dsn, "Reporting-MTA: dns; mail.example.com\n")
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; never@example.net\nAction: failed\nStatus: 5.1.1\nDiagnostic-Code: smtp; 550 5.1.1 no such user\n")
+	assert.Contains(t, dsn, "Content-Type: text/rfc822-headers\n\nFrom: sender@example.com\nSubject: hello\n\n--")
+	assert.NotContains(t, dsn, "secret body", "only the original headers should be returned")
+
+	// The bounce itself can't be delivered, and must not generate another bounce
+	transport.results["sender@example.com"] = Permanent(errors.New("no such user"))
+	require.NoError(t, r.RunOnce())
+	names, err = q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0, "undeliverable bounce should be discarded")
+}
+
+func TestDelayWarning(t *testing.T) {
+	q := createTestQueue(t)
+	require.NoError(t, q.Enqueue("sender@example.com", []string{"later@example.net"}, []byte("Subject: hello\n\nbody\n")))
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	name := names[0]
+	transport := &fakeTransport{results: map[string]error{
+		"later@example.net":  &textproto.Error{Code: 451, Msg: "4.3.0 try again later"},
+		"sender@example.com": errors.New("sender's server is down too"),
+	}}
+	r := &Runner{Queue: q, Transport: transport, Hostname: "mail.example.com", Schedule: Schedule{WarnAfter: time.Hour}}
+
+	// No warning until the message has been delayed long enough
+	require.NoError(t, r.RunOnce())
+	assert.Len(t, loadOthers(t, q, name), 0)
+
+	env, err := q.Load(name)
+	require.NoError(t, err)
+	env.Created = time.Now().Add(-2 * time.Hour)
+	env.NextAttempt = time.Time{}
+	require.NoError(t, q.Save(env))
+	require.NoError(t, r.RunOnce())
+	warnings := loadOthers(t, q, name)
+	require.Len(t, warnings, 1)
+	data, err := q.ReadMessage(warnings[0])
+	require.NoError(t, err)
+	dsn := string(data)
+	assert.Contains(t, dsn, "Subject: Delayed Mail (still being retried)\n")
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; later@example.net\nAction: delayed\nStatus: 4.3.0\nDiagnostic-Code: smtp; 451 4.3.0 try again later\n")
+	assert.Contains(t, dsn, "Will-Retry-Until: ")
+
+	// The warning is only sent once
+	env, err = q.Load(name)
+	require.NoError(t, err)
+	assert.True(t, env.DelayWarned)
+	env.NextAttempt = time.Time{}
+	require.NoError(t, q.Save(env))
+	require.NoError(t, r.RunOnce())
+	assert.Len(t, loadOthers(t, q, name), 1)
+}
+
+func TestNoDelayWarningForBounce(t *testing.T) {
+	q := createTestQueue(t)
+	require.NoError(t, q.Enqueue("", []string{"later@example.net"}, []byte("Subject: bounce\n\nbody\n")))
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	assert.True(t, env.IsBounce())
+	env.Created = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, q.Save(env))
+
+	transport := &fakeTransport{results: map[string]error{"later@example.net": errors.New("try again")}}
+	r := &Runner{Queue: q, Transport: transport, Schedule: Schedule{WarnAfter: time.Hour}}
+	require.NoError(t, r.RunOnce())
+	assert.Len(t, loadOthers(t, q, names[0]), 0, "bounces should not generate delay warnings")
+}
+
+func TestNotifyParameters(t *testing.T) {
+	q := createTestQueue(t)
+	w, err := q.NewMessage(Envelope{
+		Sender:     "sender@example.com",
+		Recipients: []string{"ok@example.net", "never@example.net", "quiet@example.net", "later@example.net", "relay@example.net", "dsn@example.net"},
+		Ret:        ReturnFull,
+		EnvID:      "QQ314159",
+		Status: []EnvelopeRecipient{
+			{Recipient: "ok@example.net", Notify: []string{NotifySuccess}, ORCPT: "rfc822;OK@example.net"},
+			{Recipient: "never@example.net", Notify: []string{NotifyFailure}},
+			{Recipient: "quiet@example.net", Notify: []string{NotifyNever}},
+			{Recipient: "later@example.net", Notify: []string{NotifyFailure}},
+			{Recipient: "relay@example.net", Notify: []string{NotifySuccess}},
+			{Recipient: "dsn@example.net", Notify: []string{NotifySuccess}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: hello\n\nsecret body\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+
+	transport := &fakeTransport{results: map[string]error{
+		"never@example.net": Permanent(errors.New("no such user")),
+		"quiet@example.net": Permanent(errors.New("no such user")),
+		"later@example.net": errors.New("try again"),
+		"relay@example.net": ErrRelayed,
+		"dsn@example.net":   ErrRelayedWithDSN,
+	}}
+	r := &Runner{Queue: q, Transport: transport, Hostname: "mail.example.com", Schedule: Schedule{WarnAfter: time.Nanosecond}}
+	require.NoError(t, r.RunOnce())
+
+	reports := loadOthers(t, q, names[0])
+	require.Len(t, reports, 3, "failure, success and relayed reports, but no delay warning")
+	var failure, success, relayed string
+	for _, rep := range reports {
+		data, err := q.ReadMessage(rep)
+		require.NoError(t, err)
+		switch {
+		case strings.Contains(string(data), "Action: failed"):
+			failure = string(data)
+		case strings.Contains(string(data), "Action: relayed"):
+			relayed = string(data)
+		default:
+			success = string(data)
+		}
+	}
+	assert.Contains(t, failure, "Original-Envelope-Id: QQ314159\n")
+	assert.Contains(t, failure, "Final-Recipient: rfc822; never@example.net\n")
+	assert.NotContains(t, failure, "quiet@example.net", "NOTIFY=NEVER should suppress the report")
+	assert.Contains(t, failure, "Content-Type: message/rfc822\n\nSubject: hello\n\nsecret body\n", "RET=FULL should return the message")
+	assert.Contains(t, success, "Subject: Successful Mail Delivery Report\n")
+	assert.Contains(t, success, "Original-Recipient: rfc822;OK@example.net\nFinal-Recipient: rfc822; ok@example.net\nAction: delivered\nStatus: 2.0.0\n")
+	assert.NotContains(t, success, "secret body", "successful delivery reports only include the headers")
+	assert.NotContains(t, success, "relay@example.net")
+	assert.Contains(t, relayed, "Final-Recipient: rfc822; relay@example.net\nAction: relayed\nStatus: 2.0.0\n")
+	assert.NotContains(t, relayed, "dsn@example.net", "the next server reports on messages relayed with DSN")
+	assert.NotContains(t, success, "dsn@example.net")
+
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	assert.True(t, env.Status[0].Notified)
+	assert.Equal(t, DeliveryResultRelayed, env.Status[4].last().DeliveryResult)
+	assert.True(t, env.Status[5].Delivered)
+	assert.True(t, env.Status[5].Notified)
+	assert.False(t, env.DelayWarned)
+}
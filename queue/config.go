@@ -0,0 +1,109 @@
+package queue
+
+import "time"
+
+// Defaults used when the queue runner configuration leaves a setting out
+const (
+	defaultInterval     = 60 * time.Second
+	defaultRetryInitial = 5 * time.Minute
+	defaultRetryMax     = 4 * time.Hour
+	defaultMaxLifetime  = 5 * 24 * time.Hour
+	defaultWarnAfter    = 4 * time.Hour
+)
+
+// Config holds the queue runner configuration
+type Config struct {
+	// Directory is the location of the queue
+	Directory string `toml:"directory"`
+	// Interval is the number of seconds between queue runs
+	Interval int `toml:"interval"`
+	// Hostname identifies this server to remote mail exchangers; defaults to the system hostname
+	Hostname string `toml:"hostname"`
+	// RequireTLS defers remote delivery rather than sending mail without TLS when STARTTLS is unavailable or fails
+	RequireTLS bool `toml:"require_tls"`
+	// RetryInitial is the number of seconds to wait before the first retry after a temporary failure
+	RetryInitial int `toml:"retry_initial"`
+	// RetryMax is the longest wait in seconds between retries, however many attempts have failed
+	RetryMax int `toml:"retry_max"`
+	// MaxLifetime is the number of seconds a message may stay in the queue before it is bounced
+	MaxLifetime int `toml:"max_lifetime"`
+	// WarnAfter is the number of seconds a message may be delayed before the sender is warned
+	WarnAfter int `toml:"warn_after"`
+}
+
+// Schedule controls when deferred messages are retried and when they expire
+type Schedule struct {
+	// RetryInitial is the delay after the first failed attempt; each further failure doubles it
+	RetryInitial time.Duration
+	// RetryMax caps the delay between attempts
+	RetryMax time.Duration
+	// MaxLifetime is how long after entering the queue a message is given up on
+	MaxLifetime time.Duration
+	// WarnAfter is how long after entering the queue the sender is told delivery is delayed
+	WarnAfter time.Duration
+}
+
+// RunInterval returns the configured time between queue runs
+func (cfg *Config) RunInterval() time.Duration {
+	if cfg.Interval <= 0 {
+		return defaultInterval
+	}
+	return time.Duration(cfg.Interval) * time.Second
+}
+
+// Schedule returns the configured retry schedule
+func (cfg *Config) Schedule() Schedule {
+	return Schedule{
+		RetryInitial: seconds(cfg.RetryInitial, defaultRetryInitial),
+		RetryMax:     seconds(cfg.RetryMax, defaultRetryMax),
+		MaxLifetime:  seconds(cfg.MaxLifetime, defaultMaxLifetime),
+		WarnAfter:    seconds(cfg.WarnAfter, defaultWarnAfter),
+	}
+}
+
+// Delay returns how long to wait after the given number of failed attempts
+func (sch Schedule) Delay(attempts int) time.Duration {
+	initial := sch.RetryInitial
+	if initial <= 0 {
+		initial = defaultRetryInitial
+	}
+	limit := sch.RetryMax
+	if limit <= 0 {
+		limit = defaultRetryMax
+	}
+	delay := initial
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// Expired reports whether a message created at the given time has been queued too long
+func (sch Schedule) Expired(created time.Time, now time.Time) bool {
+	return now.Sub(created) > sch.maxLifetime()
+}
+
+func (sch Schedule) maxLifetime() time.Duration {
+	if sch.MaxLifetime <= 0 {
+		return defaultMaxLifetime
+	}
+	return sch.MaxLifetime
+}
+
+func (sch Schedule) warnAfter() time.Duration {
+	if sch.WarnAfter <= 0 {
+		return defaultWarnAfter
+	}
+	return sch.WarnAfter
+}
+
+// seconds converts a configured number of seconds, using the default if it isn't set
+func seconds(value int, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return time.Duration(value) * time.Second
+}
@@ -2,12 +2,12 @@ package queue
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -22,21 +22,120 @@ type Queue struct {
 type Envelope struct {
 	MessagePath  string
 	EnvelopePath string
-	Sender       string
-	From         string
-	Recipients   []string
+	// Sender is the reverse-path, empty for bounces
+	Sender     string
+	From       string
+	Recipients []string
+	// Body is the body type declared by the client, such as 8BITMIME, or empty if none was given
+	Body string `json:",omitempty"`
+	// Ret asks for the full message or only its headers in failure notifications (RFC 3461 section 4.3)
+	Ret string `json:",omitempty"`
+	// EnvID is the sender's identifier for the message, returned in notifications (RFC 3461 section 4.4)
+	EnvID string `json:",omitempty"`
+	// Status tracks delivery to each recipient; filled in by the queue runner
+	Status []EnvelopeRecipient `json:",omitempty"`
+	// Created is when the message entered the queue
+	Created time.Time
+	// Attempts counts the delivery runs that left recipients outstanding
+	Attempts int
+	// NextAttempt is the earliest time delivery will be retried
+	NextAttempt time.Time
+	// DelayWarned indicates the sender has been told delivery is delayed
+	DelayWarned bool `json:",omitempty"`
 }
 
 // EnvelopeRecipient tracks recipients and delivery status
 type EnvelopeRecipient struct {
 	Recipient string
 	Delivered bool
-	Result    []EnvelopeDelivery
+	// Failed indicates delivery failed permanently and will not be retried
+	Failed bool
+	// Notified indicates a delivery status notification has been sent for the delivery or failure
+	Notified bool `json:",omitempty"`
+	// Notify lists the events the sender wants to be notified of, or NEVER; empty means the default (RFC 3461 section 4.1)
+	Notify []string `json:",omitempty"`
+	// ORCPT is the original recipient given by the client, as an address type and address such as "rfc822;user@example.com"
+	ORCPT  string `json:",omitempty"`
+	Result []EnvelopeDelivery
 }
 
+// Values of the NOTIFY parameter (RFC 3461 section 4.1)
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// Values of the RET parameter (RFC 3461 section 4.3)
+const (
+	ReturnFull    = "FULL"
+	ReturnHeaders = "HDRS"
+)
+
+// BodyBinaryMIME is the body type of messages received with BODY=BINARYMIME (RFC 3030)
+// These are stored exactly as received, rather than with their line endings converted
+const BodyBinaryMIME = "BINARYMIME"
+
+// Delivery results recorded for each attempt
+const (
+	DeliveryResultDelivered = "delivered"
+	DeliveryResultRelayed   = "relayed"
+	DeliveryResultDeferred  = "deferred"
+	DeliveryResultFailed    = "failed"
+)
+
 // EnvelopeDelivery tracks the result of the last delivery attempt
 type EnvelopeDelivery struct {
+	Time           time.Time
 	DeliveryResult string
+	// Message describes the reason for a deferral or failure
+	Message string `json:",omitempty"`
+	// Status is the RFC 3463 enhanced status code for the attempt
+	Status string `json:",omitempty"`
+	// Diagnostic is the reply from the remote server in RFC 3464 form, such as "smtp; 550 no such user"
+	Diagnostic string `json:",omitempty"`
+}
+
+// IsBounce reports whether the message has the null reverse-path used by bounces and other
+// automatic notifications, which must never be answered with a bounce or auto-reply
+func (env *Envelope) IsBounce() bool {
+	return env.Sender == ""
+}
+
+// IsComplete reports whether every recipient has either been delivered or failed permanently
+func (env *Envelope) IsComplete() bool {
+	for _, rcpt := range env.Status {
+		if !rcpt.Delivered && !rcpt.Failed {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyOn reports whether the sender wants to be notified of the event for this recipient
+// Without a NOTIFY parameter, failures and delays are reported but successful delivery is not
+func (rcpt *EnvelopeRecipient) notifyOn(event string) bool {
+	if len(rcpt.Notify) == 0 {
+		return event != NotifySuccess
+	}
+	for _, n := range rcpt.Notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// initStatus creates the delivery status for envelopes that have not yet been attempted
+func (env *Envelope) initStatus() {
+	if len(env.Status) > 0 {
+		return
+	}
+	env.Status = make([]EnvelopeRecipient, 0, len(env.Recipients))
+	for _, rcpt := range env.Recipients {
+		env.Status = append(env.Status, EnvelopeRecipient{Recipient: rcpt})
+	}
 }
 
 func init() {
@@ -91,37 +190,80 @@ func CreateQueue(path string) (*Queue, error) {
 
 // Enqueue places a message into the queue
 func (q *Queue) Enqueue(sender string, recipients []string, msg []byte) error {
-	env := Envelope{
-		Sender:     sender,
-		Recipients: recipients,
+	w, err := q.NewMessage(Envelope{Sender: sender, Recipients: recipients})
+	if err != nil {
+		return err
 	}
-	name := createUniqueName()
-	envFile := filepath.Join(q.Directory, "env", name+".env")
-	msgFile := filepath.Join(q.Directory, "msg", name+".msg")
-	// Add the message path to the envelope
-	env.MessagePath = msgFile
-	env.EnvelopePath = envFile
+	if _, err := w.Write(msg); err != nil {
+		if err := w.Abort(); err != nil {
+			logger.Printf("error discarding message: %v", err)
+		}
+		return fmt.Errorf("could not write message to queue file: %w", err)
+	}
+	return w.Commit()
+}
 
-	// Technically, to follow Maildir rules, we should write to tmp and then move
-	// However, for now, we are just writing directly
-	logger.Printf("Writing envelope to queue file: %v", envFile)
-	envMarshalled, err := json.Marshal(env)
+// List returns the names of the messages in the queue
+func (q *Queue) List() ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(q.Directory, "env"))
 	if err != nil {
-		return errors.New("could not marshall envelope to json")
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".env") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(f.Name(), ".env"))
 	}
-	logger.Printf("Writing envelope: %v", string(envMarshalled))
+	return names, nil
+}
 
-	logger.Printf("Writing message to queue file: %v", msgFile)
-	err = os.WriteFile(envFile, envMarshalled, 0644)
+// Load reads the envelope of a queued message
+func (q *Queue) Load(name string) (*Envelope, error) {
+	envFile := filepath.Join(q.Directory, "env", name+".env")
+	data, err := os.ReadFile(envFile)
 	if err != nil {
-		return errors.New("could not write envelope to file")
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("could not parse envelope %s: %w", envFile, err)
 	}
+	// The paths are relative to this queue, even if the queue directory has moved
+	env.EnvelopePath = envFile
+	env.MessagePath = filepath.Join(q.Directory, "msg", name+".msg")
+	return &env, nil
+}
+
+// ReadMessage reads the message belonging to an envelope
+func (q *Queue) ReadMessage(env *Envelope) ([]byte, error) {
+	return os.ReadFile(env.MessagePath)
+}
 
-	err = os.WriteFile(msgFile, msg, 0644)
+// Save writes an updated envelope back to the queue
+// The envelope is written to tmp and renamed, so that it is never seen half written
+func (q *Queue) Save(env *Envelope) error {
+	data, err := json.Marshal(env)
 	if err != nil {
-		return errors.New("could not write message to file")
+		return fmt.Errorf("could not marshall envelope to json: %w", err)
+	}
+	tmpFile := filepath.Join(q.Directory, "tmp", filepath.Base(env.EnvelopePath))
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
 	}
+	return os.Rename(tmpFile, env.EnvelopePath)
+}
 
+// Remove deletes a message and its envelope from the queue
+// The envelope is removed first, so a partial failure never leaves an envelope without its message
+func (q *Queue) Remove(env *Envelope) error {
+	if err := os.Remove(env.EnvelopePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(env.MessagePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Transport delivers a queued message to a single recipient
+// A nil error means the message was delivered, and ErrRelayed or ErrRelayedWithDSN that it was
+// passed to another server; other errors are retried later unless marked with Permanent
+type Transport interface {
+	Deliver(env *Envelope, recipient string, msg []byte) error
+}
+
+// TransportFunc allows an ordinary function to be used as a Transport
+type TransportFunc func(env *Envelope, recipient string, msg []byte) error
+
+// Deliver calls f(env, recipient, msg)
+func (f TransportFunc) Deliver(env *Envelope, recipient string, msg []byte) error {
+	return f(env, recipient, msg)
+}
+
+// ErrRelayed reports that the message was passed to a server that doesn't support delivery status
+// notifications, so the sender can only be told it was relayed rather than delivered (RFC 3461 section 4.1)
+var ErrRelayed = errors.New("relayed to a server without delivery status notifications")
+
+// ErrRelayedWithDSN reports that the message was passed on together with the sender's delivery status
+// notification request, leaving any further notifications to the receiving server
+var ErrRelayedWithDSN = errors.New("relayed with delivery status notification request")
+
+// PermanentError marks a delivery failure that should not be retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as a permanent delivery failure
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err is a permanent delivery failure
+func IsPermanent(err error) bool {
+	var perm *PermanentError
+	return errors.As(err, &perm)
+}
+
+// StatusError attaches an RFC 3463 enhanced status code to a delivery error
+type StatusError struct {
+	Status string
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// WithStatus attaches an enhanced status code such as "5.1.1" to err
+func WithStatus(status string, err error) error {
+	return &StatusError{Status: status, Err: err}
+}
+
+// Runner delivers the messages in a queue
+type Runner struct {
+	Queue     *Queue
+	Transport Transport
+	// Schedule controls retries and expiry; the zero value uses the defaults
+	Schedule Schedule
+	// Hostname identifies this server in delivery status notifications
+	Hostname string
+}
+
+// Run processes the queue every interval until stop is closed
+func (r *Runner) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.RunOnce(); err != nil {
+			logger.Printf("error processing queue: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce attempts delivery of every message currently in the queue
+// Problems with individual messages are logged and don't stop the run
+func (r *Runner) RunOnce() error {
+	names, err := r.Queue.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := r.process(name); err != nil {
+			logger.Printf("error processing queued message %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// process attempts delivery to each outstanding recipient of a message if it is due,
+// removing the message once nothing remains to be delivered
+func (r *Runner) process(name string) error {
+	env, err := r.Queue.Load(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(env.NextAttempt) {
+		return nil
+	}
+	// Envelopes queued before creation times were recorded expire from their first run
+	if env.Created.IsZero() {
+		env.Created = now
+	}
+	msg, err := r.Queue.ReadMessage(env)
+	if err != nil {
+		return err
+	}
+	env.initStatus()
+	for i := range env.Status {
+		rcpt := &env.Status[i]
+		if rcpt.Delivered || rcpt.Failed {
+			continue
+		}
+		err := r.Transport.Deliver(env, rcpt.Recipient, msg)
+		rcpt.record(err)
+	}
+	if !env.IsComplete() {
+		env.Attempts++
+		if r.Schedule.Expired(env.Created, now) {
+			env.expire(now)
+		} else {
+			env.NextAttempt = now.Add(r.Schedule.Delay(env.Attempts))
+		}
+	}
+	// If the sender couldn't be notified, the message is kept so that it can be tried again
+	if err := r.notify(env, msg, now); err != nil {
+		logger.Printf("error sending delivery status notification for %s: %v", name, err)
+		return r.Queue.Save(env)
+	}
+	if env.IsComplete() {
+		return r.Queue.Remove(env)
+	}
+	return r.Queue.Save(env)
+}
+
+// expire gives up on the recipients still awaiting delivery
+func (env *Envelope) expire(now time.Time) {
+	age := now.Sub(env.Created).Round(time.Minute)
+	for i := range env.Status {
+		rcpt := &env.Status[i]
+		if rcpt.Delivered || rcpt.Failed {
+			continue
+		}
+		rcpt.record(Permanent(WithStatus("5.4.7", fmt.Errorf("message expired after %v in the queue", age))))
+	}
+}
+
+// record stores the result of a delivery attempt
+func (rcpt *EnvelopeRecipient) record(err error) {
+	result := EnvelopeDelivery{Time: time.Now()}
+	result.Status, result.Diagnostic = deliveryStatus(err)
+	switch {
+	case err == nil:
+		result.DeliveryResult = DeliveryResultDelivered
+		rcpt.Delivered = true
+		logger.Printf("delivered to %s", rcpt.Recipient)
+	case errors.Is(err, ErrRelayed), errors.Is(err, ErrRelayedWithDSN):
+		result.DeliveryResult = DeliveryResultRelayed
+		rcpt.Delivered = true
+		// When the request was passed on, the receiving server sends any further reports
+		rcpt.Notified = errors.Is(err, ErrRelayedWithDSN)
+		logger.Printf("relayed to %s", rcpt.Recipient)
+	case IsPermanent(err):
+		result.DeliveryResult = DeliveryResultFailed
+		result.Message = err.Error()
+		rcpt.Failed = true
+		logger.Printf("delivery to %s failed: %v", rcpt.Recipient, err)
+	default:
+		result.DeliveryResult = DeliveryResultDeferred
+		result.Message = err.Error()
+		logger.Printf("delivery to %s deferred: %v", rcpt.Recipient, err)
+	}
+	rcpt.Result = append(rcpt.Result, result)
+}
@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTransport returns the configured error for each recipient and records the attempts
+type fakeTransport struct {
+	results  map[string]error
+	attempts []string
+}
+
+func (f *fakeTransport) Deliver(env *Envelope, recipient string, msg []byte) error {
+	f.attempts = append(f.attempts, recipient)
+	return f.results[recipient]
+}
+
+func createTestQueue(t *testing.T) *Queue {
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, os.RemoveAll(tempDir)) })
+	q, err := CreateQueue(tempDir)
+	require.NoError(t, err)
+	return q
+}
+
+func TestLoadAndSave(t *testing.T) {
+	q := createTestQueue(t)
+	require.NoError(t, q.Enqueue("sender@example.com", []string{"a@example.com"}, []byte("Subject: test\n\nbody\n")))
+
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	assert.Equal(t, "sender@example.com", env.Sender)
+	assert.Equal(t, []string{"a@example.com"}, env.Recipients)
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\n\nbody\n", string(msg))
+
+	env.initStatus()
+	env.Status[0].record(errors.New("try later"))
+	require.NoError(t, q.Save(env))
+	env, err = q.Load(names[0])
+	require.NoError(t, err)
+	require.Len(t, env.Status, 1)
+	require.Len(t, env.Status[0].Result, 1)
+	assert.Equal(t, DeliveryResultDeferred, env.Status[0].Result[0].DeliveryResult)
+	assert.Equal(t, "try later", env.Status[0].Result[0].Message)
+}
+
+func TestRunner(t *testing.T) {
+	q := createTestQueue(t)
+	recipients := []string{"ok@example.com", "later@example.com", "never@example.com"}
+	require.NoError(t, q.Enqueue("sender@example.com", recipients, []byte("test")))
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	name := names[0]
+	transport := &fakeTransport{results: map[string]error{
+		"later@example.com": errors.New("mailbox busy"),
+		"never@example.com": Permanent(errors.New("no such user")),
+	}}
+	r := &Runner{Queue: q, Transport: transport}
+
+	require.NoError(t, r.RunOnce())
+	assert.Equal(t, recipients, transport.attempts)
+	names, err = q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 2, "message with deferred recipients should stay queued, along with a bounce")
+	env, err := q.Load(name)
+	require.NoError(t, err)
+	assert.True(t, env.Status[0].Delivered)
+	assert.False(t, env.Status[1].Delivered)
+	assert.False(t, env.Status[1].Failed)
+	assert.True(t, env.Status[2].Failed)
+	assert.True(t, env.Status[2].Notified)
+	assert.False(t, env.IsComplete())
+	assert.Equal(t, 1, env.Attempts)
+	assert.WithinDuration(t, time.Now().Add(defaultRetryInitial), env.NextAttempt, time.Minute)
+
+	// Nothing is retried before the next attempt is due, but the bounce is delivered
+	transport.attempts = nil
+	require.NoError(t, r.RunOnce())
+	assert.Equal(t, []string{"sender@example.com"}, transport.attempts)
+
+	// Only the deferred recipient is retried
+	transport.attempts = nil
+	env.NextAttempt = time.Now().Add(-time.Second)
+	require.NoError(t, q.Save(env))
+	delete(transport.results, "later@example.com")
+	require.NoError(t, r.RunOnce())
+	assert.Equal(t, []string{"later@example.com"}, transport.attempts)
+	names, err = q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0, "completed message should be removed")
+	assert.False(t, fileExists(env.MessagePath), "message file should be removed")
+}
+
+func TestRunnerExpiry(t *testing.T) {
+	q := createTestQueue(t)
+	require.NoError(t, q.Enqueue("sender@example.com", []string{"later@example.com"}, []byte("test")))
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	name := names[0]
+	env, err := q.Load(name)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), env.Created, time.Minute)
+
+	transport := &fakeTransport{results: map[string]error{"later@example.com": errors.New("mailbox busy")}}
+	r := &Runner{Queue: q, Transport: transport, Schedule: Schedule{MaxLifetime: time.Hour}}
+	env.Created = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, q.Save(env))
+	require.NoError(t, r.RunOnce())
+	assert.Equal(t, []string{"later@example.com"}, transport.attempts, "expired message should get a final attempt")
+	names, err = q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1, "expired message should be replaced by its bounce")
+	assert.NotEqual(t, name, names[0])
+	bounce, err := q.Load(names[0])
+	require.NoError(t, err)
+	msg, err := q.ReadMessage(bounce)
+	require.NoError(t, err)
+	assert.Contains(t, string(msg), "Action: failed\nStatus: 5.4.7\n")
+}
+
+func TestScheduleDelay(t *testing.T) {
+	sch := Schedule{RetryInitial: time.Minute, RetryMax: 10 * time.Minute}
+	assert.Equal(t, time.Minute, sch.Delay(1))
+	assert.Equal(t, 2*time.Minute, sch.Delay(2))
+	assert.Equal(t, 8*time.Minute, sch.Delay(4))
+	assert.Equal(t, 10*time.Minute, sch.Delay(5))
+	assert.Equal(t, 10*time.Minute, sch.Delay(1000))
+
+	cfg := Config{RetryInitial: 60, MaxLifetime: 3600}
+	assert.Equal(t, Schedule{RetryInitial: time.Minute, RetryMax: defaultRetryMax, MaxLifetime: time.Hour, WarnAfter: defaultWarnAfter}, cfg.Schedule())
+	assert.True(t, cfg.Schedule().Expired(time.Now().Add(-2*time.Hour), time.Now()))
+	assert.False(t, cfg.Schedule().Expired(time.Now(), time.Now()))
+}
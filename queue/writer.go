@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MessageWriter spools a new message into the queue as it is received
+// The message is written to tmp and only moved into the queue, followed by its envelope,
+// when Commit is called, so the queue runner never sees a partial message
+type MessageWriter struct {
+	queue   *Queue
+	env     Envelope
+	name    string
+	tmpPath string
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	closed  bool
+	// headers are added to the top of the message when it is committed
+	headers []string
+}
+
+// NewMessage starts a new message for the sender and recipients in the envelope
+// The envelope is copied, and its paths and creation time are filled in by the queue
+func (q *Queue) NewMessage(env Envelope) (*MessageWriter, error) {
+	name := createUniqueName()
+	tmpPath := filepath.Join(q.Directory, "tmp", name+".msg")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create queue file: %w", err)
+	}
+	env.MessagePath = filepath.Join(q.Directory, "msg", name+".msg")
+	env.EnvelopePath = filepath.Join(q.Directory, "env", name+".env")
+	w := &MessageWriter{
+		queue:   q,
+		env:     env,
+		name:    name,
+		tmpPath: tmpPath,
+		file:    file,
+		buf:     bufio.NewWriter(file),
+	}
+	return w, nil
+}
+
+// Write appends message data
+func (w *MessageWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written so far
+func (w *MessageWriter) Size() int64 {
+	return w.size
+}
+
+// AddHeader adds a header, with its line ending, to the top of the message when it is committed
+// This is for headers that depend on the whole message, such as verification results;
+// the message has to be copied to add them
+func (w *MessageWriter) AddHeader(header string) {
+	w.headers = append(w.headers, header)
+	w.size += int64(len(header))
+}
+
+// Commit places the message into the queue for delivery
+func (w *MessageWriter) Commit() error {
+	err := w.buf.Flush()
+	if err == nil && len(w.headers) == 0 {
+		err = w.file.Sync()
+	}
+	if closeErr := w.close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && len(w.headers) > 0 {
+		err = w.prependHeaders()
+	}
+	if err != nil {
+		w.remove()
+		return fmt.Errorf("could not write message to queue file: %w", err)
+	}
+	// The message is moved first, since the queue runner picks up messages by their envelopes
+	logger.Printf("Writing message to queue file: %v", w.env.MessagePath)
+	if err := os.Rename(w.tmpPath, w.env.MessagePath); err != nil {
+		w.remove()
+		return fmt.Errorf("could not move message into the queue: %w", err)
+	}
+	w.env.Created = time.Now()
+	logger.Printf("Writing envelope to queue file: %v", w.env.EnvelopePath)
+	if err := w.queue.Save(&w.env); err != nil {
+		if err := os.Remove(w.env.MessagePath); err != nil {
+			logger.Printf("error removing message %v: %v", w.env.MessagePath, err)
+		}
+		return fmt.Errorf("could not write envelope to queue file: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the message; it is safe to call after Commit has failed
+func (w *MessageWriter) Abort() error {
+	if err := w.close(); err != nil {
+		logger.Printf("error closing queue file %v: %v", w.tmpPath, err)
+	}
+	if err := os.Remove(w.tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// prependHeaders replaces the temporary file with a copy that starts with the added headers
+func (w *MessageWriter) prependHeaders() error {
+	in, err := os.Open(w.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			logger.Printf("error closing queue file %v: %v", w.tmpPath, err)
+		}
+	}()
+	newPath := w.tmpPath + ".new"
+	out, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(out)
+	for _, header := range w.headers {
+		if _, err = buf.WriteString(header); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = io.Copy(buf, in)
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(newPath, w.tmpPath)
+	}
+	if err != nil {
+		if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+			logger.Printf("error removing queue file %v: %v", newPath, err)
+		}
+	}
+	return err
+}
+
+func (w *MessageWriter) close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.file.Close()
+}
+
+// remove deletes the temporary file after a failure
+func (w *MessageWriter) remove() {
+	if err := os.Remove(w.tmpPath); err != nil && !os.IsNotExist(err) {
+		logger.Printf("error removing queue file %v: %v", w.tmpPath, err)
+	}
+}
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageWriter(t *testing.T) {
+	q := createTestQueue(t)
+	w, err := q.NewMessage(Envelope{Sender: "sender@example.com", Recipients: []string{"a@example.com"}})
+	require.NoError(t, err)
+	for _, line := range []string{"Subject: test\n", "\n", "body\n"} {
+		_, err := w.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(20), w.Size())
+	names, err := q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0, "message should not be queued before it is committed")
+
+	require.NoError(t, w.Commit())
+	names, err = q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	assert.Equal(t, "sender@example.com", env.Sender)
+	assert.False(t, env.Created.IsZero())
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\n\nbody\n", string(msg))
+	tmp, err := os.ReadDir(filepath.Join(q.Directory, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0, "nothing should be left in tmp")
+}
+
+func TestMessageWriterAbort(t *testing.T) {
+	q := createTestQueue(t)
+	w, err := q.NewMessage(Envelope{Sender: "sender@example.com", Recipients: []string{"a@example.com"}})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: test\n\nbody\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+
+	names, err := q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0)
+	tmp, err := os.ReadDir(filepath.Join(q.Directory, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0, "aborted message should be removed")
+}
+
+func TestMessageWriterAddHeader(t *testing.T) {
+	q := createTestQueue(t)
+	w, err := q.NewMessage(Envelope{Sender: "sender@example.com", Recipients: []string{"a@example.com"}})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: test\n\nbody\n"))
+	require.NoError(t, err)
+	w.AddHeader("X-First: 1\n")
+	w.AddHeader("X-Second: 2\n")
+	assert.Equal(t, int64(43), w.Size())
+	require.NoError(t, w.Commit())
+
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	assert.Equal(t, "X-First: 1\nX-Second: 2\nSubject: test\n\nbody\n", string(msg))
+	tmp, err := os.ReadDir(filepath.Join(q.Directory, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0, "nothing should be left in tmp")
+}
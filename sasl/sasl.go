@@ -0,0 +1,97 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported SASL mechanism names
+const (
+	Plain   = "PLAIN"
+	Login   = "LOGIN"
+	CramMD5 = "CRAM-MD5"
+)
+
+// Base64 encoded prompts conventionally sent by servers for the LOGIN mechanism
+const (
+	LoginUsernameChallenge = "VXNlcm5hbWU6" // "Username:"
+	LoginPasswordChallenge = "UGFzc3dvcmQ6" // "Password:"
+)
+
+// ErrCancelled indicates the client cancelled the exchange with "*"
+var ErrCancelled = errors.New("authentication cancelled by client")
+
+// ErrMalformed indicates a response that could not be decoded
+var ErrMalformed = errors.New("malformed authentication response")
+
+// Decode decodes a base64 client response, recognizing "*" as a cancellation
+// and "=" as an empty initial response (RFC 4954 section 4)
+func Decode(resp string) ([]byte, error) {
+	resp = strings.TrimSpace(resp)
+	if resp == "*" {
+		return nil, ErrCancelled
+	}
+	if resp == "=" {
+		return []byte{}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return decoded, nil
+}
+
+// Encode base64 encodes a server challenge
+func Encode(challenge string) string {
+	return base64.StdEncoding.EncodeToString([]byte(challenge))
+}
+
+// DecodePlain extracts the authorization identity, username and password from a PLAIN response (RFC 4616)
+func DecodePlain(resp string) (identity string, username string, password string, err error) {
+	decoded, err := Decode(resp)
+	if err != nil {
+		return "", "", "", err
+	}
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return "", "", "", ErrMalformed
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// NewCramMD5Challenge creates a unique challenge in the form suggested by RFC 2195
+// The result is not yet base64 encoded
+func NewCramMD5Challenge(hostname string) string {
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), hostname)
+}
+
+// DecodeCramMD5 extracts the username and hex digest from a CRAM-MD5 response
+func DecodeCramMD5(resp string) (username string, digest string, err error) {
+	decoded, err := Decode(resp)
+	if err != nil {
+		return "", "", err
+	}
+	i := strings.LastIndex(string(decoded), " ")
+	if i <= 0 || i == len(decoded)-1 {
+		return "", "", ErrMalformed
+	}
+	return string(decoded[:i]), strings.ToLower(string(decoded[i+1:])), nil
+}
+
+// VerifyCramMD5 checks a hex digest against the HMAC-MD5 of the challenge keyed by the shared secret
+func VerifyCramMD5(challenge string, digest string, secret string) bool {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(digest))
+}
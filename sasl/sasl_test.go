@@ -0,0 +1,42 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePlain(t *testing.T) {
+	resp := base64.StdEncoding.EncodeToString([]byte("\x00test@example.com\x00secret"))
+	identity, username, password, err := DecodePlain(resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "", identity)
+	assert.Equal(t, "test@example.com", username)
+	assert.Equal(t, "secret", password)
+
+	_, _, _, err = DecodePlain("*")
+	assert.ErrorIs(t, err, ErrCancelled)
+	_, _, _, err = DecodePlain("not base64!")
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, _, _, err = DecodePlain(base64.StdEncoding.EncodeToString([]byte("test@example.com")))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+// TestCramMD5 uses the example exchange from RFC 2195
+func TestCramMD5(t *testing.T) {
+	challenge := "<1896.697170952@postoffice.reston.mci.net>"
+	resp := "dGltIGI5MTNhNjAyYzdlZGE3YTQ5NWI0ZTZlNzMzNGQzODkw"
+	username, digest, err := DecodeCramMD5(resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "tim", username)
+	assert.True(t, VerifyCramMD5(challenge, digest, "tanstaaftanstaaf"))
+	assert.False(t, VerifyCramMD5(challenge, digest, "wrong"))
+}
+
+func TestNewCramMD5Challenge(t *testing.T) {
+	first := NewCramMD5Challenge("mail.example.com")
+	second := NewCramMD5Challenge("mail.example.com")
+	assert.NotEqual(t, first, second, "challenges should be unique")
+	assert.Contains(t, first, "@mail.example.com>")
+}
@@ -0,0 +1,137 @@
+package sasl
+
+import (
+	"errors"
+
+	"github.com/infodancer/gomail/domain"
+)
+
+// ErrUnsupportedMechanism indicates the client requested a mechanism that isn't available
+var ErrUnsupportedMechanism = errors.New("unsupported authentication mechanism")
+
+// Challenge sends a base64 encoded challenge to the client and returns its response
+// The protocol decides how the challenge is framed (334 for SMTP, + for POP3)
+type Challenge func(encoded string) (string, error)
+
+// Server runs the server side of SASL exchanges against a domain authenticator
+type Server struct {
+	// Auth verifies the credentials presented by the client
+	Auth domain.Authenticator
+	// Hostname is used to create CRAM-MD5 challenges
+	Hostname string
+}
+
+// Mechanisms lists the mechanisms that may be offered to the client
+// PLAIN and LOGIN send the password in the clear, so they are only offered over encrypted connections,
+// and CRAM-MD5 is only possible if the backend can supply plaintext secrets
+func (srv *Server) Mechanisms(encrypted bool) []string {
+	if srv.Auth == nil {
+		return nil
+	}
+	mechanisms := make([]string, 0, 3)
+	if encrypted {
+		mechanisms = append(mechanisms, Plain, Login)
+	}
+	if _, ok := srv.Auth.(domain.SecretProvider); ok {
+		mechanisms = append(mechanisms, CramMD5)
+	}
+	return mechanisms
+}
+
+// IsAvailable checks whether a mechanism may be used
+func (srv *Server) IsAvailable(mechanism string, encrypted bool) bool {
+	for _, m := range srv.Mechanisms(encrypted) {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate runs a complete exchange for the given mechanism and optional initial response
+// It returns the username the client attempted to use, which is only authenticated if the error is nil
+func (srv *Server) Authenticate(mechanism string, initial string, challenge Challenge) (string, error) {
+	switch mechanism {
+	case Plain:
+		return srv.authPlain(initial, challenge)
+	case Login:
+		return srv.authLogin(initial, challenge)
+	case CramMD5:
+		if len(initial) > 0 {
+			return "", ErrMalformed
+		}
+		return srv.authCramMD5(challenge)
+	}
+	return "", ErrUnsupportedMechanism
+}
+
+// authPlain handles the PLAIN mechanism, with or without an initial response
+func (srv *Server) authPlain(initial string, challenge Challenge) (string, error) {
+	resp := initial
+	if len(resp) == 0 {
+		var err error
+		resp, err = challenge("")
+		if err != nil {
+			return "", err
+		}
+	}
+	identity, username, password, err := DecodePlain(resp)
+	if err != nil {
+		return "", err
+	}
+	// We don't support acting on behalf of another user
+	if len(identity) > 0 && identity != username {
+		return username, domain.ErrAuthFailed
+	}
+	return username, srv.Auth.Authenticate(username, password)
+}
+
+// authLogin handles the LOGIN mechanism, which prompts separately for username and password
+func (srv *Server) authLogin(initial string, challenge Challenge) (string, error) {
+	resp := initial
+	if len(resp) == 0 {
+		var err error
+		resp, err = challenge(LoginUsernameChallenge)
+		if err != nil {
+			return "", err
+		}
+	}
+	username, err := Decode(resp)
+	if err != nil {
+		return "", err
+	}
+	resp, err = challenge(LoginPasswordChallenge)
+	if err != nil {
+		return "", err
+	}
+	password, err := Decode(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(username), srv.Auth.Authenticate(string(username), string(password))
+}
+
+// authCramMD5 handles the CRAM-MD5 challenge and response (RFC 2195)
+func (srv *Server) authCramMD5(challenge Challenge) (string, error) {
+	secrets, ok := srv.Auth.(domain.SecretProvider)
+	if !ok {
+		return "", ErrUnsupportedMechanism
+	}
+	nonce := NewCramMD5Challenge(srv.Hostname)
+	resp, err := challenge(Encode(nonce))
+	if err != nil {
+		return "", err
+	}
+	username, digest, err := DecodeCramMD5(resp)
+	if err != nil {
+		return "", err
+	}
+	secret, err := secrets.Secret(username)
+	if err != nil {
+		return username, err
+	}
+	if !VerifyCramMD5(nonce, digest, secret) {
+		return username, domain.ErrAuthFailed
+	}
+	return username, nil
+}
@@ -0,0 +1,91 @@
+package smtpd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/sasl"
+)
+
+func init() {
+	RegisterExtension(Extension{
+		Keyword: "AUTH",
+		Params:  func(s *Session) []string { return s.authMechanisms() },
+		Enabled: func(s *Session) bool { return len(s.authMechanisms()) > 0 },
+	})
+}
+
+// saslServer creates the SASL server for this session's authenticator
+func (s *Session) saslServer() *sasl.Server {
+	return &sasl.Server{Auth: s.Config.Auth, Hostname: s.Config.ServerName}
+}
+
+// authMechanisms lists the SASL mechanisms that may be offered on this connection
+// If TLS is available, authentication waits until the client has started it
+func (s *Session) authMechanisms() []string {
+	if s.Config.Auth == nil || s.isStartTLSAvailable() {
+		return nil
+	}
+	return s.saslServer().Mechanisms(s.Conn.IsEncrypted())
+}
+
+// processAUTH handles the AUTH command as described in RFC 4954
+func (s *Session) processAUTH(line string) (Reply, bool) {
+	if s.Config.Auth == nil {
+		return Reply{502, "5.5.1", "AUTH not supported"}, false
+	}
+	if s.isStartTLSAvailable() {
+		return Reply{530, "5.7.0", "Must issue a STARTTLS command first"}, false
+	}
+	if len(s.Sender) > 0 {
+		return Reply{503, "5.5.1", "Already authenticated"}, false
+	}
+	if s.mailGiven {
+		return Reply{503, "5.5.1", "AUTH not permitted during a mail transaction"}, false
+	}
+	args := strings.Fields(line)
+	if len(args) < 2 || len(args) > 3 {
+		return Reply{501, "5.5.4", "Syntax error in parameters"}, false
+	}
+	mechanism := strings.ToUpper(args[1])
+	server := s.saslServer()
+	if !server.IsAvailable(mechanism, s.Conn.IsEncrypted()) {
+		return Reply{504, "5.5.4", "Unrecognized authentication type"}, false
+	}
+	initial := ""
+	if len(args) == 3 {
+		initial = args[2]
+	}
+
+	username, err := server.Authenticate(mechanism, initial, s.challenge)
+	if err != nil {
+		switch {
+		case errors.Is(err, sasl.ErrCancelled):
+			return Reply{501, "5.0.0", "Authentication cancelled"}, false
+		case errors.Is(err, sasl.ErrMalformed):
+			return Reply{501, "5.5.2", "Cannot decode response"}, false
+		case errors.Is(err, domain.ErrAuthFailed), errors.Is(err, domain.ErrSecretUnavailable):
+			if err := s.Println("Authentication failed for: " + username); err != nil {
+				s.Conn.Logger().Print(err)
+			}
+			return Reply{535, "5.7.8", "Authentication credentials invalid"}, false
+		default:
+			s.Conn.Logger().Printf("error during authentication: %s", err)
+			return Reply{454, "4.7.0", "Temporary authentication failure"}, false
+		}
+	}
+	s.Sender = username
+	if err := s.Println("Authenticated as: " + username); err != nil {
+		s.Conn.Logger().Print(err)
+	}
+	return Reply{235, "2.7.0", "Authentication successful"}, false
+}
+
+// challenge sends a 334 continuation and reads the client's response
+func (s *Session) challenge(encoded string) (string, error) {
+	if err := s.SendCodeLine(334, encoded); err != nil {
+		return "", err
+	}
+	return s.ReadLine()
+}
@@ -0,0 +1,124 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/gomail/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticAuthenticator holds plaintext passwords in memory for testing
+type staticAuthenticator map[string]string
+
+func (a staticAuthenticator) Authenticate(username string, password string) error {
+	if secret, ok := a[username]; ok && secret == password {
+		return nil
+	}
+	return domain.ErrAuthFailed
+}
+
+func (a staticAuthenticator) Secret(username string) (string, error) {
+	if secret, ok := a[username]; ok {
+		return secret, nil
+	}
+	return "", domain.ErrAuthFailed
+}
+
+func createAuthSession(encrypted bool, input ...string) (*Session, *MockConnection) {
+	conn := &MockConnection{readLines: input, encrypted: encrypted}
+	cfg := Config{Auth: staticAuthenticator{"test@example.com": "secret"}}
+	cfg.ServerName = "mail.example.com"
+	return Create(cfg, conn), conn
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	s, _ := createAuthSession(false)
+	assert.Equal(t, []string{"CRAM-MD5"}, s.authMechanisms(), "plaintext mechanisms should require TLS")
+	reply, _ := s.HandleInputLine("AUTH PLAIN " + encode("\x00test@example.com\x00secret"))
+	assert.Equal(t, 504, reply.Code)
+
+	s, _ = createAuthSession(true)
+	assert.Equal(t, []string{"PLAIN", "LOGIN", "CRAM-MD5"}, s.authMechanisms())
+
+	s.Config.Auth = nil
+	assert.Empty(t, s.authMechanisms())
+	reply, _ = s.HandleInputLine("AUTH PLAIN")
+	assert.Equal(t, 502, reply.Code)
+}
+
+func TestAuthPlain(t *testing.T) {
+	s, _ := createAuthSession(true)
+	reply, _ := s.HandleInputLine("AUTH PLAIN " + encode("\x00test@example.com\x00wrong"))
+	assert.Equal(t, 535, reply.Code)
+	assert.Empty(t, s.Sender)
+
+	reply, _ = s.HandleInputLine("AUTH PLAIN " + encode("\x00test@example.com\x00secret"))
+	assert.Equal(t, 235, reply.Code)
+	assert.Equal(t, "test@example.com", s.Sender)
+
+	reply, _ = s.HandleInputLine("AUTH PLAIN " + encode("\x00test@example.com\x00secret"))
+	assert.Equal(t, 503, reply.Code, "second AUTH should be rejected")
+
+	// Without an initial response the server sends an empty challenge
+	s, conn := createAuthSession(true, encode("\x00test@example.com\x00secret"))
+	reply, _ = s.HandleInputLine("AUTH PLAIN")
+	assert.Equal(t, 235, reply.Code)
+	assert.Equal(t, []string{"334 \r\n"}, conn.writeLines)
+}
+
+func TestAuthSurvivesRSET(t *testing.T) {
+	s, _ := createAuthSession(true)
+	reply, _ := s.HandleInputLine("AUTH PLAIN " + encode("\x00test@example.com\x00secret"))
+	require.Equal(t, 235, reply.Code)
+	reply, _ = s.HandleInputLine("RSET")
+	assert.Equal(t, 250, reply.Code)
+	assert.Equal(t, "test@example.com", s.Sender, "RSET must not undo authentication")
+
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com>")
+	assert.Equal(t, 250, reply.Code)
+	reply, _ = s.HandleInputLine("RCPT TO:<friend@remote.example.net>")
+	assert.Equal(t, 250, reply.Code)
+}
+
+func TestAuthLogin(t *testing.T) {
+	s, conn := createAuthSession(true, encode("test@example.com"), encode("secret"))
+	reply, _ := s.HandleInputLine("AUTH LOGIN")
+	assert.Equal(t, 235, reply.Code)
+	assert.Equal(t, "test@example.com", s.Sender)
+	assert.Equal(t, []string{"334 VXNlcm5hbWU6\r\n", "334 UGFzc3dvcmQ6\r\n"}, conn.writeLines)
+
+	s, _ = createAuthSession(true, "*")
+	reply, _ = s.HandleInputLine("AUTH LOGIN " + encode("test@example.com"))
+	assert.Equal(t, 501, reply.Code, "client cancellation should be reported")
+	assert.Empty(t, s.Sender)
+}
+
+func TestAuthCramMD5(t *testing.T) {
+	s, conn := createAuthSession(false)
+	// Answer the challenge as soon as it is written
+	respond := func(secret string) {
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(conn.writeLines[len(conn.writeLines)-1], "334 ")))
+		assert.NoError(t, err)
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(challenge)
+		conn.readLines = append(conn.readLines, encode("test@example.com "+hex.EncodeToString(mac.Sum(nil))))
+	}
+	conn.onWrite = func() { respond("wrong") }
+	reply, _ := s.HandleInputLine("AUTH CRAM-MD5")
+	assert.Equal(t, 535, reply.Code)
+
+	conn.onWrite = func() { respond("secret") }
+	reply, _ = s.HandleInputLine("AUTH CRAM-MD5")
+	assert.Equal(t, 235, reply.Code)
+	assert.Equal(t, "test@example.com", s.Sender)
+}
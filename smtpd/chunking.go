@@ -0,0 +1,143 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterExtension(Extension{Keyword: "CHUNKING"})
+	RegisterExtension(Extension{Keyword: "BINARYMIME"})
+}
+
+// chunkedMessage collects a message sent in BDAT chunks (RFC 3030)
+// Chunks are raw data with CRLF line endings, which are converted to the LF used in the
+// queue unless the message is binary
+type chunkedMessage struct {
+	spool  *spool
+	binary bool
+	// size is the total declared size of the chunks so far
+	size int64
+	// cr is set when a chunk ended with a CR that may start a line ending
+	cr bool
+	// err is the first error writing to the spool; the rest of the message is discarded
+	err error
+}
+
+// Write passes chunk data to the spool, never failing so that the whole chunk is always read
+func (c *chunkedMessage) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return len(p), nil
+	}
+	if !c.binary {
+		p = c.convert(p)
+	}
+	if _, err := c.spool.Write(p); err != nil {
+		c.err = err
+	}
+	return len(p), nil
+}
+
+// convert replaces CRLF line endings with LF, holding back a CR at the end of the data
+// in case the LF arrives in the next chunk
+func (c *chunkedMessage) convert(p []byte) []byte {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b != '\n' {
+				out = append(out, '\r')
+			}
+		}
+		if b == '\r' {
+			c.cr = true
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// finish writes any data held back and places the message in the queue
+func (c *chunkedMessage) finish() error {
+	if c.cr && c.err == nil {
+		_, c.err = c.spool.Write([]byte{'\r'})
+	}
+	if c.err != nil {
+		c.spool.abort()
+		return c.err
+	}
+	return c.spool.commit()
+}
+
+// processBDAT receives a chunk of message data of the declared size (RFC 3030)
+// The chunk is always read, even when it is refused, so the session stays in step with the client
+func (s *Session) processBDAT(line string) (Reply, bool) {
+	args := strings.Fields(line)[1:]
+	if len(args) == 0 || len(args) > 2 {
+		return Reply{501, "5.5.4", "Syntax: BDAT size [LAST]"}, false
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return Reply{501, "5.5.4", "Syntax: BDAT size [LAST]"}, false
+	}
+	last := len(args) == 2
+	if last && !strings.EqualFold(args[1], "LAST") {
+		return s.discardChunk(size, Reply{501, "5.5.4", "Syntax: BDAT size [LAST]"})
+	}
+	if !s.mailGiven {
+		return s.discardChunk(size, Reply{503, "5.5.1", "need MAIL before BDAT"})
+	}
+	if len(s.Recipients) == 0 {
+		return s.discardChunk(size, Reply{503, "5.5.1", "need RCPT before BDAT"})
+	}
+	if s.chunks == nil {
+		sp, err := s.createSpool()
+		if err != nil {
+			s.Conn.Logger().Printf("unable to create queue file: %s", err)
+			s.resetTransaction()
+			return s.discardChunk(size, Reply{451, "4.3.0", "message could not be accepted at this time, try again later"})
+		}
+		s.chunks = &chunkedMessage{spool: sp, binary: s.Body == BodyBinaryMIME}
+	}
+	c := s.chunks
+	c.size += size
+	if s.maxsize > 0 && c.size > s.maxsize {
+		s.resetTransaction()
+		return s.discardChunk(size, Reply{552, "5.3.4", "Message size exceeds fixed maximum message size"})
+	}
+	if _, err := s.Conn.ReadChunk(c, size); err != nil {
+		// We can no longer tell where the chunk ends, so the session can't continue
+		s.Conn.Logger().Printf("error reading chunk: %s", err)
+		s.resetTransaction()
+		return Reply{451, "4.4.2", "error reading message data"}, true
+	}
+	if c.err != nil {
+		s.Conn.Logger().Printf("unable to write message: %s", c.err)
+		s.resetTransaction()
+		return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
+	}
+	if !last {
+		return Reply{250, "2.0.0", fmt.Sprintf("%d octets received", size)}, false
+	}
+
+	// The message is finished either way, so it must not be aborted when the transaction is reset
+	s.chunks = nil
+	s.resetTransaction()
+	if err := c.finish(); err != nil {
+		s.Conn.Logger().Printf("unable to enqueue message: %s", err)
+		return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
+	}
+	return Reply{250, "2.0.0", "message accepted for delivery"}, false
+}
+
+// discardChunk reads and discards a refused chunk before replying
+func (s *Session) discardChunk(size int64, reply Reply) (Reply, bool) {
+	if _, err := s.Conn.ReadChunk(io.Discard, size); err != nil {
+		s.Conn.Logger().Printf("error reading chunk: %s", err)
+		return reply, true
+	}
+	return reply, false
+}
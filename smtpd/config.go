@@ -3,9 +3,35 @@ package smtpd
 import (
 	"github.com/infodancer/gomail/config"
 	"github.com/infodancer/gomail/connect"
+	"github.com/infodancer/gomail/domain"
 	"github.com/infodancer/gomail/queue"
+	"github.com/infodancer/gomail/spf"
 )
 
+// DKIMConfig controls DomainKeys Identified Mail (RFC 6376)
+type DKIMConfig struct {
+	// Verify checks the signatures on mail from unauthenticated clients, adding an
+	// Authentication-Results header
+	Verify bool `toml:"verify"`
+	// Sign adds a signature to mail from authenticated users, using the key for the selector
+	// stored under their domain, such as /srv/domains/example.com/dkim/default.key
+	Sign bool `toml:"sign"`
+	// Selector names the signing key; defaults to "default"
+	Selector string `toml:"selector"`
+	// Headers lists the header fields to sign; defaults to dkim.DefaultHeaders
+	Headers []string `toml:"headers"`
+	// Canonicalization is given as for the c= tag; defaults to "relaxed/relaxed"
+	Canonicalization string `toml:"canonicalization"`
+}
+
+// SPFConfig controls checking incoming mail with the Sender Policy Framework (RFC 7208)
+type SPFConfig struct {
+	// Enabled adds a Received-SPF header to messages from unauthenticated clients
+	Enabled bool `toml:"enabled"`
+	// RejectFail refuses mail from senders whose domain does not permit the client to send for it
+	RejectFail bool `toml:"reject_fail"`
+}
+
 type Config struct {
 	// Embed the common server configuration
 	config.ServerConfig `toml:"server"`
@@ -15,6 +41,14 @@ type Config struct {
 	Maxsize       int64  `toml:"maxsize"`
 	MaxRecipients int    `toml:"max_recipients"`
 	MQueue        *queue.Queue
+	// Auth verifies credentials for SMTP AUTH; AUTH is not offered if nil
+	Auth domain.Authenticator `toml:"-"`
+	// SPF controls checking whether clients may send mail for the sender's domain
+	SPF SPFConfig `toml:"spf"`
+	// DKIM controls checking and adding DKIM signatures
+	DKIM DKIMConfig `toml:"dkim"`
+	// Resolver looks up SPF records and DKIM keys; defaults to net.DefaultResolver
+	Resolver spf.Resolver `toml:"-"`
 }
 
 // Start accepts a connection and sends the configured banner
@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/infodancer/gomail/address"
+	"github.com/infodancer/gomail/dkim"
+	"github.com/infodancer/gomail/domain"
+)
+
+// defaultSelector is used when no DKIM selector is configured
+const defaultSelector = "default"
+
+// createSigner prepares to sign a message from the authenticated user with their domain's key
+// It returns nil if the domain has no key, so the message is sent unsigned
+func (s *Session) createSigner() *dkim.Signer {
+	cfg := s.Config.DKIM
+	selector := cfg.Selector
+	if selector == "" {
+		selector = defaultSelector
+	}
+	headerC, bodyC := dkim.Relaxed, dkim.Relaxed
+	if cfg.Canonicalization != "" {
+		var err error
+		if headerC, bodyC, err = dkim.ParseCanonicalization(cfg.Canonicalization); err != nil {
+			s.Conn.Logger().Printf("cannot sign message: %s", err)
+			return nil
+		}
+	}
+
+	name := strings.ToLower(address.GetHost(s.Sender))
+	dom, err := domain.GetDomain(name)
+	if err != nil {
+		s.Conn.Logger().Printf("cannot sign message for %s: %s", name, err)
+		return nil
+	}
+	path, err := dom.DKIMKeyPath(selector)
+	if err != nil {
+		s.Conn.Logger().Printf("cannot sign message for %s: %s", name, err)
+		return nil
+	}
+	key, err := dkim.LoadPrivateKey(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.Conn.Logger().Printf("no DKIM key for %s, sending unsigned", name)
+		} else {
+			s.Conn.Logger().Printf("cannot load DKIM key %s: %s", path, err)
+		}
+		return nil
+	}
+	return &dkim.Signer{
+		Domain:                 name,
+		Selector:               selector,
+		Key:                    key,
+		Headers:                cfg.Headers,
+		HeaderCanonicalization: headerC,
+		BodyCanonicalization:   bodyC,
+	}
+}
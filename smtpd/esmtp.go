@@ -0,0 +1,260 @@
+package smtpd
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/gomail/queue"
+)
+
+// Message body types declared with the BODY parameter (RFC 6152, RFC 3030)
+const (
+	Body7Bit       = "7BIT"
+	Body8BitMIME   = "8BITMIME"
+	BodyBinaryMIME = queue.BodyBinaryMIME
+)
+
+func init() {
+	RegisterExtension(Extension{Keyword: "8BITMIME"})
+	RegisterExtension(Extension{Keyword: "SMTPUTF8"})
+	RegisterExtension(Extension{Keyword: "DSN"})
+	RegisterExtension(Extension{Keyword: "ENHANCEDSTATUSCODES"})
+	// SIZE is only advertised with a limit, so clients can refuse to send larger messages (RFC 1870)
+	RegisterExtension(Extension{
+		Keyword: "SIZE",
+		Params:  func(s *Session) []string { return []string{strconv.FormatInt(s.maxsize, 10)} },
+		Enabled: func(s *Session) bool { return s.maxsize > 0 },
+	})
+}
+
+// maxPathLength is the longest path we accept in MAIL FROM or RCPT TO (RFC 5321 section 4.5.3.1.3)
+const maxPathLength = 254
+
+// parsePath splits the argument of MAIL FROM or RCPT TO into the path and its ESMTP
+// parameters (RFC 5321 section 4.1.2); parameter names are returned in upper case,
+// and parameters without a value map to an empty string
+func parsePath(line string) (string, map[string]string, error) {
+	begin := strings.Index(line, "<")
+	if begin == -1 {
+		return "", nil, errors.New("address not found in command")
+	}
+	length := strings.Index(line[begin:], ">")
+	if length == -1 {
+		return "", nil, errors.New("address not found in command")
+	}
+	path := line[begin+1 : begin+length]
+	if len(path) > maxPathLength {
+		return "", nil, errors.New("address exceeds maximum length of email address")
+	}
+	// Source routes must be accepted but ignored (RFC 5321 section 4.1.1.3)
+	if strings.HasPrefix(path, "@") {
+		if i := strings.Index(path, ":"); i != -1 {
+			path = path[i+1:]
+		}
+	}
+
+	rest := line[begin+length+1:]
+	params := make(map[string]string)
+	if len(rest) > 0 && rest[0] != ' ' {
+		return "", nil, errors.New("parameters must be separated from the address by a space")
+	}
+	for _, param := range strings.Fields(rest) {
+		keyword, value, hasValue := strings.Cut(param, "=")
+		if !isESMTPKeyword(keyword) || (hasValue && !isESMTPValue(value)) {
+			return "", nil, errors.New("invalid parameter: " + param)
+		}
+		keyword = strings.ToUpper(keyword)
+		if _, ok := params[keyword]; ok {
+			return "", nil, errors.New("duplicate parameter: " + keyword)
+		}
+		params[keyword] = value
+	}
+	return path, params, nil
+}
+
+// isESMTPKeyword checks the syntax of a parameter name: a letter or digit followed by letters, digits or dashes
+func isESMTPKeyword(keyword string) bool {
+	if len(keyword) == 0 || keyword[0] == '-' {
+		return false
+	}
+	for _, c := range keyword {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isESMTPValue checks the syntax of a parameter value: printable characters other than '='
+func isESMTPValue(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, c := range value {
+		if c < 33 || c == '=' || c == 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// maxEnvIDLength is the longest ENVID we accept (RFC 3461 section 4.4)
+const maxEnvIDLength = 100
+
+// processMailParameters checks the parameters given to MAIL FROM and records them in the session
+// It returns the reply if the parameters are refused, or a zero Reply if they are accepted
+func (s *Session) processMailParameters(params map[string]string) Reply {
+	var size int64
+	body := ""
+	smtputf8 := false
+	ret := ""
+	envid := ""
+	// Check in a fixed order, so the reply doesn't depend on map ordering
+	for _, keyword := range sortedKeys(params) {
+		value := params[keyword]
+		switch keyword {
+		case "SIZE":
+			// The declared size lets us refuse a large message before it is sent (RFC 1870)
+			var err error
+			size, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return Reply{501, "5.5.4", "Syntax error in SIZE parameter"}
+			}
+			if s.maxsize > 0 && size > s.maxsize {
+				return Reply{552, "5.3.4", "Message size exceeds fixed maximum message size"}
+			}
+		case "BODY":
+			body = strings.ToUpper(value)
+			if body != Body7Bit && body != Body8BitMIME && body != BodyBinaryMIME {
+				return Reply{501, "5.5.4", "Syntax error in BODY parameter"}
+			}
+		case "SMTPUTF8":
+			if value != "" {
+				return Reply{501, "5.5.4", "SMTPUTF8 does not take a value"}
+			}
+			smtputf8 = true
+		case "AUTH":
+			// We don't relay on behalf of other servers, so the submitter identity is not used (RFC 4954 section 5)
+			if s.Config.Auth == nil {
+				return Reply{555, "5.5.4", "MAIL FROM parameters not recognized or not implemented"}
+			}
+		case "RET":
+			ret = strings.ToUpper(value)
+			if ret != queue.ReturnFull && ret != queue.ReturnHeaders {
+				return Reply{501, "5.5.4", "Syntax error in RET parameter"}
+			}
+		case "ENVID":
+			var err error
+			envid, err = decodeXtext(value)
+			if err != nil || len(value) > maxEnvIDLength {
+				return Reply{501, "5.5.4", "Syntax error in ENVID parameter"}
+			}
+		default:
+			return Reply{555, "5.5.4", "MAIL FROM parameters not recognized or not implemented"}
+		}
+	}
+	s.Size = size
+	s.Body = body
+	s.SMTPUTF8 = smtputf8
+	s.Ret = ret
+	s.EnvID = envid
+	return Reply{}
+}
+
+// processRcptParameters checks the parameters given to RCPT TO, returning the delivery
+// status notification settings for the recipient (RFC 3461)
+// It returns the reply if the parameters are refused, or a zero Reply if they are accepted
+func (s *Session) processRcptParameters(params map[string]string) (queue.EnvelopeRecipient, Reply) {
+	var rcpt queue.EnvelopeRecipient
+	for _, keyword := range sortedKeys(params) {
+		value := params[keyword]
+		switch keyword {
+		case "NOTIFY":
+			notify, err := parseNotify(value)
+			if err != nil {
+				return rcpt, Reply{501, "5.5.4", "Syntax error in NOTIFY parameter"}
+			}
+			rcpt.Notify = notify
+		case "ORCPT":
+			addrType, addr, found := strings.Cut(value, ";")
+			if !found || !isESMTPKeyword(addrType) {
+				return rcpt, Reply{501, "5.5.4", "Syntax error in ORCPT parameter"}
+			}
+			decoded, err := decodeXtext(addr)
+			if err != nil || decoded == "" {
+				return rcpt, Reply{501, "5.5.4", "Syntax error in ORCPT parameter"}
+			}
+			rcpt.ORCPT = addrType + ";" + decoded
+		default:
+			return rcpt, Reply{555, "5.5.4", "RCPT TO parameters not recognized or not implemented"}
+		}
+	}
+	return rcpt, Reply{}
+}
+
+// sortedKeys returns the parameter names in order
+func sortedKeys(params map[string]string) []string {
+	keywords := make([]string, 0, len(params))
+	for keyword := range params {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// parseNotify parses the NOTIFY parameter: NEVER, or a list of SUCCESS, FAILURE and DELAY
+func parseNotify(value string) ([]string, error) {
+	notify := make([]string, 0)
+	for _, n := range strings.Split(strings.ToUpper(value), ",") {
+		switch n {
+		case queue.NotifyNever, queue.NotifySuccess, queue.NotifyFailure, queue.NotifyDelay:
+		default:
+			return nil, errors.New("invalid NOTIFY value: " + n)
+		}
+		for _, existing := range notify {
+			if existing == n {
+				return nil, errors.New("duplicate NOTIFY value: " + n)
+			}
+		}
+		notify = append(notify, n)
+	}
+	// NEVER can't be combined with anything else
+	if len(notify) > 1 {
+		for _, n := range notify {
+			if n == queue.NotifyNever {
+				return nil, errors.New("NOTIFY=NEVER cannot be combined with other values")
+			}
+		}
+	}
+	return notify, nil
+}
+
+// decodeXtext decodes the xtext encoding used by ENVID and ORCPT, where "+" introduces
+// two hexadecimal digits (RFC 3461 section 4)
+// Control characters are refused, since the values are copied into notification headers
+func decodeXtext(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '+' {
+			if i+2 >= len(value) {
+				return "", errors.New("truncated xtext escape")
+			}
+			decoded, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.New("invalid xtext escape")
+			}
+			c = byte(decoded)
+			i += 2
+			if c < 32 || c == 127 {
+				return "", errors.New("control character in xtext")
+			}
+		} else if c < 33 || c > 126 || c == '=' {
+			return "", errors.New("invalid character in xtext")
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
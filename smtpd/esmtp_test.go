@@ -0,0 +1,135 @@
+package smtpd
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/gomail/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePath(t *testing.T) {
+	path, params, err := parsePath("MAIL FROM:<test@example.com> SIZE=123456 body=8BITMIME SMTPUTF8")
+	require.NoError(t, err)
+	assert.Equal(t, "test@example.com", path)
+	assert.Equal(t, map[string]string{"SIZE": "123456", "BODY": "8BITMIME", "SMTPUTF8": ""}, params)
+
+	path, params, err = parsePath("MAIL FROM:<>")
+	require.NoError(t, err)
+	assert.Equal(t, "", path)
+	assert.Empty(t, params)
+
+	path, _, err = parsePath("RCPT TO:<@relay.example.org:test@example.com>")
+	require.NoError(t, err)
+	assert.Equal(t, "test@example.com", path, "source routes should be ignored")
+
+	for _, line := range []string{
+		"MAIL FROM:test@example.com",
+		"MAIL FROM:<test@example.com",
+		"MAIL FROM:<test@example.com>SIZE=1",
+		"MAIL FROM:<test@example.com> SIZE=",
+		"MAIL FROM:<test@example.com> SIZE=1=2",
+		"MAIL FROM:<test@example.com> -X=1",
+		"MAIL FROM:<test@example.com> SIZE=1 size=2",
+	} {
+		_, _, err := parsePath(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestMailParameters(t *testing.T) {
+	s := Create(Config{Maxsize: 1000}, &MockConnection{})
+	reply, _ := s.HandleInputLine("MAIL FROM:<test@example.com> SIZE=1001")
+	assert.Equal(t, 552, reply.Code, "oversize messages should be refused up front")
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> SIZE=big")
+	assert.Equal(t, 501, reply.Code)
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> BODY=8BIT")
+	assert.Equal(t, 501, reply.Code)
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> BODY=8BITMIME XYZZY=1")
+	assert.Equal(t, 555, reply.Code, "unknown parameters should be refused")
+	assert.Equal(t, "", s.Body, "parameters of a refused MAIL should not be recorded")
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> AUTH=<>")
+	assert.Equal(t, 555, reply.Code, "AUTH is only recognized when authentication is offered")
+
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> SIZE=1000 BODY=8bitmime SMTPUTF8")
+	assert.Equal(t, 250, reply.Code)
+	assert.Equal(t, int64(1000), s.Size)
+	assert.Equal(t, Body8BitMIME, s.Body)
+	assert.True(t, s.SMTPUTF8)
+
+	reply, _ = s.HandleInputLine("RCPT TO:<test@example.com> XYZZY")
+	assert.Equal(t, 555, reply.Code, "unknown RCPT parameters should be refused")
+
+	s.HandleInputLine("RSET")
+	assert.Equal(t, int64(0), s.Size)
+	assert.Equal(t, "", s.Body)
+	assert.False(t, s.SMTPUTF8)
+
+	s.Config.Auth = staticAuthenticator{}
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> AUTH=<>")
+	assert.Equal(t, 250, reply.Code)
+}
+
+func TestDecodeXtext(t *testing.T) {
+	decoded, err := decodeXtext("user+2Bfolder@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "user+folder@example.com", decoded)
+	for _, value := range []string{"a+2", "a+ZZ", "a=b", "a+0Ab"} {
+		_, err := decodeXtext(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestDSNParameters(t *testing.T) {
+	createLocalDomain(t, "a", "b")
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+
+	conn := &MockConnection{readLines: []string{"Subject: dsn", "", "body", "."}}
+	s := Create(Config{MQueue: q}, conn)
+	reply, _ := s.HandleInputLine("EHLO client.example.com")
+	assert.Contains(t, reply.Lines(), "250-DSN")
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> RET=PARTIAL")
+	assert.Equal(t, 501, reply.Code)
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> ENVID=" + strings.Repeat("x", 101))
+	assert.Equal(t, 501, reply.Code)
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> RET=hdrs ENVID=QQ+2B314159")
+	assert.Equal(t, 250, reply.Code)
+
+	for _, line := range []string{
+		"RCPT TO:<a@example.com> NOTIFY=NEVER,SUCCESS",
+		"RCPT TO:<a@example.com> NOTIFY=SOMETIMES",
+		"RCPT TO:<a@example.com> NOTIFY=DELAY,DELAY",
+		"RCPT TO:<a@example.com> ORCPT=a@example.com",
+		"RCPT TO:<a@example.com> ORCPT=rfc822;a+0Ab@example.com",
+	} {
+		reply, _ = s.HandleInputLine(line)
+		assert.Equal(t, 501, reply.Code, line)
+	}
+	reply, _ = s.HandleInputLine("RCPT TO:<a@example.com> NOTIFY=success,failure ORCPT=rfc822;A+2Bx@example.com")
+	assert.Equal(t, 250, reply.Code)
+	reply, _ = s.HandleInputLine("RCPT TO:<b@example.com>")
+	assert.Equal(t, 250, reply.Code)
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 250, reply.Code)
+
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	assert.Equal(t, queue.ReturnHeaders, env.Ret)
+	assert.Equal(t, "QQ+314159", env.EnvID)
+	require.Len(t, env.Status, 2)
+	assert.Equal(t, "a@example.com", env.Status[0].Recipient)
+	assert.Equal(t, []string{queue.NotifySuccess, queue.NotifyFailure}, env.Status[0].Notify)
+	assert.Equal(t, "rfc822;A+x@example.com", env.Status[0].ORCPT)
+	assert.Equal(t, "b@example.com", env.Status[1].Recipient)
+	assert.Empty(t, env.Status[1].Notify)
+	assert.Equal(t, "", s.EnvID, "the settings should be cleared with the transaction")
+}
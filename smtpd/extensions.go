@@ -0,0 +1,43 @@
+package smtpd
+
+import (
+	"strings"
+)
+
+// Extension is an SMTP service extension advertised in the response to EHLO (RFC 5321 section 4.1.1.1)
+type Extension struct {
+	// Keyword is the EHLO keyword, such as "PIPELINING"
+	Keyword string
+	// Params returns the parameters advertised after the keyword; nil if there are none
+	Params func(s *Session) []string
+	// Enabled reports whether the extension is available in the session; nil if it always is
+	Enabled func(s *Session) bool
+}
+
+// extensions holds the registered extensions in the order they are advertised
+var extensions []Extension
+
+// RegisterExtension adds an extension to the EHLO response
+// Extensions register themselves from init functions, and are advertised in the order they are registered
+func RegisterExtension(ext Extension) {
+	extensions = append(extensions, ext)
+}
+
+// ehloResponse builds the lines of the EHLO response: the server's domain, followed by
+// the extensions enabled in this session
+func (s *Session) ehloResponse() []string {
+	lines := []string{s.Config.ServerName}
+	for _, ext := range extensions {
+		if ext.Enabled != nil && !ext.Enabled(s) {
+			continue
+		}
+		line := ext.Keyword
+		if ext.Params != nil {
+			if params := ext.Params(s); len(params) > 0 {
+				line += " " + strings.Join(params, " ")
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
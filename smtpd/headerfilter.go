@@ -0,0 +1,101 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// headerFilter removes header fields from a message as it is written, passing the body through unchanged
+type headerFilter struct {
+	w io.Writer
+	// drop reports whether a complete header field, including folded lines, should be removed
+	drop func(field string) bool
+	// partial holds the start of a line that hasn't been finished
+	partial []byte
+	// field holds the header field being read, which may continue on folded lines
+	field  []byte
+	inBody bool
+}
+
+// Write filters message data
+func (f *headerFilter) Write(p []byte) (int, error) {
+	data := p
+	for len(data) > 0 && !f.inBody {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			f.partial = append(f.partial, data...)
+			return len(p), nil
+		}
+		line := append(f.partial, data[:i+1]...)
+		f.partial = nil
+		data = data[i+1:]
+		if err := f.line(line); err != nil {
+			return 0, err
+		}
+	}
+	if len(data) > 0 {
+		if _, err := f.w.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// line processes a complete header line, with its line ending
+func (f *headerFilter) line(line []byte) error {
+	if (line[0] == ' ' || line[0] == '\t') && len(f.field) > 0 {
+		f.field = append(f.field, line...)
+		return nil
+	}
+	if err := f.flushField(); err != nil {
+		return err
+	}
+	if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		f.inBody = true
+		_, err := f.w.Write(line)
+		return err
+	}
+	f.field = line
+	return nil
+}
+
+// flushField writes the current header field unless it is dropped
+func (f *headerFilter) flushField() error {
+	field := f.field
+	f.field = nil
+	if len(field) == 0 || f.drop(string(field)) {
+		return nil
+	}
+	_, err := f.w.Write(field)
+	return err
+}
+
+// flush writes anything held back, for a message that ends without a body
+func (f *headerFilter) flush() error {
+	if err := f.flushField(); err != nil {
+		return err
+	}
+	if len(f.partial) > 0 {
+		partial := f.partial
+		f.partial = nil
+		if _, err := f.w.Write(partial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isAuthenticationResults checks whether a header field is an Authentication-Results field
+// claiming to come from authServID, which must be removed from incoming mail (RFC 8601 section 5)
+func isAuthenticationResults(field string, authServID string) bool {
+	name, value, found := strings.Cut(field, ":")
+	if !found || !strings.EqualFold(strings.TrimRight(name, " \t"), "Authentication-Results") {
+		return false
+	}
+	id := strings.TrimSpace(value)
+	if i := strings.IndexAny(id, "; \t\r\n("); i >= 0 {
+		id = id[:i]
+	}
+	return strings.EqualFold(id, authServID)
+}
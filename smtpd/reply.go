@@ -0,0 +1,63 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reply is the response to an SMTP command: a basic reply code (RFC 5321 section 4.2)
+// and, for replies that take one, an enhanced status code (RFC 3463)
+// A zero Code means the command has already sent its own response
+type Reply struct {
+	Code int
+	// Status is the enhanced status code, such as "5.1.1"; empty for replies without one,
+	// such as the greeting and the response to HELO or EHLO (RFC 2034 section 3)
+	Status  string
+	Message string
+}
+
+// Text returns the reply text, starting with the enhanced status code if there is one
+func (r Reply) Text() string {
+	if r.Status == "" {
+		return r.Message
+	}
+	return r.Status + " " + r.Message
+}
+
+// Lines formats the reply for sending, splitting a message with several lines into a
+// multiline reply where every line but the last has a hyphen after the code (RFC 5321 section 4.2.1)
+func (r Reply) Lines() []string {
+	messages := strings.Split(r.Message, "\n")
+	lines := make([]string, 0, len(messages))
+	for i, message := range messages {
+		separator := "-"
+		if i == len(messages)-1 {
+			separator = " "
+		}
+		text := Reply{Status: r.Status, Message: message}.Text()
+		lines = append(lines, fmt.Sprintf("%d%s%s", r.Code, separator, text))
+	}
+	return lines
+}
+
+// SendReply sends a reply to the client
+func (s *Session) SendReply(r Reply) error {
+	if err := s.writeReply(r); err != nil {
+		return err
+	}
+	return s.Conn.Flush()
+}
+
+// writeReply adds a reply to the output buffer, to be sent with the replies to any other
+// pipelined commands
+func (s *Session) writeReply(r Reply) error {
+	for _, line := range r.Lines() {
+		if err := s.Println("S:" + line); err != nil {
+			s.Conn.Logger().Printf("error: %s", err)
+		}
+		if err := s.Conn.Write(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,41 +1,57 @@
 package smtpd
 
 import (
-	"bufio"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/infodancer/gomail/address"
 	"github.com/infodancer/gomail/connect"
 	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/queue"
 )
 
+// spamcHeaderAllowance is the room allowed beyond the maximum message size for headers added by spamc
+const spamcHeaderAllowance = 64 * 1024
+
 // Session describes the current session
 type Session struct {
 	// Config holds the server configuration
 	Config Config
 	// Connection holds the client connection information
 	Conn connect.TCPConnection
+	// Helo is the name the client gave in HELO or EHLO
+	Helo string
 	// Sender is the authenticated user sending the message; nil if not authenticated
 	Sender string
-	// From is the claimed sender of the message
+	// From is the claimed sender of the message; empty for bounces
 	From string
+	// mailGiven indicates MAIL has been accepted, since From is empty for the null reverse-path
+	mailGiven bool
+	// Size is the message size declared with the SIZE parameter, or zero
+	Size int64
+	// Body is the body type declared with the BODY parameter, or empty if none was given
+	Body string
+	// SMTPUTF8 indicates the client may use UTF-8 in addresses and headers (RFC 6531)
+	SMTPUTF8 bool
+	// Ret is the RET parameter, asking for the full message or only headers in failure notifications
+	Ret string
+	// EnvID is the decoded ENVID parameter identifying the message in notifications
+	EnvID string
 	// Recipients is the array of recipients
 	Recipients     []string
 	RecipientLimit int
+	// notify holds the notification settings given with each of the Recipients (RFC 3461)
+	notify []queue.EnvelopeRecipient
 
 	// Headers are only the headers this mail system is adding
 	Headers []string
-	// Data contains all the data received from the client
-	Data string
+	// chunks receives the message sent with BDAT until the last chunk arrives
+	chunks *chunkedMessage
 
 	// maxsize is the max message size in bytes for this session
 	maxsize int64
@@ -56,7 +72,7 @@ func Create(cfg Config, conn connect.TCPConnection) *Session {
 }
 
 func (s *Session) Printf(v ...any) error {
-	_, err := fmt.Fprintf(os.Stderr, v[0].(string), v[1:])
+	_, err := fmt.Fprintf(os.Stderr, v[0].(string), v[1:]...)
 	return err
 }
 
@@ -71,6 +87,8 @@ func (s *Session) HandleConnection() error {
 			s.Conn.Logger().Printf("error closing connection: %s", err)
 		}
 	}()
+	// Discard any message left unfinished when the client goes away
+	defer s.resetTransaction()
 	for {
 		line, err := s.ReadLine()
 		if err != nil {
@@ -82,8 +100,20 @@ func (s *Session) HandleConnection() error {
 			}
 			break
 		}
-		code, message, finished := s.HandleInputLine(line)
-		err = s.SendCodeLine(code, message)
+		reply, finished := s.HandleInputLine(line)
+		// A zero code means the command has already sent its own response
+		if reply.Code == 0 {
+			if finished {
+				break
+			}
+			continue
+		}
+		// Replies to pipelined commands are sent together once the client's input is used up,
+		// or when the command ends a group (RFC 2920 section 3.1)
+		err = s.writeReply(reply)
+		if err == nil && (finished || isSynchronizing(line) || !s.Conn.InputPending()) {
+			err = s.Conn.Flush()
+		}
 		if err != nil {
 			if err := s.Println("io error sending response"); err != nil {
 				s.Conn.Logger().Printf("error: %s", err)
@@ -97,6 +127,27 @@ func (s *Session) HandleConnection() error {
 	return nil
 }
 
+// isSynchronizing returns true if the command must be the last in a pipelined group, so its
+// reply is sent straight away (RFC 2920 section 3.1, RFC 3030 section 4.2)
+func isSynchronizing(line string) bool {
+	command := strings.ToUpper(strings.TrimSpace(strings.Split(line, " ")[0]))
+	switch command {
+	case "HELO", "EHLO", "DATA", "BDAT", "VRFY", "NOOP", "QUIT":
+		return true
+	}
+	return false
+}
+
+// checkSynchronization refuses a command the client sent more input after without waiting for the reply
+// Clients that do this are usually spamware that doesn't follow the protocol, so the session is ended
+func (s *Session) checkSynchronization(command string) (Reply, bool) {
+	if !s.Conn.InputPending() {
+		return Reply{}, false
+	}
+	s.Conn.Logger().Printf("improper pipelining after %s from %s", command, s.Conn.GetTCPRemoteIP())
+	return Reply{554, "5.5.0", "SMTP protocol synchronization error"}, true
+}
+
 // SendCodeLine accepts a line without linefeeds and sends it with a CRLF and the provided response code
 func (s *Session) SendCodeLine(code int, line string) error {
 	cline := fmt.Sprintf("%d %s", code, line)
@@ -120,37 +171,16 @@ func (s *Session) ReadLine() (string, error) {
 }
 
 // HandleInputLine accepts a line and handles it
-func (s *Session) HandleInputLine(line string) (int, string, bool) {
-	var err error
+func (s *Session) HandleInputLine(line string) (Reply, bool) {
 	cmd := strings.Split(line, " ")
 	command := strings.ToUpper(strings.TrimSpace(cmd[0]))
 	switch command {
 	case "HELO":
 		return s.processHELO(line)
 	case "EHLO":
-		{
-			// This is a bit of a special case because of extensions
-			err = s.SendLine("250-8BITMIME\r\n")
-			if err != nil {
-				return 500, "i/o error", false
-			}
-			err = s.SendLine("250-PIPELINING\r\n")
-			if err != nil {
-				return 500, "i/o error", false
-			}
-			err = s.SendLine("250-AUTH CRAM-MD5\r\n")
-			if err != nil {
-				return 500, "i/o error", false
-			}
-			if s.Config.Maxsize != 0 && s.maxsize != 0 {
-				size := strconv.FormatInt(s.maxsize, 10)
-				err = s.SendLine("250-SIZE " + size + "\r\n")
-				if err != nil {
-					return 500, "Unrecognized command", false
-				}
-			}
-			return s.processEHLO(line)
-		}
+		return s.processEHLO(line)
+	case "STARTTLS":
+		return s.processSTARTTLS(line)
 	case "AUTH":
 		return s.processAUTH(line)
 	case "RCPT":
@@ -159,6 +189,8 @@ func (s *Session) HandleInputLine(line string) (int, string, bool) {
 		return s.processMAIL(line)
 	case "DATA":
 		return s.processDATA(line)
+	case "BDAT":
+		return s.processBDAT(line)
 
 	// These commands are not vital
 	case "RSET":
@@ -172,100 +204,150 @@ func (s *Session) HandleInputLine(line string) (int, string, bool) {
 	case "QUIT":
 		return s.processQUIT(line)
 	default:
-		return 500, "Unrecognized command", false
+		return Reply{500, "5.5.2", "Unrecognized command"}, false
 	}
 }
 
 // processHELO handles the standard SMTP helo
-func (s *Session) processHELO(line string) (int, string, bool) {
-	return 250, s.Config.ServerName, false
+func (s *Session) processHELO(line string) (Reply, bool) {
+	if reply, failed := s.checkSynchronization("HELO"); failed {
+		return reply, true
+	}
+	s.resetTransaction()
+	s.Helo = extractArgument(line)
+	return Reply{Code: 250, Message: s.Config.ServerName}, false
 }
 
-// processEHLO handles the extended EHLO command, but the extensions are listed elsewhere
-func (s *Session) processEHLO(line string) (int, string, bool) {
-	return 250, s.Config.ServerName, false
+// processEHLO handles the extended EHLO command, listing the registered extensions
+func (s *Session) processEHLO(line string) (Reply, bool) {
+	if reply, failed := s.checkSynchronization("EHLO"); failed {
+		return reply, true
+	}
+	// A repeated greeting starts over as if RSET had been sent (RFC 5321 section 4.1.4)
+	s.resetTransaction()
+	s.Helo = extractArgument(line)
+	return Reply{Code: 250, Message: strings.Join(s.ehloResponse(), "\n")}, false
 }
 
-// processQUIT simply terminates the session
-func (s *Session) processQUIT(line string) (int, string, bool) {
-	return 221, "goodbye", true
+func init() {
+	RegisterExtension(Extension{Keyword: "PIPELINING"})
+	RegisterExtension(Extension{
+		Keyword: "STARTTLS",
+		Enabled: func(s *Session) bool { return s.isStartTLSAvailable() },
+	})
 }
 
-// processRSET clears the session information
-func (s *Session) processRSET(line string) (int, string, bool) {
-	s.Sender = ""
-	s.From = ""
-	s.Recipients = make([]string, 0)
-	s.Data = ""
-	return 250, "OK", false
+// isStartTLSAvailable reports whether STARTTLS can be offered on this connection
+func (s *Session) isStartTLSAvailable() bool {
+	return s.Config.TLS.HasCertificate() && !s.Conn.IsEncrypted()
 }
 
-func (s *Session) processNOOP(line string) (int, string, bool) {
-	return 250, "OK", false
+// processSTARTTLS upgrades the connection to TLS as described in RFC 3207
+// The 220 response is sent here, before the handshake, so this returns a zero code
+func (s *Session) processSTARTTLS(line string) (Reply, bool) {
+	if len(extractArgument(line)) > 0 {
+		return Reply{501, "5.5.4", "Syntax error (no parameters allowed)"}, false
+	}
+	if s.Conn.IsEncrypted() {
+		return Reply{503, "5.5.1", "TLS already active"}, false
+	}
+	if !s.Config.TLS.HasCertificate() {
+		return Reply{502, "5.5.1", "STARTTLS not supported"}, false
+	}
+	tlsConfig, err := s.Config.TLS.TLSConfig()
+	if err != nil {
+		s.Conn.Logger().Printf("error loading TLS configuration: %s", err)
+		return Reply{454, "4.7.0", "TLS not available due to temporary reason"}, false
+	}
+	if err := s.SendReply(Reply{220, "2.0.0", "Ready to start TLS"}); err != nil {
+		return Reply{}, true
+	}
+	if err := s.Conn.StartTLS(tlsConfig); err != nil {
+		// The connection is in an unknown state, so the only safe option is to drop it
+		s.Conn.Logger().Printf("TLS handshake failed: %s", err)
+		return Reply{}, true
+	}
+	// The client must start over with EHLO, forgetting anything learned in plaintext
+	s.reset()
+	s.Helo = ""
+	return Reply{}, false
 }
 
-func (s *Session) processVRFY(line string) (int, string, bool) {
-	return 500, "VRFY not supported", false
+// processQUIT simply terminates the session
+func (s *Session) processQUIT(line string) (Reply, bool) {
+	return Reply{221, "2.0.0", "goodbye"}, true
 }
 
-// processAUTH handles the auth process
-func (s *Session) processAUTH(line string) (int, string, bool) {
-	// For now, we haven't implemented this
-	if strings.HasPrefix(line, "AUTH ") {
-		authType := line[5:]
-		// Reject insecure authentication methods
-		if authType != "CRAM-MD5" {
-			return 500, "Unrecognized command", false
-		}
-		challenge := createChallenge()
-		err := s.SendCodeLine(354, challenge)
-		if err != nil {
-			return 550, "i/o error", false
-		}
-		resp, err := s.ReadLine()
-		if err != nil {
-			return 550, "Authentication failed", false
-		}
-		username, err := extractUsername(resp)
-		if err != nil {
-			return 550, "Authentication failed", false
-		}
-		password := extractPassword(username)
-		if !validateCramMD5(resp, password) {
-			return 550, "Authentication failed", false
-		}
-		return 235, "Authentication successful", false
+// processRSET aborts the current mail transaction; authentication is kept (RFC 4954 section 4)
+func (s *Session) processRSET(line string) (Reply, bool) {
+	s.resetTransaction()
+	return Reply{250, "2.0.0", "OK"}, false
+}
+
+// reset clears the authentication and transaction state
+func (s *Session) reset() {
+	s.Sender = ""
+	s.resetTransaction()
+}
+
+// resetTransaction clears the state of the current mail transaction, which ends with the message data
+func (s *Session) resetTransaction() {
+	s.From = ""
+	s.mailGiven = false
+	s.Size = 0
+	s.Body = ""
+	s.SMTPUTF8 = false
+	s.Ret = ""
+	s.EnvID = ""
+	s.Recipients = make([]string, 0)
+	s.notify = nil
+	s.Headers = nil
+	if s.chunks != nil {
+		s.chunks.spool.abort()
+		s.chunks = nil
 	}
-	return 500, "Unrecognized command", false
 }
 
-// createChallenge creates a challenge for use in CRAM-MD5
-func validateCramMD5(resp string, password string) bool {
-	return false
+func (s *Session) processNOOP(line string) (Reply, bool) {
+	return Reply{250, "2.0.0", "OK"}, false
 }
 
-func (s *Session) processRCPT(line string) (int, string, bool) {
-	addr, err := extractAddressPart(line)
+// processVRFY declines to confirm addresses, as RFC 5321 section 3.5.3 suggests for servers
+// that don't verify them
+func (s *Session) processVRFY(line string) (Reply, bool) {
+	if len(extractArgument(line)) == 0 {
+		return Reply{501, "5.5.4", "Syntax error (VRFY requires an argument)"}, false
+	}
+	return Reply{252, "2.1.5", "Cannot VRFY user, but will accept message and attempt delivery"}, false
+}
+
+func (s *Session) processRCPT(line string) (Reply, bool) {
+	path, params, err := parsePath(line)
 	if err != nil {
-		return 550, "Invalid address", false
+		return Reply{501, "5.1.3", "Bad recipient address syntax"}, false
 	}
+	addr := &path
 	// Check if the sender has been set
-	if len(s.From) == 0 {
-		return 503, "need MAIL before RCPT", false
+	if !s.mailGiven {
+		return Reply{503, "5.5.1", "need MAIL before RCPT"}, false
+	}
+	rcpt, reply := s.processRcptParameters(params)
+	if reply.Code != 0 {
+		return reply, false
 	}
 	// Check for number of recipients
 	if len(s.Recipients) >= s.RecipientLimit {
 		if err := s.Printf("Rejecting RCPT TO %d recipients already", len(s.Recipients)); err != nil {
 			s.Conn.Logger().Print(err)
 		}
-		return 452, "Too many recipients", false
+		return Reply{452, "4.5.3", "Too many recipients"}, false
 	}
 	// Check if this is being sent to a bounce address
 	if len(*addr) == 0 {
 		if err := s.Println("Rejecting RCPT TO to bounce address: " + *addr); err != nil {
 			s.Conn.Logger().Print(err)
 		}
-		return 503, "We don't accept mail to that address", false
+		return Reply{501, "5.1.3", "Bad recipient address syntax"}, false
 	}
 
 	// Before we actually do filesystem operations, sanitize the input
@@ -273,7 +355,7 @@ func (s *Session) processRCPT(line string) (int, string, bool) {
 		if err := s.Println("Rejecting suspicious RCPT TO: " + *addr); err != nil {
 			s.Conn.Logger().Print(err)
 		}
-		return 550, "Invalid address", false
+		return Reply{553, "5.1.3", "Invalid address"}, false
 	}
 
 	recipient, err := address.CreateAddress(*addr)
@@ -281,27 +363,22 @@ func (s *Session) processRCPT(line string) (int, string, bool) {
 		if err := s.Println("Error creating address: " + err.Error()); err != nil {
 			s.Conn.Logger().Print(err)
 		}
-		return 550, "Invalid address", false
+		return Reply{501, "5.1.3", "Bad recipient address syntax"}, false
 	}
 
 	// Check for relay and allow only if sender has authenticated
 	dom, err := domain.GetDomain(recipient.Domain)
 	if err != nil {
-		if err := s.Println("Error getting domain: " + err.Error()); err != nil {
-			s.Conn.Logger().Print(err)
-		}
-		// For now, accept all domains to allow testing
-		if err := s.Println("Accepting recipient for testing: " + *addr); err != nil {
-			s.Conn.Logger().Print(err)
+		if !errors.Is(err, domain.ErrNoSuchDomain) {
+			if err := s.Println("Error getting domain: " + err.Error()); err != nil {
+				s.Conn.Logger().Print(err)
+			}
+			return Reply{451, "4.3.0", "Unable to check the recipient domain, try again later"}, false
 		}
-		s.Recipients = append(s.Recipients, recipient.String())
-		return 250, "OK", false
-	}
-	if len(s.Sender) == 0 {
-		// Only bother to check domain if the sender is nil
-		if dom == nil {
-			return 551, "We don't relay mail to remote addresses", false
+		if len(s.Sender) == 0 {
+			return Reply{550, "5.7.1", "We don't relay mail to remote addresses"}, false
 		}
+		dom = nil
 	}
 
 	// Check for local recipient existing if the domain is local
@@ -313,11 +390,11 @@ func (s *Session) processRCPT(line string) (int, string, bool) {
 			if err := s.Println("Error from GetUser: ", err); err != nil {
 				s.Conn.Logger().Print(err)
 			}
-			return 451, "Address does not exist or cannot receive mail at this time, try again later", false
+			return Reply{451, "4.3.0", "Address does not exist or cannot receive mail at this time, try again later"}, false
 		}
 		// If we got back nil without error, they really don't exist
 		if user == nil {
-			return 550, "User does not exist", false
+			return Reply{550, "5.1.1", "User does not exist"}, false
 		}
 		// But if they do exist, check that their mailbox also exists
 		maildir, err := dom.GetUserMaildir(recipient.User)
@@ -325,255 +402,235 @@ func (s *Session) processRCPT(line string) (int, string, bool) {
 			if err := s.Println("User exists but GetUserMaildir errors: ", err); err != nil {
 				s.Conn.Logger().Print(err)
 			}
-			return 451, "Address does not exist or cannot receive mail at this time, try again later", false
+			return Reply{451, "4.3.0", "Address does not exist or cannot receive mail at this time, try again later"}, false
 		}
 		// If we got back nil without error, the maildir doesn't exist, but this is a temporary (hopefully) setup problem
 		if maildir == nil {
 			if err := s.Println("User exists but maildir is nil: ", err); err != nil {
 				s.Conn.Logger().Print(err)
 			}
-			return 451, "Maildir does not exist; try again later", false
+			return Reply{451, "4.3.0", "Maildir does not exist; try again later"}, false
 		}
 	}
 
 	// At this point, we are willing to accept this recipient
-	s.Recipients = append(s.Recipients, recipient.String())
+	s.addRecipient(recipient.String(), rcpt)
 	if err := s.Println("Recipient accepted: ", *addr); err != nil {
 		s.Conn.Logger().Print(err)
 	}
-	return 250, "OK", false
+	return Reply{250, "2.1.5", "OK"}, false
 }
 
-func (s *Session) processMAIL(line string) (int, string, bool) {
-	if len(s.From) > 0 {
-		return 400, "MAIL FROM already sent", false
+// addRecipient adds an accepted recipient to the transaction, along with its notification settings
+func (s *Session) addRecipient(recipient string, rcpt queue.EnvelopeRecipient) {
+	rcpt.Recipient = recipient
+	s.Recipients = append(s.Recipients, recipient)
+	s.notify = append(s.notify, rcpt)
+}
+
+func (s *Session) processMAIL(line string) (Reply, bool) {
+	if s.mailGiven {
+		return Reply{503, "5.5.1", "Sender already specified"}, false
 	}
-	addr, err := extractAddressPart(line)
+	addr, params, err := parsePath(line)
 	if err != nil {
-		return 451, "Invalid address", false
+		return Reply{501, "5.1.7", "Bad sender address syntax"}, false
 	}
-	// Check if this is a bounce message
-	if len(*addr) == 0 {
-		return 551, "We don't accept mail to that address", false
+	if reply := s.processMailParameters(params); reply.Code != 0 {
+		return reply, false
 	}
-
-	s.From = *addr
-	return 250, "OK", false
+	// Authenticated users send from wherever they are, so only other clients are checked
+	if s.Config.SPF.Enabled && s.Sender == "" {
+		if reply := s.checkSPF(addr); reply.Code != 0 {
+			s.resetTransaction()
+			return reply, false
+		}
+	}
+	// The null reverse-path <> is used by bounces and must be accepted (RFC 5321 section 4.5.5)
+	s.From = addr
+	s.mailGiven = true
+	return Reply{250, "2.1.0", "OK"}, false
 }
 
-func (s *Session) processDATA(line string) (int, string, bool) {
+func (s *Session) processDATA(line string) (Reply, bool) {
 	// Did the user specify an envelope?
 	// Check if the sender has been set
-	if len(s.From) == 0 {
-		return 503, "need MAIL before DATA", false
+	if !s.mailGiven {
+		return Reply{503, "5.5.1", "need MAIL before DATA"}, false
 	}
 	// Check for number of recipients
 	if len(s.Recipients) == 0 {
-		return 503, "need RCPT before DATA", false
+		return Reply{503, "5.5.1", "need RCPT before DATA"}, false
 	}
-	// Generate a received header
-	rcv, err := s.createReceived()
-	if err != nil {
-		return 451, "message could not be accepted at this time, try again later", false
+	// Binary messages and messages already started with BDAT can't be sent with DATA (RFC 3030)
+	if s.Body == BodyBinaryMIME {
+		return Reply{503, "5.5.1", "BINARYMIME messages must be sent with BDAT"}, false
+	}
+	if s.chunks != nil {
+		return Reply{503, "5.5.1", "DATA cannot be used after BDAT"}, false
+	}
+	// The message must not be sent until the client has seen our 354
+	if reply, failed := s.checkSynchronization("DATA"); failed {
+		return reply, true
 	}
-	s.AddHeader(rcv)
-
 	// Accept the start of message data
-	err = s.SendCodeLine(354, "Send message content; end with <CRLF>.<CRLF>")
+	err := s.SendCodeLine(354, "Send message content; end with <CRLF>.<CRLF>")
+	if err != nil {
+		return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
+	}
+	// The message is written to the queue as it arrives, and counted with CRLF line endings
+	// so an oversize message is refused; the rest is read and discarded so the client sees our reply
+	sp, err := s.createSpool()
 	if err != nil {
-		return 451, "message could not be accepted at this time, try again later", false
+		s.Conn.Logger().Printf("unable to create queue file: %s", err)
 	}
-	for finished := false; !finished; {
+	var size int64
+	tooLarge := false
+	for {
 		line, err := s.ReadLine()
 		if err != nil {
 			break
 		}
-		if err := s.Printf(">%v\n", line); err != nil {
-			s.Conn.Logger().Print(err)
+		if sp != nil {
+			if err := s.Printf(">%v\n", line); err != nil {
+				s.Conn.Logger().Print(err)
+			}
+		}
+		if line == "." {
+			s.resetTransaction()
+			if tooLarge {
+				return Reply{552, "5.3.4", "Message size exceeds fixed maximum message size"}, false
+			}
+			if sp == nil {
+				return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
+			}
+			if err := sp.commit(); err != nil {
+				s.Conn.Logger().Printf("unable to enqueue message: %s", err)
+				return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
+			}
+			return Reply{250, "2.0.0", "message accepted for delivery"}, false
+		}
+		if sp == nil {
+			continue
 		}
 		if strings.HasPrefix(line, ".") {
-			if strings.HasPrefix(line, "..") {
-				// Remove escaped period character
-				line = line[1:]
-			} else {
-				// Check with spamc if needed
-				if len(s.Config.Spamc) > 0 {
-					err = s.Printf("session.Data is %d bytes", len(s.Data))
-					if err != nil {
-						return 451, "i/o error", false
-					}
-					err = s.Printf("session.Data:\n%s", s.Data)
-					if err != nil {
-						return 451, "i/o error", false
-					}
-					msg, err := s.checkSpam()
-					if err != nil {
-						return 451, "i/o error", false
-					}
-					// We don't block here; let the user use their filters
-					s.Data = msg
-				}
-				err := s.enqueue()
-				if err != nil {
-					if err := s.Println("Unable to enqueue message!"); err != nil {
-						s.Conn.Logger().Print(err)
-					}
-					return 451, "message could not be accepted at this time, try again later", false
-				}
-				return 250, "message accepted for delivery", false
+			// Remove escaped period character
+			line = line[1:]
+		}
+		size += int64(len(line)) + 2
+		if s.maxsize > 0 && size > s.maxsize {
+			if err := s.Printf("message exceeds %d bytes, discarding the rest", s.maxsize); err != nil {
+				s.Conn.Logger().Print(err)
 			}
+			tooLarge = true
+			sp.abort()
+			sp = nil
+			continue
+		}
+		if err := sp.WriteLine(line); err != nil {
+			s.Conn.Logger().Printf("unable to write message: %s", err)
+			sp.abort()
+			sp = nil
 		}
-		s.Data += line
-		s.Data += "\n"
+	}
+	if sp != nil {
+		sp.abort()
 	}
 	// If we somehow get here without the message being completed, return a temporary failure
-	return 451, "message could not be accepted at this time, try again later", false
+	return Reply{451, "4.3.0", "message could not be accepted at this time, try again later"}, false
 }
 
-func (s *Session) createReceived() (string, error) {
-	rcv := "Received: from "
-	// remote server info
-	rcv += s.Conn.GetTCPRemoteIP()
-	rcv += " by "
-	rcv += " with SMTP; "
-	rcv += time.Now().String()
-	rcv += "\n"
-	return rcv, nil
+// createReceived generates the Received header recording where the message came from (RFC 5321 section 4.4)
+func (s *Session) createReceived() string {
+	client := "[" + s.Conn.GetTCPRemoteIP() + "]"
+	if host := s.Conn.GetTCPRemoteHost(); host != "" {
+		client = host + " " + client
+	}
+	return fmt.Sprintf("Received: from %s (%s)\n\tby %s with SMTP; %s",
+		s.Helo, client, s.Config.ServerName, time.Now().Format(time.RFC1123Z))
 }
 
+// AddHeader adds a header to the top of the message, without a line ending; long headers
+// may be folded with "\n\t"
 func (s *Session) AddHeader(h string) {
 	s.Headers = append(s.Headers, h)
 }
 
-// enqueue places the current message (as contained in the session) into the disk queue; ie accepting delivery
-func (s *Session) enqueue() error {
-	err := s.Config.MQueue.Enqueue(s.From, s.Recipients, []byte(s.Data))
-	if err != nil {
-		log.Fatal(err)
-		return errors.New("queue attempt failed")
-	}
-	return nil
-}
-
-// CheckSpam runs spamc to see if a message is spam, and returns either an error, or the modified message
-func (s *Session) checkSpam() (string, error) {
-	if len(s.Config.Spamc) > 0 {
-		cmd := exec.Command(s.Config.Spamc)
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return "", err
-		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return "", err
-		}
-
-		if err := s.Printf("Executing spamc: %v", s.Config.Spamc); err != nil {
-			s.Conn.Logger().Print(err)
-		}
-		if err := cmd.Start(); err != nil {
-			return "", err
-		}
-
-		if err := s.Printf("Beginning output processing: %v", s.Config.Spamc); err != nil {
-			s.Conn.Logger().Print(err)
-		}
-		result := ""
-
-		// Create reader and writer
-		spamwriter := bufio.NewWriter(stdin)
-		spamwriter = bufio.NewWriterSize(spamwriter, len(s.Data))
-		// spamreader := bufio.NewReader(stdout)
-		// spamreader = bufio.NewReaderSize(spamreader, len(session.Data)+1024)
-
-		// Write and flush
-		l, err := spamwriter.WriteString(s.Data)
-		if err != nil {
-			return "", err
-		}
-		if err := s.Printf("Wrote %v bytes of %v to spamwriter", l, len(s.Data)); err != nil {
-			s.Conn.Logger().Print(err)
-		}
-		if err := spamwriter.Flush(); err != nil {
-			s.Conn.Logger().Printf("error flushing spamwriter: %s", err)
-		}
-		if err := stdin.Close(); err != nil {
-			s.Conn.Logger().Printf("error closing stdin: %s", err)
-		}
-		if err := s.Printf("Message written to spamc"); err != nil {
-			s.Conn.Logger().Print(err)
-		}
-
-		// Create a reader at least as big as the original message with extra space for headers
-
-		if err := s.Printf("Reading message back from spamc"); err != nil {
+// checkSpam runs the message through spamc, writing the message it returns to out
+// Without spamc configured the message is copied unchanged
+func (s *Session) checkSpam(msg io.Reader, out io.Writer) error {
+	if len(s.Config.Spamc) == 0 {
+		if err := s.Printf("spamc not configured!"); err != nil {
 			s.Conn.Logger().Print(err)
 		}
+		_, err := io.Copy(out, msg)
+		return err
+	}
+	cmd := exec.Command(s.Config.Spamc)
+	cmd.Stdin = msg
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
 
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if err := s.Println(line); err != nil {
-				s.Conn.Logger().Print(err)
-			}
-			result += line
-			result += "\n"
-		}
-
-		if err := scanner.Err(); err != nil {
-			return "", err
-		}
+	if err := s.Printf("Executing spamc: %v", s.Config.Spamc); err != nil {
+		s.Conn.Logger().Print(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-		if err := s.Printf("Waiting for spamc to exit"); err != nil {
-			s.Conn.Logger().Print(err)
+	// spamc only adds headers, so output much larger than the message is not trusted
+	var output io.Reader = stdout
+	limit := s.spamcLimit()
+	if limit > 0 {
+		output = io.LimitReader(stdout, limit+1)
+	}
+	n, err := io.Copy(out, output)
+	if err == nil && limit > 0 && n > limit {
+		err = fmt.Errorf("spamc output exceeded %d bytes", limit)
+	}
+	if err != nil {
+		// Stop spamc rather than waiting for it to write the rest
+		if err := cmd.Process.Kill(); err != nil {
+			s.Conn.Logger().Printf("error stopping spamc: %s", err)
 		}
-		err = cmd.Wait()
-		if err != nil {
-			return "", err
+		if err := cmd.Wait(); err != nil {
+			s.Conn.Logger().Printf("spamc exited: %s", err)
 		}
-		return result, nil
+		return err
 	}
-	if err := s.Printf("spamc not configured!"); err != nil {
+
+	if err := s.Printf("Waiting for spamc to exit"); err != nil {
 		s.Conn.Logger().Print(err)
 	}
-	return s.Data, nil
+	return cmd.Wait()
 }
 
-// extractAddress parses an SMTP command line for an @ address within <>
-func extractAddressPart(line string) (*string, error) {
-	begin := strings.Index(line, "<") + 1
-	end := strings.LastIndex(line, ">")
-	if begin == -1 || end == -1 {
-		return nil, errors.New("address not found in command")
-	}
-	value := line[begin:end]
-	// RFC 5321 https://tools.ietf.org/html/rfc5321#section-4.5.3
-	if len(value) > 254 {
-		return nil, errors.New("address exceeds maximum length of email address")
+// spamcLimit is the most output accepted from spamc, allowing room for the headers it adds, or zero if unlimited
+func (s *Session) spamcLimit() int64 {
+	if s.maxsize <= 0 {
+		return 0
 	}
-	return &value, nil
+	return s.maxsize + spamcHeaderAllowance
 }
 
-// extractUsername decodes the username from the client's response
-func extractUsername(resp string) (string, error) {
-	decoded, err := base64.StdEncoding.DecodeString(resp)
+// extractAddress parses an SMTP command line for an @ address within <>
+func extractAddressPart(line string) (*string, error) {
+	value, _, err := parsePath(line)
 	if err != nil {
-		return "", errors.New("base64 decode failed")
+		return nil, err
 	}
-	// s.Println("CRAM-MD5 response: ", decoded)
-	return string(decoded), nil
-}
-
-// extractPassword finds the password for the given user
-func extractPassword(username string) string {
-	return ""
+	return &value, nil
 }
 
-// createChallenge creates a challenge for use in CRAM-MD5
-func createChallenge() string {
-	challenge := ""
-	encoded := base64.StdEncoding.EncodeToString([]byte(challenge))
-	return encoded
+// extractArgument returns everything after the command verb, trimmed of whitespace
+func extractArgument(line string) string {
+	i := strings.Index(line, " ")
+	if i == -1 {
+		return ""
+	}
+	return strings.TrimSpace(line[i+1:])
 }
 
 // IsSuspiciousInput looks for input that contains filename elements
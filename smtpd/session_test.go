@@ -1,6 +1,11 @@
 package smtpd
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -13,6 +18,17 @@ type MockConnection struct {
 	readLines  []string
 	writeLines []string
 	readIndex  int
+	// readChunks holds the raw data returned by successive calls to ReadChunk
+	readChunks []string
+	chunkIndex int
+	encrypted  bool
+	// pipelined holds the indexes of readLines that arrive together with the line before,
+	// so input is still pending when that line is read
+	pipelined []int
+	// flushes records the number of writeLines sent at each flush
+	flushes []int
+	// onWrite is called after each write, allowing tests to respond to challenges
+	onWrite func()
 }
 
 func (m *MockConnection) ReadLine() (string, error) {
@@ -24,11 +40,47 @@ func (m *MockConnection) ReadLine() (string, error) {
 	return line, nil
 }
 
+func (m *MockConnection) ReadChunk(w io.Writer, n int64) (int64, error) {
+	if m.chunkIndex >= len(m.readChunks) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	chunk := m.readChunks[m.chunkIndex]
+	m.chunkIndex++
+	if int64(len(chunk)) != n {
+		return 0, fmt.Errorf("chunk is %d bytes, not %d", len(chunk), n)
+	}
+	written, err := io.WriteString(w, chunk)
+	return int64(written), err
+}
+
 func (m *MockConnection) WriteLine(s string) error {
 	m.writeLines = append(m.writeLines, s)
+	m.flushes = append(m.flushes, len(m.writeLines))
+	if m.onWrite != nil {
+		m.onWrite()
+	}
+	return nil
+}
+
+func (m *MockConnection) Write(s string) error {
+	m.writeLines = append(m.writeLines, s)
+	return nil
+}
+
+func (m *MockConnection) Flush() error {
+	m.flushes = append(m.flushes, len(m.writeLines))
 	return nil
 }
 
+func (m *MockConnection) InputPending() bool {
+	for _, i := range m.pipelined {
+		if i == m.readIndex {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *MockConnection) Close() error {
 	return nil
 }
@@ -62,7 +114,11 @@ func (m *MockConnection) GetTCPRemoteHost() string {
 }
 
 func (m *MockConnection) IsEncrypted() bool {
-	return false
+	return m.encrypted
+}
+
+func (m *MockConnection) StartTLS(cfg *tls.Config) error {
+	return errors.New("TLS not supported by mock connection")
 }
 
 func (m *MockConnection) Logger() *log.Logger {
@@ -75,21 +131,30 @@ func createTestSession() *Session {
 		Spamc: "",
 	}
 	session := Create(config, mockConn)
-	session.Data = "Subject: Test Message\n\nThis is a test message body."
 	return session
 }
 
+// testMessage is the message passed to spamc by the tests
+const testMessage = "Subject: Test Message\n\nThis is a test message body."
+
+// runCheckSpam passes a message through checkSpam and returns the result
+func runCheckSpam(session *Session, msg string) (string, error) {
+	var out bytes.Buffer
+	err := session.checkSpam(strings.NewReader(msg), &out)
+	return out.String(), err
+}
+
 func TestCheckSpam_NoSpamcConfigured(t *testing.T) {
 	session := createTestSession()
 	session.Config.Spamc = ""
 
-	result, err := session.checkSpam()
+	result, err := runCheckSpam(session, testMessage)
 
 	if err != nil {
 		t.Errorf("Expected no error when spamc not configured, got: %v", err)
 	}
 
-	if result != session.Data {
+	if result != testMessage {
 		t.Errorf("Expected original data to be returned when spamc not configured")
 	}
 }
@@ -103,14 +168,14 @@ func TestCheckSpam_WithSpamcConfigured(t *testing.T) {
 	session := createTestSession()
 	session.Config.Spamc = "cat" // Use cat as a mock spamc that just echoes input
 
-	result, err := session.checkSpam()
+	result, err := runCheckSpam(session, testMessage)
 
 	if err != nil {
 		t.Errorf("Expected no error with valid spamc command, got: %v", err)
 	}
 
 	// cat should return the same content with newlines
-	expectedLines := strings.Split(session.Data, "\n")
+	expectedLines := strings.Split(testMessage, "\n")
 	resultLines := strings.Split(strings.TrimSuffix(result, "\n"), "\n")
 
 	if len(resultLines) != len(expectedLines) {
@@ -156,7 +221,7 @@ cat
 	session := createTestSession()
 	session.Config.Spamc = tmpFile.Name()
 
-	result, err := session.checkSpam()
+	result, err := runCheckSpam(session, testMessage)
 
 	if err != nil {
 		t.Errorf("Expected no error with mock spamc script, got: %v", err)
@@ -179,7 +244,7 @@ func TestCheckSpam_WithInvalidSpamcCommand(t *testing.T) {
 	session := createTestSession()
 	session.Config.Spamc = "/nonexistent/command"
 
-	_, err := session.checkSpam()
+	_, err := runCheckSpam(session, testMessage)
 	
 	if err == nil {
 		t.Errorf("Expected error with invalid spamc command")
@@ -197,9 +262,8 @@ func TestCheckSpam_EmptyMessage(t *testing.T) {
 
 	session := createTestSession()
 	session.Config.Spamc = "cat"
-	session.Data = ""
 
-	result, err := session.checkSpam()
+	result, err := runCheckSpam(session, "")
 
 	if err != nil {
 		t.Errorf("Expected no error with empty message, got: %v", err)
@@ -220,9 +284,9 @@ func TestCheckSpam_LargeMessage(t *testing.T) {
 	
 	// Create a large message
 	largeBody := strings.Repeat("This is a line of text in a large message.\n", 1000)
-	session.Data = "Subject: Large Test Message\n\n" + largeBody
+	data := "Subject: Large Test Message\n\n" + largeBody
 
-	result, err := session.checkSpam()
+	result, err := runCheckSpam(session, data)
 
 	if err != nil {
 		t.Errorf("Expected no error with large message, got: %v", err)
@@ -236,3 +300,19 @@ func TestCheckSpam_LargeMessage(t *testing.T) {
 		t.Errorf("Expected body content to be preserved in large message")
 	}
 }
+
+func TestCheckSpam_OutputLimit(t *testing.T) {
+	if _, err := exec.LookPath("yes"); err != nil {
+		t.Skip("yes command not available for testing")
+	}
+
+	session := createTestSession()
+	session.maxsize = 1000
+	session.Config.Spamc = "yes" // Never stops writing
+
+	_, err := runCheckSpam(session, testMessage)
+
+	if err == nil {
+		t.Errorf("Expected error when spamc output exceeds the limit")
+	}
+}
@@ -1,11 +1,22 @@
 package smtpd
 
 import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/infodancer/gomail/config"
 	"github.com/infodancer/gomail/connect"
+	"github.com/infodancer/gomail/dkim"
+	"github.com/infodancer/gomail/domain"
+	"github.com/infodancer/gomail/maildir"
+	"github.com/infodancer/gomail/queue"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestextractAddress extracts an address from a RCPT TO or MAIL FROM line
@@ -44,37 +55,623 @@ func TestHandleInputLine(t *testing.T) {
 	s := &Session{Conn: c, Config: cfg}
 	success := 250
 	endsession := 221
-	failure := 500
-	code, result, finished := s.HandleInputLine("HELO hi")
-	assert.Equal(t, success, code, "result code was not 250")
-	assert.Contains(t, result, "testserver")
+	reply, finished := s.HandleInputLine("HELO hi")
+	assert.Equal(t, success, reply.Code, "result code was not 250")
+	assert.Contains(t, reply.Message, "testserver")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("EHLO hi")
-	assert.Equal(t, success, code, "result code was not 250")
-	assert.Contains(t, result, "testserver")
+	reply, finished = s.HandleInputLine("EHLO hi")
+	assert.Equal(t, success, reply.Code, "result code was not 250")
+	assert.Contains(t, reply.Message, "testserver")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("NOOP")
-	assert.Equal(t, success, code, "result code was not 250")
-	assert.Contains(t, result, "OK")
+	reply, finished = s.HandleInputLine("NOOP")
+	assert.Equal(t, success, reply.Code, "result code was not 250")
+	assert.Contains(t, reply.Message, "OK")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("RSET")
-	assert.Equal(t, success, code, "result code was not 250")
-	assert.Contains(t, result, "OK")
+	reply, finished = s.HandleInputLine("RSET")
+	assert.Equal(t, success, reply.Code, "result code was not 250")
+	assert.Contains(t, reply.Message, "OK")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("VRFY")
-	assert.Equal(t, failure, code, "VRFY command did not return 500")
-	assert.Contains(t, result, "VRFY not supported")
+	reply, finished = s.HandleInputLine("VRFY")
+	assert.Equal(t, 501, reply.Code, "VRFY without an argument did not return 501")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("VRFY test@example.com")
-	assert.Equal(t, failure, code, "VRFY command did not return 500")
-	assert.Contains(t, result, "VRFY not supported")
+	reply, finished = s.HandleInputLine("VRFY test@example.com")
+	assert.Equal(t, 252, reply.Code, "VRFY command did not return 252")
+	assert.Equal(t, "2.1.5", reply.Status)
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("MAIL FROM:<test@example.com>")
-	assert.Equal(t, success, code, "MAIL FROM command did not return 250")
-	assert.Contains(t, result, "OK")
+	reply, finished = s.HandleInputLine("MAIL FROM:<test@example.com>")
+	assert.Equal(t, success, reply.Code, "MAIL FROM command did not return 250")
+	assert.Contains(t, reply.Message, "OK")
 	assert.False(t, finished)
-	code, result, finished = s.HandleInputLine("QUIT")
-	assert.Equal(t, endsession, code, "QUIT command did not return 221")
-	assert.Contains(t, result, "goodbye")
+	reply, finished = s.HandleInputLine("QUIT")
+	assert.Equal(t, endsession, reply.Code, "QUIT command did not return 221")
+	assert.Contains(t, reply.Message, "goodbye")
 	assert.True(t, finished)
 }
+
+func TestProcessSTARTTLS(t *testing.T) {
+	s := Create(Config{}, &MockConnection{})
+	reply, finished := s.HandleInputLine("STARTTLS")
+	assert.Equal(t, 502, reply.Code, "STARTTLS without a certificate should not be supported")
+	assert.False(t, finished)
+	assert.False(t, s.isStartTLSAvailable())
+
+	s.Config.TLS = config.SecureConnection{CertFile: "/nonexistent/server.crt", KeyFile: "/nonexistent/server.key"}
+	assert.True(t, s.isStartTLSAvailable(), "STARTTLS should be advertised once a certificate is configured")
+	reply, _ = s.HandleInputLine("STARTTLS now")
+	assert.Equal(t, 501, reply.Code, "STARTTLS does not accept parameters")
+	reply, finished = s.HandleInputLine("STARTTLS")
+	assert.Equal(t, 454, reply.Code, "unreadable certificates should be a temporary failure")
+	assert.False(t, finished)
+}
+
+// createLocalDomain creates a domain root holding example.com with the given users, so that
+// mail to them is accepted without authentication
+func createLocalDomain(t *testing.T, users ...string) string {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "example.com"), 0755))
+	for _, user := range users {
+		_, err := maildir.Create(filepath.Join(root, "example.com", "users", user, "Maildir"))
+		require.NoError(t, err)
+	}
+	previous := domain.DomainRoot()
+	domain.SetDomainRoot(root)
+	t.Cleanup(func() { domain.SetDomainRoot(previous) })
+	return root
+}
+
+func TestRelay(t *testing.T) {
+	createLocalDomain(t, "test")
+	s := Create(Config{}, &MockConnection{})
+	s.HandleInputLine("MAIL FROM:<user@example.org>")
+	reply, _ := s.HandleInputLine("RCPT TO:<friend@example.net>")
+	assert.Equal(t, 550, reply.Code, "unauthenticated clients may not relay")
+	assert.Equal(t, "5.7.1", reply.Status)
+	reply, _ = s.HandleInputLine("RCPT TO:<test@example.com>")
+	assert.Equal(t, 250, reply.Code, "local recipients should be accepted")
+
+	s.resetTransaction()
+	s.Sender = "test@example.com"
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	reply, _ = s.HandleInputLine("RCPT TO:<friend@example.net>")
+	assert.Equal(t, 250, reply.Code, "authenticated users may relay")
+	assert.Equal(t, []string{"friend@example.net"}, s.Recipients)
+}
+
+func TestNullReversePath(t *testing.T) {
+	createLocalDomain(t, "test")
+	s := Create(Config{}, &MockConnection{})
+	reply, _ := s.HandleInputLine("RCPT TO:<test@example.com>")
+	assert.Equal(t, 503, reply.Code, "RCPT should require MAIL first")
+	reply, _ = s.HandleInputLine("MAIL FROM:<>")
+	assert.Equal(t, 250, reply.Code, "the null reverse-path must be accepted")
+	assert.Equal(t, "", s.From)
+	reply, _ = s.HandleInputLine("MAIL FROM:<>")
+	assert.Equal(t, 503, reply.Code, "a second MAIL should be rejected")
+	reply, _ = s.HandleInputLine("AUTH PLAIN")
+	assert.Equal(t, 502, reply.Code)
+	reply, _ = s.HandleInputLine("RCPT TO:<test@example.com>")
+	assert.Equal(t, 250, reply.Code, "RCPT should be accepted after a null reverse-path")
+
+	s.HandleInputLine("RSET")
+	reply, _ = s.HandleInputLine("RCPT TO:<test@example.com>")
+	assert.Equal(t, 503, reply.Code, "RSET should clear the reverse-path")
+}
+
+func TestDataSizeLimit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+
+	lines := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		lines = append(lines, strings.Repeat("0123456789", 4))
+	}
+	lines = append(lines, ".", "after the message")
+	conn := &MockConnection{readLines: lines}
+	s := Create(Config{Maxsize: 100, MQueue: q}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, finished := s.HandleInputLine("DATA")
+	assert.Equal(t, 552, reply.Code, "oversize message should be refused")
+	assert.False(t, finished)
+	tmp, err := os.ReadDir(filepath.Join(tempDir, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0, "oversize message should not be kept")
+	assert.Equal(t, len(conn.readLines)-1, conn.readIndex, "the rest of the message should be read")
+	names, err := q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0)
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 503, reply.Code, "the transaction should be over")
+
+	conn = &MockConnection{readLines: []string{"Subject: small", "", "..hello", "."}}
+	s = Create(Config{Maxsize: 100, MQueue: q}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 250, reply.Code)
+	names, err = q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: small\n\n.hello\n", stripReceived(t, string(msg)))
+}
+
+// stripReceived checks that a queued message starts with our Received header, and returns the rest of it
+func stripReceived(t *testing.T, msg string) string {
+	require.True(t, strings.HasPrefix(msg, "Received: from "), "missing Received header: %q", msg)
+	_, rest, _ := strings.Cut(msg, "\n")
+	for strings.HasPrefix(rest, "\t") {
+		_, rest, _ = strings.Cut(rest, "\n")
+	}
+	return rest
+}
+
+func TestDataThroughSpamc(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat command not available for testing")
+	}
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+
+	lines := []string{"Subject: filtered", ""}
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, "This is a line of text in a large message.")
+	}
+	conn := &MockConnection{readLines: append(lines, ".")}
+	s := Create(Config{MQueue: q, Spamc: "cat"}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, _ := s.HandleInputLine("DATA")
+	assert.Equal(t, 250, reply.Code)
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(lines, "\n")+"\n", stripReceived(t, string(msg)))
+
+	// A failing filter leaves nothing in the queue
+	conn = &MockConnection{readLines: append(lines, ".")}
+	s = Create(Config{MQueue: q, Spamc: "/nonexistent/command"}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 451, reply.Code)
+	assert.Equal(t, len(conn.readLines), conn.readIndex, "the message should still be read")
+	names, err = q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+	tmp, err := os.ReadDir(filepath.Join(tempDir, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0)
+}
+
+func TestBDAT(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+	readQueued := func() (*queue.Envelope, string) {
+		names, err := q.List()
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+		env, err := q.Load(names[0])
+		require.NoError(t, err)
+		msg, err := q.ReadMessage(env)
+		require.NoError(t, err)
+		require.NoError(t, q.Remove(env))
+		return env, string(msg)
+	}
+
+	conn := &MockConnection{readChunks: []string{"ignored", "Subject: chunks\r", "\n\r\n..body\r\n", "more"}}
+	s := Create(Config{Maxsize: 100, MQueue: q}, conn)
+	reply, _ := s.HandleInputLine("EHLO client.example.com")
+	assert.Contains(t, reply.Lines(), "250-CHUNKING")
+	assert.Contains(t, reply.Lines(), "250-BINARYMIME")
+	reply, _ = s.HandleInputLine("BDAT 7")
+	assert.Equal(t, 503, reply.Code, "BDAT should require MAIL first")
+	assert.Equal(t, 1, conn.chunkIndex, "a refused chunk should still be read")
+
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, _ = s.HandleInputLine("BDAT 16")
+	assert.Equal(t, 250, reply.Code)
+	assert.Equal(t, "2.0.0 16 octets received", reply.Text())
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 503, reply.Code, "DATA can't be mixed with BDAT")
+	reply, _ = s.HandleInputLine("BDAT 11 LAST")
+	assert.Equal(t, 250, reply.Code)
+	_, data := readQueued()
+	assert.Equal(t, "Subject: chunks\n\n..body\n", stripReceived(t, data), "line endings should be converted, and dots left alone")
+	reply, _ = s.HandleInputLine("BDAT 4 LAST")
+	assert.Equal(t, 503, reply.Code, "the transaction should be over")
+
+	// Binary messages are stored as received, and must use BDAT
+	conn = &MockConnection{readChunks: []string{"a\r\nb\x00\rc\n"}}
+	s = Create(Config{Maxsize: 100, MQueue: q}, conn)
+	reply, _ = s.HandleInputLine("MAIL FROM:<test@example.com> BODY=BINARYMIME")
+	assert.Equal(t, 250, reply.Code)
+	s.Recipients = []string{"test@example.com"}
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 503, reply.Code, "BINARYMIME requires BDAT")
+	reply, _ = s.HandleInputLine("BDAT 8 last")
+	assert.Equal(t, 250, reply.Code)
+	env, data := readQueued()
+	assert.Equal(t, queue.BodyBinaryMIME, env.Body)
+	assert.Equal(t, "a\r\nb\x00\rc\n", stripReceived(t, data))
+
+	// An oversize message is refused, and nothing is queued
+	conn = &MockConnection{readChunks: []string{strings.Repeat("x", 60), strings.Repeat("y", 60)}}
+	s = Create(Config{Maxsize: 100, MQueue: q}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.Recipients = []string{"test@example.com"}
+	reply, _ = s.HandleInputLine("BDAT 60")
+	assert.Equal(t, 250, reply.Code)
+	reply, _ = s.HandleInputLine("BDAT 60 LAST")
+	assert.Equal(t, 552, reply.Code)
+	assert.Equal(t, 2, conn.chunkIndex)
+	names, err := q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 0)
+	tmp, err := os.ReadDir(filepath.Join(tempDir, "tmp"))
+	require.NoError(t, err)
+	assert.Len(t, tmp, 0, "the partial message should be discarded")
+
+	reply, _ = s.HandleInputLine("BDAT x")
+	assert.Equal(t, 501, reply.Code)
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	createLocalDomain(t, "test")
+	conn := &MockConnection{readLines: []string{
+		"EHLO client.example.com",
+		"MAIL FROM:<test@example.com>",
+		"MAIL FROM:<test@example.com>",
+		"RCPT TO:<>",
+		"RCPT TO:<test@example.com>",
+		"QUIT",
+	}}
+	s := Create(Config{ServerConfig: config.ServerConfig{ServerName: "testserver"}}, conn)
+	require.NoError(t, s.HandleConnection())
+	assert.Contains(t, conn.writeLines, "250-ENHANCEDSTATUSCODES\r\n")
+	assert.Equal(t, "250-testserver\r\n", conn.writeLines[0], "the EHLO response has no enhanced status code")
+	assert.Contains(t, conn.writeLines, "250 2.1.0 OK\r\n")
+	assert.Contains(t, conn.writeLines, "503 5.5.1 Sender already specified\r\n")
+	assert.Contains(t, conn.writeLines, "501 5.1.3 Bad recipient address syntax\r\n")
+	assert.Contains(t, conn.writeLines, "250 2.1.5 OK\r\n")
+	assert.Contains(t, conn.writeLines, "221 2.0.0 goodbye\r\n")
+}
+
+func TestEHLO(t *testing.T) {
+	conn := &MockConnection{}
+	cfg := Config{ServerConfig: config.ServerConfig{ServerName: "testserver"}, Auth: staticAuthenticator{}}
+	s := Create(cfg, conn)
+	reply, finished := s.HandleInputLine("EHLO client.example.com")
+	assert.False(t, finished)
+	assert.Equal(t, 250, reply.Code)
+	lines := reply.Lines()
+	assert.Equal(t, "250-testserver", lines[0], "the domain should come first")
+	assert.Regexp(t, "^250 ", lines[len(lines)-1])
+	assert.Contains(t, lines, "250-8BITMIME")
+	assert.Contains(t, lines, "250-AUTH CRAM-MD5")
+	for _, line := range lines {
+		assert.NotContains(t, line, "SIZE", "SIZE should only be advertised with a limit")
+		assert.NotContains(t, line, "STARTTLS")
+	}
+
+	// Once TLS is available, AUTH waits for it
+	s.maxsize = 1000
+	s.Config.TLS = config.SecureConnection{CertFile: "/nonexistent/server.crt", KeyFile: "/nonexistent/server.key"}
+	reply, _ = s.HandleInputLine("EHLO client.example.com")
+	lines = reply.Lines()
+	assert.Contains(t, lines, "250-SIZE 1000")
+	assert.Equal(t, "250 STARTTLS", lines[len(lines)-1])
+	for _, line := range lines {
+		assert.NotContains(t, line, "AUTH")
+	}
+	reply, _ = s.HandleInputLine("AUTH CRAM-MD5")
+	assert.Equal(t, 530, reply.Code)
+
+	RegisterExtension(Extension{Keyword: "XTEST", Params: func(s *Session) []string { return []string{"a", "b"} }})
+	defer func() { extensions = extensions[:len(extensions)-1] }()
+	reply, _ = s.HandleInputLine("EHLO client.example.com")
+	assert.Equal(t, "250 XTEST a b", reply.Lines()[len(reply.Lines())-1])
+}
+
+func TestRepeatedEHLO(t *testing.T) {
+	s := Create(Config{ServerConfig: config.ServerConfig{ServerName: "testserver"}}, &MockConnection{})
+	s.HandleInputLine("EHLO client.example.com")
+	s.Sender = "user@example.com"
+	reply, _ := s.HandleInputLine("MAIL FROM:<user@example.com>")
+	require.Equal(t, 250, reply.Code)
+	reply, _ = s.HandleInputLine("RCPT TO:<friend@example.net>")
+	require.Equal(t, 250, reply.Code)
+
+	// EHLO implies RSET, so a new transaction can start
+	reply, _ = s.HandleInputLine("EHLO client.example.com")
+	assert.Equal(t, 250, reply.Code)
+	assert.Empty(t, s.Recipients)
+	reply, _ = s.HandleInputLine("MAIL FROM:<other@example.com>")
+	assert.Equal(t, 250, reply.Code, "MAIL after EHLO should not be a nested MAIL")
+	assert.Equal(t, "user@example.com", s.Sender, "EHLO must not undo authentication")
+}
+
+func TestPipelining(t *testing.T) {
+	createLocalDomain(t, "one", "two")
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+
+	conn := &MockConnection{
+		readLines: []string{
+			"EHLO client.example.com",
+			"MAIL FROM:<test@example.com>",
+			"RCPT TO:<one@example.com>",
+			"RCPT TO:<two@example.com>",
+			"DATA",
+			"Subject: pipelined",
+			"",
+			"hello",
+			".",
+			"QUIT",
+		},
+		pipelined: []int{2, 3, 4},
+	}
+	s := Create(Config{ServerConfig: config.ServerConfig{ServerName: "testserver"}, MQueue: q}, conn)
+	require.NoError(t, s.HandleConnection())
+	ehlo := len(s.ehloResponse())
+	assert.Equal(t, []int{ehlo, ehlo + 4, ehlo + 5, ehlo + 6}, conn.flushes,
+		"the replies to MAIL, RCPT and DATA should be sent together")
+	assert.Equal(t, "354 Send message content; end with <CRLF>.<CRLF>\r\n", conn.writeLines[ehlo+3])
+	names, err := q.List()
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+
+	// Commands may not follow EHLO or DATA before the reply has been sent
+	conn = &MockConnection{
+		readLines: []string{"EHLO client.example.com", "MAIL FROM:<test@example.com>"},
+		pipelined: []int{1},
+	}
+	s = Create(Config{}, conn)
+	require.NoError(t, s.HandleConnection())
+	assert.Equal(t, []string{"554 5.5.0 SMTP protocol synchronization error\r\n"}, conn.writeLines)
+
+	conn = &MockConnection{readLines: []string{"Subject: too soon"}, pipelined: []int{0}}
+	s = Create(Config{MQueue: q}, conn)
+	s.HandleInputLine("MAIL FROM:<test@example.com>")
+	s.HandleInputLine("RCPT TO:<one@example.com>")
+	reply, finished := s.HandleInputLine("DATA")
+	assert.Equal(t, 554, reply.Code)
+	assert.True(t, finished)
+}
+
+// spfResolver serves SPF records from a map, returning not found for anything else
+type spfResolver map[string]string
+
+func (r spfResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r spfResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r spfResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r spfResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestSPF(t *testing.T) {
+	createLocalDomain(t, "test")
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+
+	resolver := spfResolver{
+		"client.example.com": "v=spf1 ip4:192.168.1.100 -all",
+		"example.com":        "v=spf1 ip4:192.168.1.0/24 -all",
+		"example.org":        "v=spf1 -all",
+	}
+	cfg := Config{
+		ServerConfig: config.ServerConfig{ServerName: "mail.example.net"},
+		MQueue:       q,
+		SPF:          SPFConfig{Enabled: true},
+		Resolver:     resolver,
+	}
+	conn := &MockConnection{readLines: []string{"Subject: spf", "", "body", "."}}
+	s := Create(cfg, conn)
+	s.HandleInputLine("EHLO client.example.com")
+	reply, _ := s.HandleInputLine("MAIL FROM:<user@example.com>")
+	assert.Equal(t, 250, reply.Code)
+	s.HandleInputLine("RCPT TO:<test@example.com>")
+	reply, _ = s.HandleInputLine("DATA")
+	assert.Equal(t, 250, reply.Code)
+	names, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	env, err := q.Load(names[0])
+	require.NoError(t, err)
+	msg, err := q.ReadMessage(env)
+	require.NoError(t, err)
+	require.NoError(t, q.Remove(env))
+	assert.True(t, strings.HasPrefix(string(msg),
+		"Received-SPF: pass (mail.example.net: domain of client.example.com designates 192.168.1.100 as permitted sender)\n"),
+		"the HELO identity should be checked first: %s", msg)
+	assert.Contains(t, string(msg), "Received-SPF: pass (mail.example.net: domain of user@example.com designates")
+	assert.Contains(t, string(msg), "identity=mailfrom\nReceived: from client.example.com")
+
+	// Failures are only refused when configured
+	reply, _ = s.HandleInputLine("MAIL FROM:<user@example.org>")
+	assert.Equal(t, 250, reply.Code)
+	assert.Contains(t, s.Headers[1], "Received-SPF: fail")
+	s.reset()
+	s.Config.SPF.RejectFail = true
+	reply, _ = s.HandleInputLine("MAIL FROM:<user@example.org>")
+	assert.Equal(t, 550, reply.Code)
+	assert.Equal(t, "5.7.23", reply.Status)
+	assert.Empty(t, s.Headers)
+	reply, _ = s.HandleInputLine("MAIL FROM:<>")
+	assert.Equal(t, 250, reply.Code, "bounces are checked with the HELO identity")
+	assert.Len(t, s.Headers, 1)
+
+	// Authenticated users aren't checked
+	s.reset()
+	s.Sender = "user@example.com"
+	reply, _ = s.HandleInputLine("MAIL FROM:<user@example.org>")
+	assert.Equal(t, 250, reply.Code)
+	assert.Empty(t, s.Headers)
+}
+
+func TestDKIMVerify(t *testing.T) {
+	createLocalDomain(t, "test")
+	tempDir, err := os.MkdirTemp("", "queue")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(tempDir)) }()
+	q, err := queue.CreateQueue(tempDir)
+	require.NoError(t, err)
+	cfg := Config{
+		ServerConfig: config.ServerConfig{ServerName: "mail.example.net"},
+		MQueue:       q,
+		DKIM:         DKIMConfig{Verify: true},
+		Resolver:     spfResolver{},
+	}
+	deliver := func(lines ...string) string {
+		conn := &MockConnection{readLines: append(lines, ".")}
+		s := Create(cfg, conn)
+		s.HandleInputLine("MAIL FROM:<user@example.com>")
+		s.HandleInputLine("RCPT TO:<test@example.com>")
+		reply, _ := s.HandleInputLine("DATA")
+		require.Equal(t, 250, reply.Code)
+		names, err := q.List()
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+		env, err := q.Load(names[0])
+		require.NoError(t, err)
+		msg, err := q.ReadMessage(env)
+		require.NoError(t, err)
+		require.NoError(t, q.Remove(env))
+		return string(msg)
+	}
+
+	msg := deliver("From: user@example.com", "Subject: unsigned", "", "body")
+	assert.True(t, strings.HasPrefix(msg, "Authentication-Results: mail.example.net;\n\tdkim=none\nReceived: from "), msg)
+
+	msg = deliver(
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; h=From:Subject;",
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=; b=AAAAAAAAAAAA",
+		"From: user@example.com", "Subject: signed", "", "body")
+	assert.True(t, strings.HasPrefix(msg, "Authentication-Results: mail.example.net;\n\tdkim=fail reason="), msg)
+	assert.Contains(t, msg, "header.d=example.com header.s=sel header.b=AAAAAAAA\n")
+
+	// Results that claim to be ours are removed, along with their folded lines
+	msg = deliver(
+		"Authentication-Results: MAIL.example.net;", "\tdkim=pass header.d=paypal.com",
+		"Authentication-Results: other.example.org; dkim=pass",
+		"From: user@example.com", "Subject: forged", "", "Authentication-Results: mail.example.net; body")
+	assert.True(t, strings.HasPrefix(msg, "Authentication-Results: mail.example.net;\n\tdkim=none\n"), msg)
+	assert.NotContains(t, msg, "MAIL.example.net")
+	assert.NotContains(t, msg, "paypal.com")
+	assert.Contains(t, msg, "\nAuthentication-Results: other.example.org; dkim=pass\nFrom: user@example.com\n")
+	assert.True(t, strings.HasSuffix(msg, "\n\nAuthentication-Results: mail.example.net; body\n"), "the body should be unchanged")
+}
+
+func TestHeaderFilter(t *testing.T) {
+	var out strings.Builder
+	f := &headerFilter{w: &out, drop: func(field string) bool { return isAuthenticationResults(field, "mx.example.net") }}
+	msg := "Authentication-Results: mx.example.net (forged);\r\n spf=pass\r\nSubject: test\r\n\r\nbody\r\n"
+	for i := 0; i < len(msg); i += 5 {
+		end := i + 5
+		if end > len(msg) {
+			end = len(msg)
+		}
+		_, err := f.Write([]byte(msg[i:end]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.flush())
+	assert.Equal(t, "Subject: test\r\n\r\nbody\r\n", out.String())
+
+	out.Reset()
+	f = &headerFilter{w: &out, drop: func(field string) bool { return false }}
+	_, err := f.Write([]byte("Subject: no body"))
+	require.NoError(t, err)
+	require.NoError(t, f.flush())
+	assert.Equal(t, "Subject: no body", out.String())
+}
+
+func TestDKIMSign(t *testing.T) {
+	root := createLocalDomain(t, "test")
+	key, err := dkim.GenerateKey(dkim.KeyTypeEd25519, 0)
+	require.NoError(t, err)
+	data, err := dkim.MarshalPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "example.com", "dkim"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "example.com", "dkim", "mail.key"), data, 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "example.org"), 0700))
+	record, err := dkim.KeyRecord(key)
+	require.NoError(t, err)
+
+	q, err := queue.CreateQueue(t.TempDir())
+	require.NoError(t, err)
+	cfg := Config{
+		ServerConfig: config.ServerConfig{ServerName: "mail.example.com"},
+		MQueue:       q,
+		DKIM:         DKIMConfig{Sign: true, Selector: "mail"},
+	}
+	send := func(sender string, lines ...string) string {
+		conn := &MockConnection{readLines: append(lines, ".")}
+		s := Create(cfg, conn)
+		s.Sender = sender
+		s.HandleInputLine("MAIL FROM:<" + sender + ">")
+		s.HandleInputLine("RCPT TO:<test@example.com>")
+		reply, _ := s.HandleInputLine("DATA")
+		require.Equal(t, 250, reply.Code)
+		names, err := q.List()
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+		env, err := q.Load(names[0])
+		require.NoError(t, err)
+		msg, err := q.ReadMessage(env)
+		require.NoError(t, err)
+		require.NoError(t, q.Remove(env))
+		return string(msg)
+	}
+
+	msg := send("user@example.com", "From: user@example.com", "Subject: signed", "", "body")
+	assert.True(t, strings.HasPrefix(msg, "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\n\td=example.com; s=mail;"), msg)
+	v := &dkim.Verifier{Resolver: spfResolver{"mail._domainkey.example.com": record}}
+	_, err = v.Write([]byte(msg))
+	require.NoError(t, err)
+	results := v.Verify()
+	require.Len(t, results, 1)
+	assert.Equal(t, dkim.Pass, results[0].Status, "%v", results[0].Err)
+
+	// Domains without a key send unsigned mail
+	msg = send("user@example.org", "From: user@example.org", "Subject: unsigned", "", "body")
+	assert.NotContains(t, msg, "DKIM-Signature")
+
+	// Unauthenticated mail is never signed
+	msg = send("", "From: user@example.com", "Subject: unsigned", "", "body")
+	assert.NotContains(t, msg, "DKIM-Signature")
+}
@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+
+	"github.com/infodancer/gomail/address"
+	"github.com/infodancer/gomail/spf"
+)
+
+// checkSPF checks whether the client may send mail for the HELO name and the MAIL FROM domain,
+// adding a Received-SPF header for each identity checked (RFC 7208 section 2.3)
+// It returns a reply refusing the sender if a check failed and failures are rejected
+func (s *Session) checkSPF(from string) Reply {
+	ip := net.ParseIP(s.Conn.GetTCPRemoteIP())
+	if ip == nil {
+		s.Conn.Logger().Printf("cannot check SPF without the client address: %q", s.Conn.GetTCPRemoteIP())
+		return Reply{}
+	}
+	checker := &spf.Checker{Resolver: s.Config.Resolver}
+	received := spf.Received{
+		ClientIP:     ip,
+		EnvelopeFrom: from,
+		Helo:         s.Helo,
+		Receiver:     s.Config.ServerName,
+	}
+
+	// Address literals can't have SPF records, so the HELO identity is only checked for names
+	if s.Helo != "" && !strings.HasPrefix(s.Helo, "[") {
+		received.Identity = "helo"
+		received.Result, received.Err = checker.CheckHost(ip, s.Helo, "postmaster@"+s.Helo, s.Helo)
+		if reply := s.recordSPF(received); reply.Code != 0 || from == "" {
+			return reply
+		}
+	}
+	// The null reverse-path is checked with the HELO identity (RFC 7208 section 2.4)
+	if from == "" {
+		return Reply{}
+	}
+	received.Identity = "mailfrom"
+	received.Result, received.Err = checker.CheckHost(ip, address.GetHost(from), from, s.Helo)
+	return s.recordSPF(received)
+}
+
+// recordSPF adds the Received-SPF header for a check, and refuses the sender if it failed
+// and failures are rejected
+func (s *Session) recordSPF(received spf.Received) Reply {
+	if received.Err != nil {
+		s.Conn.Logger().Printf("SPF %s for %s identity: %s", received.Result, received.Identity, received.Err)
+	}
+	s.AddHeader(received.String())
+	if received.Result == spf.Fail && s.Config.SPF.RejectFail {
+		return Reply{550, "5.7.23", "SPF validation failed"}
+	}
+	return Reply{}
+}
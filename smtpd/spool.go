@@ -0,0 +1,168 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/infodancer/gomail/dkim"
+	"github.com/infodancer/gomail/queue"
+)
+
+// errSpoolAborted stops the spam filter when a message is discarded
+var errSpoolAborted = errors.New("message discarded")
+
+// spool streams a message into the queue as it is received, passing it through spamc if configured
+type spool struct {
+	msg *queue.MessageWriter
+	// w receives the message data: the queue file, or a pipe into the spam filter
+	w    io.Writer
+	pipe *io.PipeWriter
+	// done receives the result of the spam filter once it has finished
+	done   chan error
+	logger *log.Logger
+	// verifier checks DKIM signatures as the message arrives, if enabled
+	verifier *dkim.Verifier
+	// filter removes Authentication-Results fields that claim to be ours, when we add our own
+	filter *headerFilter
+	// signer signs mail from authenticated users as it arrives, if enabled
+	signer *dkim.Signer
+	// authServID names this server in the Authentication-Results header
+	authServID string
+	newline    string
+}
+
+// createSpool starts a new message in the queue for the current transaction
+func (s *Session) createSpool() (*spool, error) {
+	env := queue.Envelope{
+		Sender:     s.From,
+		Recipients: s.Recipients,
+		Body:       s.Body,
+		Ret:        s.Ret,
+		EnvID:      s.EnvID,
+		Status:     s.notify,
+	}
+	msg, err := s.Config.MQueue.NewMessage(env)
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{msg: msg, w: msg, logger: s.Conn.Logger(), authServID: s.Config.ServerName, newline: "\n"}
+	if s.Body == BodyBinaryMIME {
+		sp.newline = "\r\n"
+	}
+	if len(s.Config.Spamc) > 0 {
+		r, w := io.Pipe()
+		sp.w = w
+		sp.pipe = w
+		sp.done = make(chan error, 1)
+		go func() {
+			err := s.checkSpam(r, msg)
+			// Unblock the writer if the filter stopped reading early
+			if err != nil {
+				r.CloseWithError(err)
+			} else {
+				r.CloseWithError(io.ErrClosedPipe)
+			}
+			sp.done <- err
+		}()
+	}
+	if s.Config.DKIM.Verify && s.Sender == "" {
+		sp.filter = &headerFilter{w: sp.w, drop: func(field string) bool {
+			return isAuthenticationResults(field, sp.authServID)
+		}}
+		sp.w = sp.filter
+	}
+	// Our headers go at the top, with Received-SPF above Received (RFC 7208 section 9.1)
+	headers := append(append([]string{}, s.Headers...), s.createReceived())
+	for _, h := range headers {
+		if _, err := io.WriteString(sp, sp.header(h)); err != nil {
+			sp.abort()
+			return nil, err
+		}
+	}
+	// Signatures are checked and made on the message as the client sent it, without our headers
+	if s.Config.DKIM.Verify && s.Sender == "" {
+		sp.verifier = &dkim.Verifier{Resolver: s.Config.Resolver}
+	}
+	if s.Config.DKIM.Sign && s.Sender != "" {
+		sp.signer = s.createSigner()
+	}
+	return sp, nil
+}
+
+// header formats a header with the line endings used for the message
+func (sp *spool) header(h string) string {
+	return strings.ReplaceAll(h, "\n", sp.newline) + sp.newline
+}
+
+// Write adds raw message data
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.verifier != nil {
+		if _, err := sp.verifier.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if sp.signer != nil {
+		if _, err := sp.signer.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return sp.w.Write(p)
+}
+
+// WriteLine adds a line of message data
+func (sp *spool) WriteLine(line string) error {
+	_, err := io.WriteString(sp, line+"\n")
+	return err
+}
+
+// commit waits for the spam filter and places the message in the queue
+func (sp *spool) commit() error {
+	if sp.filter != nil {
+		if err := sp.filter.flush(); err != nil {
+			sp.abort()
+			return err
+		}
+	}
+	if sp.pipe != nil {
+		if err := sp.pipe.Close(); err != nil {
+			sp.logger.Print(err)
+		}
+		if err := <-sp.done; err != nil {
+			if err := sp.msg.Abort(); err != nil {
+				sp.logger.Print(err)
+			}
+			return err
+		}
+	}
+	if sp.verifier != nil {
+		results := sp.verifier.Verify()
+		for _, r := range results {
+			if r.Err != nil {
+				sp.logger.Printf("DKIM %s for %s: %s", r.Status, r.Domain, r.Err)
+			}
+		}
+		sp.msg.AddHeader(sp.header(dkim.AuthenticationResults(sp.authServID, results)))
+	}
+	if sp.signer != nil {
+		// A message that can't be signed is still sent, since the recipient may accept it unsigned
+		if sig, err := sp.signer.Sign(); err != nil {
+			sp.logger.Printf("could not sign message: %s", err)
+		} else {
+			sp.msg.AddHeader(sp.header(sig))
+		}
+	}
+	return sp.msg.Commit()
+}
+
+// abort discards the message
+func (sp *spool) abort() {
+	if sp.pipe != nil {
+		sp.pipe.CloseWithError(errSpoolAborted)
+		<-sp.done
+	}
+	if err := sp.msg.Abort(); err != nil {
+		sp.logger.Print(err)
+	}
+}
@@ -0,0 +1,80 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Received describes the outcome of a check for the Received-SPF header
+type Received struct {
+	Result Result
+	// Err is the problem behind a TempError or PermError result
+	Err error
+	// ClientIP is the address of the host that was checked
+	ClientIP net.IP
+	// EnvelopeFrom is the MAIL FROM address, or empty for the null reverse-path
+	EnvelopeFrom string
+	Helo         string
+	// Identity is the identity that was checked: "mailfrom" or "helo"
+	Identity string
+	// Receiver is the name of the server doing the check
+	Receiver string
+}
+
+// dotAtom matches values that can be used in the header without quoting
+var dotAtom = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+/=?^_{|}~-]+(\.[A-Za-z0-9!#$%&'*+/=?^_{|}~-]+)*$`)
+
+// String formats the Received-SPF header, without a line ending (RFC 7208 section 9.1)
+func (r Received) String() string {
+	subject := r.EnvelopeFrom
+	if r.Identity == "helo" || subject == "" {
+		subject = r.Helo
+	}
+	var comment string
+	switch r.Result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", subject, r.ClientIP)
+	case Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", subject, r.ClientIP)
+	case SoftFail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", subject, r.ClientIP)
+	case Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", r.ClientIP, subject)
+	case None:
+		comment = fmt.Sprintf("domain of %s does not designate permitted sender hosts", subject)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s", subject)
+	}
+
+	pairs := []string{"client-ip=" + r.ClientIP.String()}
+	pairs = append(pairs, "envelope-from="+quote(r.EnvelopeFrom))
+	if r.Helo != "" {
+		pairs = append(pairs, "helo="+quote(r.Helo))
+	}
+	if r.Err != nil && (r.Result == TempError || r.Result == PermError) {
+		pairs = append(pairs, "problem="+quote(r.Err.Error()))
+	}
+	pairs = append(pairs, "receiver="+quote(r.Receiver), "identity="+r.Identity)
+	return fmt.Sprintf("Received-SPF: %s (%s: %s)\n\t%s", r.Result, r.Receiver, clean(comment), strings.Join(pairs, ";\n\t"))
+}
+
+// quote returns a value as a dot-atom, or as a quoted string if it needs one
+func quote(s string) string {
+	if dotAtom.MatchString(s) {
+		return s
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(clean(s))
+	return `"` + s + `"`
+}
+
+// clean removes characters that could break the header from text supplied by the client
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == '(' || r == ')' {
+			return -1
+		}
+		return r
+	}, s)
+}
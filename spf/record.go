@@ -0,0 +1,319 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mechanism is a directive from an SPF record (RFC 7208 section 5)
+type mechanism struct {
+	qualifier Result
+	name      string
+	// domainSpec is the target of the mechanism before macro expansion; empty for the current domain
+	domainSpec string
+	// network is the address range for ip4 and ip6
+	network *net.IPNet
+	// prefix4 and prefix6 are the prefix lengths for a and mx
+	prefix4 int
+	prefix6 int
+}
+
+// record is a parsed SPF record
+type record struct {
+	mechanisms []mechanism
+	// redirect is the domain spec of the redirect modifier, if there is one
+	redirect string
+}
+
+var qualifiers = map[byte]Result{'+': Pass, '-': Fail, '~': SoftFail, '?': Neutral}
+
+// modifierName matches the name of a modifier (RFC 7208 section 12)
+var modifierName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*$`)
+
+// dualCIDR separates the optional prefix lengths from the domain spec of a or mx
+var dualCIDR = regexp.MustCompile(`^(.*?)(?:/(\d+))?(?://(\d+))?$`)
+
+// parseRecord parses the terms of an SPF record (RFC 7208 section 4.6)
+func parseRecord(txt string) (*record, error) {
+	terms := strings.Fields(txt)[1:]
+	rec := &record{}
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if eq := strings.IndexByte(term, '='); eq > 0 && modifierName.MatchString(term[:eq]) {
+			name := strings.ToLower(term[:eq])
+			if name != "redirect" && name != "exp" {
+				// Unknown modifiers are ignored (RFC 7208 section 6)
+				continue
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("more than one %s modifier", name)
+			}
+			seen[name] = true
+			if err := checkMacros(term[eq+1:]); err != nil {
+				return nil, err
+			}
+			// The explanation from exp is optional, and isn't used
+			if name == "redirect" {
+				rec.redirect = term[eq+1:]
+			}
+			continue
+		}
+		m, err := parseMechanism(term)
+		if err != nil {
+			return nil, err
+		}
+		rec.mechanisms = append(rec.mechanisms, m)
+	}
+	// redirect is ignored if the record has an all mechanism (RFC 7208 section 6.1)
+	for _, m := range rec.mechanisms {
+		if m.name == "all" {
+			rec.redirect = ""
+		}
+	}
+	return rec, nil
+}
+
+// parseMechanism parses a directive: an optional qualifier, the mechanism and its arguments
+func parseMechanism(term string) (mechanism, error) {
+	m := mechanism{qualifier: Pass, prefix4: 32, prefix6: 128}
+	if q, ok := qualifiers[term[0]]; ok {
+		m.qualifier = q
+		term = term[1:]
+	}
+	name := term
+	args := ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name = term[:i]
+		args = term[i:]
+	}
+	m.name = strings.ToLower(name)
+
+	switch m.name {
+	case "all":
+		if args != "" {
+			return m, fmt.Errorf("all takes no arguments: %s", term)
+		}
+	case "include", "exists", "ptr":
+		spec := strings.TrimPrefix(args, ":")
+		if args != "" && (!strings.HasPrefix(args, ":") || spec == "") {
+			return m, fmt.Errorf("invalid mechanism %s", term)
+		}
+		if spec == "" && m.name != "ptr" {
+			return m, fmt.Errorf("%s needs a domain: %s", m.name, term)
+		}
+		if err := checkMacros(spec); err != nil {
+			return m, err
+		}
+		m.domainSpec = spec
+	case "a", "mx":
+		parts := dualCIDR.FindStringSubmatch(args)
+		spec := parts[1]
+		if spec != "" {
+			if !strings.HasPrefix(spec, ":") || len(spec) == 1 {
+				return m, fmt.Errorf("invalid mechanism %s", term)
+			}
+			spec = spec[1:]
+		}
+		if err := checkMacros(spec); err != nil {
+			return m, err
+		}
+		m.domainSpec = spec
+		var err error
+		if m.prefix4, err = parsePrefix(parts[2], 32); err != nil {
+			return m, err
+		}
+		if m.prefix6, err = parsePrefix(parts[3], 128); err != nil {
+			return m, err
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(args, ":") {
+			return m, fmt.Errorf("%s needs an address: %s", m.name, term)
+		}
+		network, err := parseNetwork(args[1:], m.name == "ip4")
+		if err != nil {
+			return m, fmt.Errorf("invalid mechanism %s: %w", term, err)
+		}
+		m.network = network
+	default:
+		return m, fmt.Errorf("unknown mechanism %s", term)
+	}
+	return m, nil
+}
+
+// parsePrefix parses a CIDR prefix length, which defaults to the full address length
+func parsePrefix(s string, bits int) (int, error) {
+	if s == "" {
+		return bits, nil
+	}
+	prefix, err := strconv.Atoi(s)
+	if err != nil || prefix > bits || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid prefix length /%s", s)
+	}
+	return prefix, nil
+}
+
+// parseNetwork parses the address and optional prefix length of ip4 or ip6
+func parseNetwork(s string, ip4 bool) (*net.IPNet, error) {
+	addr, prefix, hasPrefix := strings.Cut(s, "/")
+	ip := net.ParseIP(addr)
+	bits := 128
+	if ip4 {
+		bits = 32
+		ip = ip.To4()
+	} else if ip != nil && strings.Count(addr, ":") == 0 {
+		ip = nil
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", addr)
+	}
+	length := bits
+	if hasPrefix {
+		var err error
+		if prefix == "" {
+			return nil, fmt.Errorf("missing prefix length")
+		}
+		if length, err = parsePrefix(prefix, bits); err != nil {
+			return nil, err
+		}
+	}
+	mask := net.CIDRMask(length, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// checkMacros validates the macros in a domain spec so syntax errors are found while parsing
+func checkMacros(spec string) error {
+	_, err := expandMacros(spec, func(byte) (string, error) { return "", nil })
+	return err
+}
+
+// expand expands the macros in a domain spec for the current check (RFC 7208 section 7),
+// shortening the result to fit in a domain name
+func (e *evaluation) expand(spec string, domain string) (string, error) {
+	expanded, err := expandMacros(spec, func(letter byte) (string, error) {
+		switch letter {
+		case 's':
+			return e.local + "@" + e.senderDomain, nil
+		case 'l':
+			return e.local, nil
+		case 'o':
+			return e.senderDomain, nil
+		case 'd':
+			return domain, nil
+		case 'i':
+			return macroIP(e.ip), nil
+		case 'p':
+			// Looking up the validated name is slow and discouraged, so it is not done (RFC 7208 section 7.3)
+			return "unknown", nil
+		case 'v':
+			if e.ip.To4() != nil {
+				return "in-addr", nil
+			}
+			return "ip6", nil
+		case 'h':
+			return e.helo, nil
+		}
+		return "", &permError{fmt.Sprintf("macro %%{%c} is not allowed in a domain spec", letter)}
+	})
+	if err != nil {
+		return "", err
+	}
+	expanded = strings.TrimSuffix(expanded, ".")
+	for len(expanded) > 253 {
+		_, rest, found := strings.Cut(expanded, ".")
+		if !found {
+			break
+		}
+		expanded = rest
+	}
+	return expanded, nil
+}
+
+// macroIP formats an address for the i macro: dotted decimal, or dot separated nibbles for IPv6
+func macroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// expandMacros expands a macro string, calling value for each macro letter (RFC 7208 section 7.1)
+func expandMacros(spec string, value func(letter byte) (string, error)) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(spec) {
+			return "", &permError{"incomplete macro in " + spec}
+		}
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", &permError{"unterminated macro in " + spec}
+			}
+			expanded, err := expandMacro(spec[i+1:i+end], value)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i += end
+		default:
+			return "", &permError{"invalid macro in " + spec}
+		}
+	}
+	return out.String(), nil
+}
+
+// macroTransform matches the body of a macro: the letter, how many parts to keep,
+// whether to reverse them, and the delimiters to split on
+var macroTransform = regexp.MustCompile(`^([A-Za-z])(\d*)([rR]?)([-.+,/_=]*)$`)
+
+// expandMacro expands a single macro, such as the "ir" in %{ir}
+func expandMacro(macro string, value func(letter byte) (string, error)) (string, error) {
+	parts := macroTransform.FindStringSubmatch(macro)
+	if parts == nil {
+		return "", &permError{"invalid macro %{" + macro + "}"}
+	}
+	v, err := value(strings.ToLower(parts[1])[0])
+	if err != nil {
+		return "", err
+	}
+	delimiters := parts[4]
+	if delimiters == "" {
+		delimiters = "."
+	}
+	labels := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if parts[3] != "" {
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+	}
+	if parts[2] != "" {
+		keep, err := strconv.Atoi(parts[2])
+		if err != nil || keep == 0 {
+			return "", &permError{"invalid macro %{" + macro + "}"}
+		}
+		if keep < len(labels) {
+			labels = labels[len(labels)-keep:]
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
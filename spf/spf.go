@@ -0,0 +1,392 @@
+// Package spf checks whether a host is authorized to send mail for a domain using the
+// Sender Policy Framework (RFC 7208)
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result is the outcome of an SPF check (RFC 7208 section 2.6)
+type Result string
+
+const (
+	// None means no SPF record was found, or the domain could not be checked
+	None Result = "none"
+	// Neutral means the domain makes no assertion about the host
+	Neutral Result = "neutral"
+	// Pass means the host is authorized to send for the domain
+	Pass Result = "pass"
+	// Fail means the host is not authorized to send for the domain
+	Fail Result = "fail"
+	// SoftFail means the host is probably not authorized
+	SoftFail Result = "softfail"
+	// TempError means a transient error, usually DNS, prevented the check
+	TempError Result = "temperror"
+	// PermError means the domain's record could not be interpreted
+	PermError Result = "permerror"
+)
+
+// Processing limits from RFC 7208 section 4.6.4
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxNames       = 10
+)
+
+// defaultTimeout limits the whole check, as suggested by RFC 7208 section 4.6.4
+const defaultTimeout = 20 * time.Second
+
+// Resolver looks up the DNS records needed to evaluate SPF records; *net.Resolver implements it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Checker evaluates SPF records
+type Checker struct {
+	// Resolver looks up SPF records; defaults to net.DefaultResolver
+	Resolver Resolver
+	// Timeout limits each check; defaults to 20 seconds
+	Timeout time.Duration
+}
+
+// CheckHost evaluates the SPF record of domain for mail from sender sent by the host at ip,
+// which introduced itself with helo (RFC 7208 section 4)
+// The sender is used for macro expansion; an empty local part is treated as postmaster
+// The error describes why the result is TempError or PermError
+func (c *Checker) CheckHost(ip net.IP, domain string, sender string, helo string) (Result, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	local, senderDomain := splitSender(sender)
+	if senderDomain == "" {
+		senderDomain = domain
+	}
+	e := &evaluation{
+		ctx:          ctx,
+		resolver:     c.resolver(),
+		ip:           ip,
+		local:        local,
+		senderDomain: senderDomain,
+		helo:         helo,
+	}
+	return e.checkHost(strings.TrimSuffix(domain, "."))
+}
+
+func (c *Checker) resolver() Resolver {
+	if c.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return c.Resolver
+}
+
+// splitSender splits a sender address into its local part and domain
+func splitSender(sender string) (string, string) {
+	at := strings.LastIndex(sender, "@")
+	if at < 0 {
+		return "postmaster", sender
+	}
+	local := sender[:at]
+	if local == "" {
+		local = "postmaster"
+	}
+	return local, sender[at+1:]
+}
+
+// evaluation holds the state shared by a check and any records it includes
+type evaluation struct {
+	ctx          context.Context
+	resolver     Resolver
+	ip           net.IP
+	local        string
+	senderDomain string
+	helo         string
+	// lookups counts the terms that needed DNS queries, and voids the queries that found nothing
+	lookups int
+	voids   int
+}
+
+// checkHost implements the check_host() function of RFC 7208 section 4
+func (e *evaluation) checkHost(domain string) (Result, error) {
+	if !validDomain(domain) {
+		return None, nil
+	}
+	rec, err := e.lookupRecord(domain)
+	if err != nil {
+		return errorResult(err), err
+	}
+	if rec == "" {
+		return None, nil
+	}
+	parsed, err := parseRecord(rec)
+	if err != nil {
+		return PermError, fmt.Errorf("invalid SPF record for %s: %w", domain, err)
+	}
+
+	for _, m := range parsed.mechanisms {
+		matched, err := e.match(m, domain)
+		if err != nil {
+			return errorResult(err), err
+		}
+		if matched {
+			return m.qualifier, nil
+		}
+	}
+
+	if parsed.redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return PermError, err
+		}
+		target, err := e.expand(parsed.redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		result, err := e.checkHost(target)
+		if result == None {
+			return PermError, fmt.Errorf("redirect from %s to %s found no SPF record", domain, target)
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+// lookupRecord finds the SPF record for a domain, returning an empty string if it has none
+func (e *evaluation) lookupRecord(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("could not look up SPF record for %s: %w", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if isSPFRecord(txt) {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	default:
+		return "", &permError{fmt.Sprintf("%s has more than one SPF record", domain)}
+	}
+}
+
+// isSPFRecord checks for the version section that starts every SPF record (RFC 7208 section 4.5)
+func isSPFRecord(txt string) bool {
+	const version = "v=spf1"
+	if len(txt) < len(version) || !strings.EqualFold(txt[:len(version)], version) {
+		return false
+	}
+	return len(txt) == len(version) || txt[len(version)] == ' '
+}
+
+// match checks whether the client matches a mechanism
+// Errors are either a *permError or a temporary DNS failure
+func (e *evaluation) match(m mechanism, domain string) (bool, error) {
+	switch m.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return m.network.Contains(e.ip), nil
+	}
+
+	if err := e.countLookup(); err != nil {
+		return false, err
+	}
+	target := domain
+	if m.domainSpec != "" {
+		var err error
+		if target, err = e.expand(m.domainSpec, domain); err != nil {
+			return false, err
+		}
+	}
+
+	switch m.name {
+	case "include":
+		result, err := e.checkHost(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case TempError:
+			return false, err
+		case PermError, None:
+			if err == nil {
+				err = fmt.Errorf("included domain %s has no SPF record", target)
+			}
+			return false, &permError{err.Error()}
+		}
+		return false, nil
+	case "a":
+		return e.matchHost(target, m)
+	case "mx":
+		mxs, err := e.resolver.LookupMX(e.ctx, target)
+		if err = e.checkLookup(target, len(mxs), err); err != nil {
+			return false, err
+		}
+		if len(mxs) > maxNames {
+			return false, &permError{fmt.Sprintf("%s has more than %d MX records", target, maxNames)}
+		}
+		for _, mx := range mxs {
+			matched, err := e.matchHost(strings.TrimSuffix(mx.Host, "."), m)
+			if matched || err != nil {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		for _, name := range e.validatedNames() {
+			if strings.EqualFold(name, target) || hasDomainSuffix(name, target) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "exists":
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, target)
+		var found int
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				found++
+			}
+		}
+		if err = e.checkLookup(target, found, err); err != nil {
+			return false, err
+		}
+		return found > 0, nil
+	}
+	return false, &permError{"unknown mechanism " + m.name}
+}
+
+// matchHost checks whether the client's address is one of a host's addresses,
+// within the prefix lengths given by the mechanism
+func (e *evaluation) matchHost(host string, m mechanism) (bool, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, host)
+	if err = e.checkLookup(host, len(addrs), err); err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		var network net.IPNet
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			network = net.IPNet{IP: ip4, Mask: net.CIDRMask(m.prefix4, 32)}
+		} else {
+			network = net.IPNet{IP: addr.IP, Mask: net.CIDRMask(m.prefix6, 128)}
+		}
+		if len(network.IP) == len(e.ip) && network.Contains(e.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validatedNames finds the host names of the client whose addresses include the client's
+// address (RFC 7208 section 5.5)
+// Lookup failures are ignored, and at most maxNames names are checked
+func (e *evaluation) validatedNames() []string {
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+	var validated []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// countLookup counts a term that needs DNS queries, failing once there are too many
+func (e *evaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return &permError{fmt.Sprintf("more than %d DNS lookups", maxLookups)}
+	}
+	return nil
+}
+
+// checkLookup classifies the outcome of a DNS query made for a mechanism, counting
+// queries that found nothing
+func (e *evaluation) checkLookup(name string, found int, err error) error {
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("could not look up %s: %w", name, err)
+	}
+	if found == 0 {
+		e.voids++
+		if e.voids > maxVoidLookups {
+			return &permError{fmt.Sprintf("more than %d DNS lookups found nothing", maxVoidLookups)}
+		}
+	}
+	return nil
+}
+
+// permError is an error in the SPF record itself, which results in PermError
+type permError struct {
+	msg string
+}
+
+func (e *permError) Error() string {
+	return e.msg
+}
+
+// errorResult gives the result for an error found while checking a record
+func errorResult(err error) Result {
+	var perm *permError
+	if errors.As(err, &perm) {
+		return PermError
+	}
+	return TempError
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// validDomain checks that a name is a fully qualified domain name that can be looked up
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDomainSuffix checks whether name is a subdomain of domain
+func hasDomainSuffix(name string, domain string) bool {
+	return len(name) > len(domain) && strings.EqualFold(name[len(name)-len(domain)-1:], "."+domain)
+}
@@ -0,0 +1,244 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers DNS queries from maps, returning not found for anything else
+type fakeResolver struct {
+	txt   map[string][]string
+	hosts map[string][]string
+	mx    map[string][]*net.MX
+	ptr   map[string][]string
+	// fail lists names whose lookups fail with a temporary error
+	fail map[string]bool
+	// queries counts the lookups made
+	queries int
+}
+
+func (f *fakeResolver) lookup(name string, records map[string][]string) ([]string, error) {
+	f.queries++
+	if f.fail[name] {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	if r, ok := records[name]; ok {
+		return r, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return f.lookup(name, f.txt)
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := f.lookup(host, f.hosts)
+	var ips []net.IPAddr
+	for _, addr := range addrs {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ips, err
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	f.queries++
+	if r, ok := f.mx[name]; ok {
+		return r, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return f.lookup(addr, f.ptr)
+}
+
+func check(resolver *fakeResolver, ip string, domain string) (Result, error) {
+	c := &Checker{Resolver: resolver}
+	return c.CheckHost(net.ParseIP(ip), domain, "user@"+domain, "client.example.net")
+}
+
+func TestCheckHost(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":            {"some other record", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.example.com mx include:_spf.example.net ~all"},
+			"_spf.example.net":       {"v=spf1 ip4:203.0.113.5 -all"},
+			"strict.example.org":     {"v=spf1 a/30 -all"},
+			"neutral.example.org":    {"v=spf1 ?all"},
+			"empty.example.org":      {"v=spf1"},
+			"redirect.example.org":   {"v=spf1 redirect=_spf.example.net"},
+			"exists.example.org":     {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ptr.example.org":        {"v=spf1 ptr -all"},
+			"twice.example.org":      {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example.org":     {"v=spf1 ip4:300.0.0.1 -all"},
+			"unknown.example.org":    {"v=spf1 foo:bar -all"},
+			"badinclude.example.org": {"v=spf1 include:nothing.example.org -all"},
+			"tempfail.example.org":   {"v=spf1 a:down.example.org -all"},
+			"spf2.example.org":       {"v=spf10 +all"},
+		},
+		hosts: map[string][]string{
+			"mail.example.com":                        {"198.51.100.1"},
+			"mx.example.com":                          {"198.51.100.2", "2001:db9::2"},
+			"strict.example.org":                      {"198.51.100.8"},
+			"10.2.0.192.user._spf.exists.example.org": {"127.0.0.2"},
+			"host.ptr.example.org":                    {"198.51.100.9"},
+		},
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+		},
+		ptr: map[string][]string{
+			"198.51.100.9": {"host.ptr.example.org."},
+		},
+		fail: map[string]bool{"down.example.org": true},
+	}
+
+	tests := []struct {
+		ip     string
+		domain string
+		result Result
+	}{
+		{"192.0.2.10", "example.com", Pass},
+		{"2001:db8::1", "example.com", Pass},
+		{"::ffff:192.0.2.10", "example.com", Pass},
+		{"198.51.100.1", "example.com", Pass},
+		{"198.51.100.2", "example.com", Pass},
+		{"2001:db9::2", "example.com", Pass},
+		{"203.0.113.5", "example.com", Pass},
+		{"203.0.113.6", "example.com", SoftFail},
+		{"198.51.100.10", "strict.example.org", Pass},
+		{"198.51.100.12", "strict.example.org", Fail},
+		{"192.0.2.1", "neutral.example.org", Neutral},
+		{"192.0.2.1", "empty.example.org", Neutral},
+		{"203.0.113.5", "redirect.example.org", Pass},
+		{"203.0.113.6", "redirect.example.org", Fail},
+		{"192.0.2.10", "exists.example.org", Pass},
+		{"192.0.2.11", "exists.example.org", Fail},
+		{"198.51.100.9", "ptr.example.org", Pass},
+		{"198.51.100.10", "ptr.example.org", Fail},
+		{"192.0.2.1", "nothing.example.org", None},
+		{"192.0.2.1", "localhost", None},
+		{"192.0.2.1", "spf2.example.org", None},
+		{"192.0.2.1", "twice.example.org", PermError},
+		{"192.0.2.1", "broken.example.org", PermError},
+		{"192.0.2.1", "unknown.example.org", PermError},
+		{"192.0.2.1", "badinclude.example.org", PermError},
+		{"192.0.2.1", "tempfail.example.org", TempError},
+	}
+	for _, tt := range tests {
+		result, err := check(resolver, tt.ip, tt.domain)
+		assert.Equal(t, tt.result, result, "%s from %s", tt.domain, tt.ip)
+		if result == PermError || result == TempError {
+			assert.Error(t, err, "%s from %s", tt.domain, tt.ip)
+		} else {
+			assert.NoError(t, err, "%s from %s", tt.domain, tt.ip)
+		}
+	}
+}
+
+func TestCheckHostLimits(t *testing.T) {
+	// Each include needs a lookup, so a chain of eleven is too long
+	resolver := &fakeResolver{txt: map[string][]string{}}
+	for i := 0; i < 11; i++ {
+		name := strings.Repeat("a", i+1) + ".example.com"
+		next := strings.Repeat("a", i+2) + ".example.com"
+		resolver.txt[name] = []string{"v=spf1 include:" + next + " -all"}
+	}
+	resolver.txt[strings.Repeat("a", 12)+".example.com"] = []string{"v=spf1 +all"}
+	result, err := check(resolver, "192.0.2.1", "a.example.com")
+	assert.Equal(t, PermError, result)
+	assert.ErrorContains(t, err, "DNS lookups")
+
+	// Lookups that find nothing are limited too
+	resolver = &fakeResolver{txt: map[string][]string{
+		"void.example.com": {"v=spf1 a:one.example.com a:two.example.com a:three.example.com +all"},
+	}}
+	result, err = check(resolver, "192.0.2.1", "void.example.com")
+	assert.Equal(t, PermError, result)
+	assert.Error(t, err)
+
+	// A loop is stopped by the lookup limit
+	resolver = &fakeResolver{txt: map[string][]string{
+		"loop.example.com": {"v=spf1 include:loop.example.com -all"},
+	}}
+	result, _ = check(resolver, "192.0.2.1", "loop.example.com")
+	assert.Equal(t, PermError, result)
+	assert.Less(t, resolver.queries, 20)
+}
+
+func TestExpandMacros(t *testing.T) {
+	e := &evaluation{
+		ip:           net.ParseIP("192.0.2.3"),
+		local:        "strong-bad",
+		senderDomain: "email.example.com",
+		helo:         "mx.example.org",
+	}
+	tests := map[string]string{
+		"%{s}":                            "strong-bad@email.example.com",
+		"%{o}":                            "email.example.com",
+		"%{d}":                            "email.example.com",
+		"%{d4}":                           "email.example.com",
+		"%{d3}":                           "email.example.com",
+		"%{d2}":                           "example.com",
+		"%{d1}":                           "com",
+		"%{dr}":                           "com.example.email",
+		"%{d2r}":                          "example.email",
+		"%{l}":                            "strong-bad",
+		"%{l-}":                           "strong.bad",
+		"%{lr}":                           "strong-bad",
+		"%{lr-}":                          "bad.strong",
+		"%{l1r-}":                         "strong",
+		"%{ir}.%{v}._spf.%{d2}":           "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":            "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}": "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{h}%%%_%-":                      "mx.example.org% %20",
+	}
+	for spec, want := range tests {
+		got, err := e.expand(spec, "email.example.com")
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, got, spec)
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, err := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", got)
+
+	for _, spec := range []string{"%{x}", "%{c}", "%", "%{d", "%a", "%{d0}"} {
+		_, err := e.expand(spec, "email.example.com")
+		var perm *permError
+		assert.True(t, errors.As(err, &perm), spec)
+	}
+}
+
+func TestReceived(t *testing.T) {
+	r := Received{
+		Result:       Pass,
+		ClientIP:     net.ParseIP("192.0.2.1"),
+		EnvelopeFrom: "user@example.com",
+		Helo:         "client.example.com",
+		Identity:     "mailfrom",
+		Receiver:     "mail.example.org",
+	}
+	assert.Equal(t, "Received-SPF: pass (mail.example.org: domain of user@example.com designates 192.0.2.1 as permitted sender)\n"+
+		"\tclient-ip=192.0.2.1;\n\tenvelope-from=\"user@example.com\";\n\thelo=client.example.com;\n"+
+		"\treceiver=mail.example.org;\n\tidentity=mailfrom", r.String())
+
+	r = Received{
+		Result:   PermError,
+		Err:      errors.New(`unknown "mechanism"`),
+		ClientIP: net.ParseIP("192.0.2.1"),
+		Helo:     "[192.0.2.1] (bad)",
+		Identity: "helo",
+		Receiver: "mail.example.org",
+	}
+	header := r.String()
+	assert.Contains(t, header, `envelope-from="";`)
+	assert.Contains(t, header, `helo="[192.0.2.1] bad";`)
+	assert.Contains(t, header, `problem="unknown \"mechanism\"";`)
+}